@@ -0,0 +1,172 @@
+package certificates
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//apiKeyHeader carries an API key on a request
+const apiKeyHeader = "X-API-Key"
+
+//last used times of API keys are recorded no more often than this, so busy
+//clients do not write to the store on every request
+const apiKeyTouchEvery = time.Minute
+
+//newAPIKeyRequest is the body of a create API key request
+type newAPIKeyRequest struct {
+	Name      string
+	Scopes    []string
+	ExpiresAt time.Time //optional
+}
+
+//createdAPIKey is returned once, when a key is made; the key cannot be
+//retrieved again
+type createdAPIKey struct {
+	apiKey
+	Key string
+}
+
+//keyOwner checks the authed user may manage the API keys of the user in the
+//URL, refusing the request if not. Keys cannot manage keys, so a leaked one
+//can be revoked but never used to make more
+func keyOwner(w http.ResponseWriter, r *http.Request, allowAdmin bool) (string, bool) {
+	id := mux.Vars(r)["userID"] // id of user owning the keys
+	u := currentUser(r)
+	if u.apiKeyID != "" {
+		forbid(w, "API keys cannot be used to manage API keys")
+		return "", false
+	}
+	if u.ID != id && !(allowAdmin && u.can(permManageUsers)) {
+		forbid(w, "Cannot manage the API keys of another user")
+		return "", false
+	}
+	return id, true
+}
+
+//Handler functions
+// ~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+
+//create an API key for the authed user
+func (a *api) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, ok := keyOwner(w, r, false)
+	if !ok {
+		return
+	}
+	log.Println("Create API key for user", id)
+
+	var req newAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Println("Bad request", err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400: Invalid request body"))
+		return
+	}
+	if len(req.Scopes) == 0 {
+		log.Println("No scopes given")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400: An API key needs at least one scope"))
+		return
+	}
+	//a key can do no more than the user making it
+	u := currentUser(r)
+	for _, scope := range req.Scopes {
+		if !knownPermission(permission(scope)) {
+			log.Println("Unknown scope", scope)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400: Unknown scope " + scope))
+			return
+		}
+		if !u.can(permission(scope)) {
+			forbid(w, missingPermission(u, permission(scope)))
+			return
+		}
+	}
+	now := a.now().UTC()
+	if !req.ExpiresAt.IsZero() && !req.ExpiresAt.After(now) {
+		log.Println("API key expiry in the past")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400: ExpiresAt must be in the future"))
+		return
+	}
+
+	k := apiKey{
+		ID:        newID("k"),
+		UserID:    id,
+		Name:      req.Name,
+		Scopes:    req.Scopes,
+		CreatedAt: now,
+		ExpiresAt: req.ExpiresAt.UTC(),
+	}
+	token, hash := newOpaqueToken(k.ID)
+	k.hash = hash
+	if err := a.store.CreateAPIKey(k); err != nil {
+		log.Println("Error creating API key", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Error creating API key"))
+		return
+	}
+
+	data, _ := json.Marshal(createdAPIKey{k, token})
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(data)
+	return
+}
+
+//list the API keys of a user, revoked ones included
+func (a *api) listAPIKeys(w http.ResponseWriter, r *http.Request) {
+	id, ok := keyOwner(w, r, true)
+	if !ok {
+		return
+	}
+	log.Println("List API keys of user", id)
+
+	data, _ := json.Marshal(a.store.ListAPIKeys(id))
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+	return
+}
+
+//revoke an API key of a user
+func (a *api) revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, ok := keyOwner(w, r, true)
+	if !ok {
+		return
+	}
+	keyID := mux.Vars(r)["keyID"]
+	log.Println("Revoke API key", keyID, "of user", id)
+
+	//a key of another user is reported as missing rather than confirmed
+	if k, found := a.store.GetAPIKey(keyID); !found || k.UserID != id {
+		log.Println("API key not found")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404: API key not found"))
+		return
+	}
+	switch err := a.store.RevokeAPIKey(keyID, a.now().UTC()); err {
+	case nil:
+	case errKeyRevoked:
+		log.Println("API key already revoked")
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("409: API key is already revoked"))
+		return
+	default:
+		log.Println("Error revoking API key", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Error revoking API key"))
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("API Key Revoked"))
+	return
+}
@@ -0,0 +1,114 @@
+package certificates
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+//router, executeRequest and checkResponseCode are defined in certControllers_test.go
+//this file of unit tests can be considered an extension of that and is separated solely
+//for the purposes of separating duties and logic
+
+//createKey makes an API key on a router as a user, returning the response
+func createKey(r http.Handler, userID string, pass string, body string) (createdAPIKey, int) {
+	req, _ := http.NewRequest("POST", "/users/"+userID+"/keys", bytes.NewBufferString(body))
+	req.SetBasicAuth(userID, pass)
+	response := executeOn(r, req)
+
+	var created createdAPIKey
+	json.Unmarshal(response.Body.Bytes(), &created)
+	return created, response.Code
+}
+
+//withKey sends a request using an API key
+func withKey(r http.Handler, method string, url string, body string, key string) int {
+	req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+	req.Header.Set(apiKeyHeader, key)
+	return executeOn(r, req).Code
+}
+
+//TestAPIKey test a key works within its scopes only, records its use and stops when revoked
+func TestAPIKey(t *testing.T) {
+	store := newTestStore()
+	r := NewRouter(store)
+
+	created, code := createKey(r, "rr01", "rrejh3294", `{"Name": "inventory", "Scopes": ["transfers:read"]}`)
+	checkResponseCode(t, http.StatusCreated, code)
+	if created.Key == "" || created.UserID != "rr01" {
+		t.Fatalf("Expected a key for rr01. Got %+v", created)
+	}
+
+	checkResponseCode(t, http.StatusOK, withKey(r, "GET", "/users/rr01/transfers/outgoing", "", created.Key))
+	checkResponseCode(t, http.StatusForbidden, withKey(r, "POST", "/certificates/c001/transfers/create", `{"To": "vvg@gmail.com"}`, created.Key))
+	checkResponseCode(t, http.StatusUnauthorized, withKey(r, "GET", "/users/rr01/transfers/outgoing", "", created.Key+"x"))
+
+	req, _ := http.NewRequest("GET", "/users/rr01/keys", nil)
+	req.SetBasicAuth("rr01", "rrejh3294")
+	response := executeOn(r, req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if strings.Contains(response.Body.String(), strings.Split(created.Key, ".")[1]) {
+		t.Errorf("Expected the key's secret to stay out of the list")
+	}
+	var keys []apiKey
+	json.Unmarshal(response.Body.Bytes(), &keys)
+	if len(keys) != 1 || keys[0].LastUsedAt.IsZero() {
+		t.Errorf("Expected one key with its last use recorded. Got %+v", keys)
+	}
+
+	req, _ = http.NewRequest("DELETE", "/users/rr01/keys/"+created.ID, nil)
+	req.SetBasicAuth("rr01", "rrejh3294")
+	checkResponseCode(t, http.StatusOK, executeOn(r, req).Code)
+	checkResponseCode(t, http.StatusConflict, executeOn(r, req).Code)
+	checkResponseCode(t, http.StatusUnauthorized, withKey(r, "GET", "/users/rr01/transfers/outgoing", "", created.Key))
+}
+
+//TestAPIKeyScopes test keys cannot be scoped beyond what their user may do
+func TestAPIKeyScopes(t *testing.T) {
+	r := NewRouter(newTestStore())
+	_, code := createKey(r, "vvg01", "vwh39043f", `{"Scopes": ["users:manage"]}`)
+	checkResponseCode(t, http.StatusForbidden, code)
+	_, code = createKey(r, "vvg01", "vwh39043f", `{"Scopes": ["everything"]}`)
+	checkResponseCode(t, http.StatusBadRequest, code)
+	_, code = createKey(r, "vvg01", "vwh39043f", `{"Scopes": []}`)
+	checkResponseCode(t, http.StatusBadRequest, code)
+}
+
+//TestAPIKeyExpiry test a key stops working once it expires
+func TestAPIKeyExpiry(t *testing.T) {
+	clock := newTestClock()
+	r := NewRouter(newTestStore(), WithClock(clock.Now))
+	expires, _ := json.Marshal(clock.Now().Add(time.Hour))
+	created, code := createKey(r, "rr01", "rrejh3294", `{"Scopes": ["transfers:read"], "ExpiresAt": `+string(expires)+`}`)
+	checkResponseCode(t, http.StatusCreated, code)
+
+	checkResponseCode(t, http.StatusOK, withKey(r, "GET", "/users/rr01/transfers/outgoing", "", created.Key))
+	clock.Advance(time.Hour)
+	checkResponseCode(t, http.StatusUnauthorized, withKey(r, "GET", "/users/rr01/transfers/outgoing", "", created.Key))
+}
+
+//TestAPIKeyManagement test keys are managed by their user or an admin, and never with a key
+func TestAPIKeyManagement(t *testing.T) {
+	r := NewRouter(newTestStore())
+	created, _ := createKey(r, "vvg01", "vwh39043f", `{"Scopes": ["transfers:read", "transfers:write"]}`)
+
+	checkResponseCode(t, http.StatusForbidden, withKey(r, "POST", "/users/vvg01/keys", `{"Scopes": ["transfers:read"]}`, created.Key))
+	checkResponseCode(t, http.StatusForbidden, withKey(r, "GET", "/users/vvg01/keys", "", created.Key))
+
+	req, _ := http.NewRequest("GET", "/users/rr01/keys", nil)
+	req.SetBasicAuth("vvg01", "vwh39043f")
+	checkResponseCode(t, http.StatusForbidden, executeOn(r, req).Code)
+
+	//an admin can see and revoke the keys of others but not make them
+	req, _ = http.NewRequest("DELETE", "/users/vvg01/keys/"+created.ID, nil)
+	req.SetBasicAuth("rr01", "rrejh3294")
+	checkResponseCode(t, http.StatusOK, executeOn(r, req).Code)
+	_, code := createKey(r, "vvg01", "wrong", `{"Scopes": ["transfers:read"]}`)
+	checkResponseCode(t, http.StatusUnauthorized, code)
+	req, _ = http.NewRequest("POST", "/users/vvg01/keys", bytes.NewBufferString(`{"Scopes": ["transfers:read"]}`))
+	req.SetBasicAuth("rr01", "rrejh3294")
+	checkResponseCode(t, http.StatusForbidden, executeOn(r, req).Code)
+}
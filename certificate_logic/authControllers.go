@@ -0,0 +1,254 @@
+package certificates
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+)
+
+//errBadCredentials is returned for a request whose credentials do not check out
+var errBadCredentials = errors.New("incorrect user credentials")
+
+//credentials is the body of a login request
+type credentials struct {
+	UserID   string
+	Password string
+}
+
+//refreshRequest is the body of a refresh request
+type refreshRequest struct {
+	RefreshToken string
+}
+
+//tokenResponse is returned by login and refresh
+type tokenResponse struct {
+	AccessToken  string
+	TokenType    string
+	ExpiresIn    int //seconds until the access token expires
+	RefreshToken string
+}
+
+//bearerToken returns the token of an `Authorization: Bearer` header, if any
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", false
+	}
+	return header[len(prefix):], true
+}
+
+//authBearer checks an access token and returns the user and session it was
+//issued for, provided the session has not been revoked
+func (a *api) authBearer(token string) (user, session, bool) {
+	claims, err := parseToken(a.keys, token, a.now())
+	if err != nil {
+		log.Println("Rejected access token:", err)
+		return user{}, session{}, false
+	}
+	sess, found := a.store.GetSession(claims.SessionID)
+	if !found || !sess.active(a.now()) || sess.UserID != claims.Subject {
+		log.Println("Rejected access token: session", claims.SessionID, "is not active")
+		return user{}, session{}, false
+	}
+	u, found := a.store.GetUser(claims.Subject)
+	if !found || !u.active() {
+		return user{}, session{}, false
+	}
+	return u, sess, true
+}
+
+//authAPIKey checks an API key and returns its user, limited to the key's
+//scopes. Use of the key is recorded at most once every apiKeyTouchEvery
+func (a *api) authAPIKey(token string) (user, bool) {
+	id, hash, ok := splitOpaqueToken(token)
+	if !ok {
+		return user{}, false
+	}
+	k, found := a.store.GetAPIKey(id)
+	if !found || !sameHash(k.hash, hash) || !k.active(a.now()) {
+		log.Println("Rejected API key", id)
+		return user{}, false
+	}
+	u, found := a.store.GetUser(k.UserID)
+	if !found || !u.active() {
+		return user{}, false
+	}
+	if now := a.now().UTC(); now.Sub(k.LastUsedAt) >= apiKeyTouchEvery {
+		if err := a.store.TouchAPIKey(k.ID, now); err != nil {
+			log.Println("Error recording use of API key", err)
+		}
+	}
+	u.apiKeyID = k.ID
+	u.scopes = make([]permission, len(k.Scopes))
+	for i, s := range k.Scopes {
+		u.scopes[i] = permission(s)
+	}
+	return u, true
+}
+
+//authRequest authenticates a request by its API key, its bearer token, or
+//failing those by its basic auth credentials. The session is only set for a
+//bearer token. It fails with errBadCredentials, or a lockedError for basic
+//auth while the user or client is locked out
+func (a *api) authRequest(r *http.Request) (user, session, error) {
+	if key := r.Header.Get(apiKeyHeader); key != "" {
+		if u, valid := a.authAPIKey(key); valid {
+			return u, session{}, nil
+		}
+		return user{}, session{}, errBadCredentials
+	}
+	if token, found := bearerToken(r); found {
+		if u, sess, valid := a.authBearer(token); valid {
+			return u, sess, nil
+		}
+		return user{}, session{}, errBadCredentials
+	}
+	id, pass, _ := r.BasicAuth()
+	u, err := a.checkPasswordFrom(r, id, pass)
+	return u, session{}, err
+}
+
+//issueTokens gives out a new access token for a session along with the
+//refresh token already stored for it
+func (a *api) issueTokens(w http.ResponseWriter, sess session, refreshToken string) {
+	now := a.now()
+	access := signToken(a.keys, accessClaims{
+		Subject:   sess.UserID,
+		SessionID: sess.ID,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(a.accessTTL).Unix(),
+	})
+	data, _ := json.Marshal(tokenResponse{
+		AccessToken:  access,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(a.accessTTL.Seconds()),
+		RefreshToken: refreshToken,
+	})
+
+	//tokens must not end up in a shared cache
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+//Handler functions
+// ~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+
+//log a user in, starting a session
+func (a *api) login(w http.ResponseWriter, r *http.Request) {
+	var creds credentials
+	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+		log.Println("Bad request", err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400: Invalid request body"))
+		return
+	}
+	log.Println("Login of user", creds.UserID)
+
+	u, err := a.checkPasswordFrom(r, creds.UserID, creds.Password)
+	if locked, ok := err.(lockedError); ok {
+		tooManyAttempts(w, locked)
+		return
+	}
+	if err != nil {
+		log.Println("Unauthorized")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("401: Incorrect user credentials"))
+		return
+	}
+
+	now := a.now().UTC()
+	sess := session{ID: newID("s"), UserID: u.ID, CreatedAt: now, ExpiresAt: now.Add(a.refreshTTL)}
+	refreshToken, hash := newOpaqueToken(sess.ID)
+	sess.RefreshHash = hash
+	if err := a.store.CreateSession(sess); err != nil {
+		log.Println("Error creating session", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Error logging in"))
+		return
+	}
+
+	log.Println("Session", sess.ID, "started")
+	a.issueTokens(w, sess, refreshToken)
+}
+
+//exchange a refresh token for a new access token and refresh token. Each
+//refresh token works once; using one again revokes its session, as only
+//a stolen copy would be used after it was replaced
+func (a *api) refresh(w http.ResponseWriter, r *http.Request) {
+	var req refreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Println("Bad request", err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400: Invalid request body"))
+		return
+	}
+
+	id, hash, ok := splitOpaqueToken(req.RefreshToken)
+	sess, found := a.store.GetSession(id)
+	//the sessions of a deactivated user are left to lapse
+	u, _ := a.store.GetUser(sess.UserID)
+	if !ok || !found || !sess.active(a.now()) || !u.active() {
+		log.Println("Unauthorized")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("401: Invalid or expired refresh token"))
+		return
+	}
+	log.Println("Refresh session", id)
+
+	refreshToken, newHash := newOpaqueToken(id)
+	expires := a.now().UTC().Add(a.refreshTTL)
+	switch err := a.store.RefreshSession(id, hash, newHash, expires); err {
+	case nil:
+	case errRefreshReused:
+		log.Println("Refresh token reused, revoking session", id)
+		a.store.RevokeSession(id, a.now().UTC())
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("401: Invalid or expired refresh token"))
+		return
+	case errSessionNotFound, errSessionRevoked:
+		log.Println("Unauthorized", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("401: Invalid or expired refresh token"))
+		return
+	default:
+		log.Println("Error refreshing session", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Error refreshing session"))
+		return
+	}
+
+	sess.RefreshHash = newHash
+	sess.ExpiresAt = expires
+	a.issueTokens(w, sess, refreshToken)
+}
+
+//log out, revoking the session of the access token used along with every
+//token issued for it
+func (a *api) logout(w http.ResponseWriter, r *http.Request) {
+	sess, found := currentSession(r)
+	if !found {
+		log.Println("Logout without a session")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400: Log out with the bearer token of the session to end"))
+		return
+	}
+
+	//a concurrent logout of the same session has done the job already
+	if err := a.store.RevokeSession(sess.ID, a.now().UTC()); err != nil && err != errSessionRevoked {
+		log.Println("Error revoking session", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Error logging out"))
+		return
+	}
+
+	log.Println("Session", sess.ID, "revoked")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Logged Out"))
+}
@@ -0,0 +1,141 @@
+package certificates
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+//router, executeRequest and checkResponseCode are defined in certControllers_test.go
+//this file of unit tests can be considered an extension of that and is separated solely
+//for the purposes of separating duties and logic
+
+//login logs a user in on a router and returns the tokens handed out
+func login(t *testing.T, r http.Handler, userID string, pass string) tokenResponse {
+	body, _ := json.Marshal(credentials{UserID: userID, Password: pass})
+	req, _ := http.NewRequest("POST", "/auth/login", bytes.NewBuffer(body))
+	response := executeOn(r, req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var tokens tokenResponse
+	json.Unmarshal(response.Body.Bytes(), &tokens)
+	return tokens
+}
+
+//refreshTokens exchanges a refresh token on a router
+func refreshTokens(r http.Handler, refreshToken string) (tokenResponse, int) {
+	body, _ := json.Marshal(refreshRequest{RefreshToken: refreshToken})
+	req, _ := http.NewRequest("POST", "/auth/refresh", bytes.NewBuffer(body))
+	response := executeOn(r, req)
+
+	var tokens tokenResponse
+	json.Unmarshal(response.Body.Bytes(), &tokens)
+	return tokens, response.Code
+}
+
+//withBearer sends a request to list rr01's outgoing transfers using an access token
+func withBearer(r http.Handler, token string) int {
+	req, _ := http.NewRequest("GET", "/users/rr01/transfers/outgoing", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return executeOn(r, req).Code
+}
+
+//TestLogin test the access token from a login works in place of basic auth
+func TestLogin(t *testing.T) {
+	tokens := login(t, router, "rr01", "rrejh3294")
+	if tokens.TokenType != "Bearer" || tokens.AccessToken == "" || tokens.RefreshToken == "" {
+		t.Fatalf("Expected bearer and refresh tokens. Got %+v", tokens)
+	}
+	checkResponseCode(t, http.StatusOK, withBearer(router, tokens.AccessToken))
+
+	//a token is only good for its own user
+	req, _ := http.NewRequest("GET", "/users/vvg01/transfers/outgoing", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	checkResponseCode(t, http.StatusForbidden, executeRequest(req).Code)
+}
+
+//TestLoginBadCredentials test logging in with a wrong password or unknown user
+func TestLoginBadCredentials(t *testing.T) {
+	for _, creds := range []credentials{{"rr01", "rr"}, {"kh01", "rrejh3294"}} {
+		body, _ := json.Marshal(creds)
+		req, _ := http.NewRequest("POST", "/auth/login", bytes.NewBuffer(body))
+		checkResponseCode(t, http.StatusUnauthorized, executeRequest(req).Code)
+	}
+}
+
+//TestBadAccessToken test tokens that are altered or signed by another key are refused
+func TestBadAccessToken(t *testing.T) {
+	tokens := login(t, router, "rr01", "rrejh3294")
+	tampered := tokens.AccessToken[:len(tokens.AccessToken)-2] + "xx"
+	checkResponseCode(t, http.StatusUnauthorized, withBearer(router, tampered))
+
+	//a router with a key of its own over the same store
+	other := NewRouter(testStore)
+	checkResponseCode(t, http.StatusUnauthorized, withBearer(other, tokens.AccessToken))
+}
+
+//TestAccessTokenExpiry test an access token stops working after its lifetime
+//while the refresh token gets a new one
+func TestAccessTokenExpiry(t *testing.T) {
+	clock := newTestClock()
+	r := NewRouter(NewMemoryStore(), WithClock(clock.Now), WithTokenTTL(time.Minute, time.Hour))
+	tokens := login(t, r, "rr01", "rrejh3294")
+
+	clock.Advance(time.Minute)
+	checkResponseCode(t, http.StatusUnauthorized, withBearer(r, tokens.AccessToken))
+
+	refreshed, code := refreshTokens(r, tokens.RefreshToken)
+	checkResponseCode(t, http.StatusOK, code)
+	checkResponseCode(t, http.StatusOK, withBearer(r, refreshed.AccessToken))
+
+	//the session ends an hour after its last refresh
+	clock.Advance(time.Hour)
+	_, code = refreshTokens(r, refreshed.RefreshToken)
+	checkResponseCode(t, http.StatusUnauthorized, code)
+}
+
+//TestRefreshTokenReuse test a refresh token works once, and using it again
+//revokes the session
+func TestRefreshTokenReuse(t *testing.T) {
+	r := NewRouter(NewMemoryStore())
+	tokens := login(t, r, "rr01", "rrejh3294")
+
+	refreshed, code := refreshTokens(r, tokens.RefreshToken)
+	checkResponseCode(t, http.StatusOK, code)
+	if refreshed.RefreshToken == tokens.RefreshToken {
+		t.Errorf("Expected a new refresh token")
+	}
+
+	_, code = refreshTokens(r, tokens.RefreshToken)
+	checkResponseCode(t, http.StatusUnauthorized, code)
+	checkResponseCode(t, http.StatusUnauthorized, withBearer(r, refreshed.AccessToken))
+	_, code = refreshTokens(r, refreshed.RefreshToken)
+	checkResponseCode(t, http.StatusUnauthorized, code)
+}
+
+//TestLogout test logging out revokes both tokens of the session and no other
+func TestLogout(t *testing.T) {
+	r := NewRouter(NewMemoryStore())
+	tokens := login(t, r, "rr01", "rrejh3294")
+	other := login(t, r, "rr01", "rrejh3294")
+
+	req, _ := http.NewRequest("POST", "/auth/logout", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	checkResponseCode(t, http.StatusOK, executeOn(r, req).Code)
+
+	checkResponseCode(t, http.StatusUnauthorized, withBearer(r, tokens.AccessToken))
+	_, code := refreshTokens(r, tokens.RefreshToken)
+	checkResponseCode(t, http.StatusUnauthorized, code)
+	checkResponseCode(t, http.StatusOK, withBearer(r, other.AccessToken))
+}
+
+//TestLogoutBasicAuth test logging out needs the bearer token of a session
+func TestLogoutBasicAuth(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/auth/logout", nil)
+	checkResponseCode(t, http.StatusUnauthorized, executeRequest(req).Code)
+
+	req.SetBasicAuth("rr01", "rrejh3294")
+	checkResponseCode(t, http.StatusBadRequest, executeRequest(req).Code)
+}
@@ -0,0 +1,155 @@
+package certificates
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+//roles a user can hold; a user may hold several
+const (
+	roleArtist    = "artist"
+	roleCollector = "collector"
+	roleGallery   = "gallery"
+	roleAdmin     = "admin"
+)
+
+//permission names something a user may do. Routes declare the permission
+//they need and handlers check the finer rules, such as owning the certificate
+type permission string
+
+const (
+	//no permission is needed beyond what the route's authLevel asks
+	noPermission permission = ""
+
+	permIssueCerts = permission("certificates:issue")
+	//change the note of certificates the user owns
+	permEditCerts = permission("certificates:edit")
+	//change the title, year and creation date of certificates the user issued
+	permEditDetails = permission("certificates:edit_details")
+	//change any certificate as if its owner and issuer
+	permManageCerts  = permission("certificates:manage")
+	permDeleteCerts  = permission("certificates:delete")
+	permRevokeCerts  = permission("certificates:revoke")
+	permReadTransfer = permission("transfers:read")
+	//create, accept, reject and cancel transfers
+	permWriteTransfer = permission("transfers:write")
+	permManageUsers   = permission("users:manage")
+	//rotate and revoke the server's signing keys
+	permManageKeys = permission("keys:manage")
+)
+
+//rolePermissions lists what each role allows
+var rolePermissions = map[string][]permission{
+	roleArtist:    {permIssueCerts, permEditCerts, permEditDetails, permReadTransfer, permWriteTransfer},
+	roleCollector: {permEditCerts, permReadTransfer, permWriteTransfer},
+	roleGallery:   {permIssueCerts, permEditCerts, permReadTransfer, permWriteTransfer},
+	roleAdmin: {permIssueCerts, permEditCerts, permEditDetails, permManageCerts, permDeleteCerts,
+		permRevokeCerts, permReadTransfer, permWriteTransfer, permManageUsers, permManageKeys},
+}
+
+//knownRole reports whether a role exists
+func knownRole(role string) bool {
+	_, found := rolePermissions[role]
+	return found
+}
+
+//roleList returns the roles of a user. Users stored before roles existed
+//have none and count as collectors
+func (u user) roleList() []string {
+	if len(u.Roles) == 0 {
+		return []string{roleCollector}
+	}
+	return u.Roles
+}
+
+//hasRole reports whether a user holds a role
+func (u user) hasRole(role string) bool {
+	for _, r := range u.roleList() {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+//GrantAdmin gives the user with the ID given the admin role on top of the
+//roles they hold. No user is an admin to begin with, so this is how the
+//first one is made; the rest can then be made through the API
+func GrantAdmin(store CertificateStore, id string) error {
+	u, found := store.GetUser(id)
+	if !found {
+		return errUserNotFound
+	}
+	if u.hasRole(roleAdmin) {
+		return nil
+	}
+	return store.SetRoles(id, append(append([]string(nil), u.roleList()...), roleAdmin))
+}
+
+//knownPermission reports whether any role grants a permission
+func knownPermission(p permission) bool {
+	return len(rolesGranting(p)) > 0
+}
+
+//scoped reports whether a request made with an API key may use a
+//permission; requests made otherwise may use any
+func (u user) scoped(p permission) bool {
+	if u.apiKeyID == "" {
+		return true
+	}
+	for _, s := range u.scopes {
+		if s == p {
+			return true
+		}
+	}
+	return false
+}
+
+//can reports whether any of a user's roles grants a permission, and the API
+//key the request was made with, if any, is scoped for it
+func (u user) can(p permission) bool {
+	if !u.scoped(p) {
+		return false
+	}
+	for _, r := range u.roleList() {
+		for _, granted := range rolePermissions[r] {
+			if granted == p {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//rolesGranting lists the roles that grant a permission, for error messages
+func rolesGranting(p permission) []string {
+	roles := []string{}
+	for role, perms := range rolePermissions {
+		for _, granted := range perms {
+			if granted == p {
+				roles = append(roles, role)
+			}
+		}
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+//missingPermission explains why a user was refused a permission
+func missingPermission(u user, p permission) string {
+	if !u.scoped(p) {
+		return fmt.Sprintf("Permission %s is needed, which API key %s is not scoped for", p, u.apiKeyID)
+	}
+	return fmt.Sprintf("Permission %s is needed, which comes with the role %s; user %s has %s",
+		p, strings.Join(rolesGranting(p), " or "), u.ID, strings.Join(u.roleList(), ", "))
+}
+
+//forbid refuses a request made with valid credentials, giving the reason
+func forbid(w http.ResponseWriter, reason string) {
+	log.Println("Forbidden:", reason)
+	w.WriteHeader(http.StatusForbidden)
+	w.Write([]byte("403: " + reason))
+}
@@ -1,6 +1,7 @@
 package certificates
 
 import (
+	"bytes"
 	"encoding/json"
 	"io/ioutil"
 	"log"
@@ -9,55 +10,111 @@ import (
 	"github.com/gorilla/mux"
 )
 
+//certWithProvenance is a certificate along with its chain of owners
+type certWithProvenance struct {
+	certificate
+	Provenance []ownershipChange
+}
+
+//signatureCheck is the outcome of checking the signature of a certificate document
+type signatureCheck struct {
+	Valid   bool //signed by this server and unchanged since
+	Current bool //valid, and the certificate is still stored as it is
+	KeyID   string
+	Reason  string      `json:",omitempty"` //why the document is not valid
+	Revoked *revocation `json:",omitempty"` //set if the certificate has been revoked since
+}
+
 //Data altering functions
 // ~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
 
 //search data for certificate by id; this is called in getCert
-func lookupCert(id string) (certificate, bool) {
-	for _, element := range certs {
-		if element.ID == id {
-			return element, true
-		}
-	}
-	return certificate{}, false
+func (a *api) lookupCert(id string) (certificate, bool) {
+	return a.store.GetCert(id)
 }
 
 //update cert collection given updated cert, returns a status code
 //code 1: update successful
-//code 2: update failed due to owner change attempt
+//code 2: update failed as the cert has another owner
 //code 3: update failed cert not found
-func updateCertCollection(uc certificate) int {
-	for index, element := range certs {
-		if element.ID == uc.ID {
-			if element.OwnerID != uc.OwnerID {
-				return 2
-			}
-			certs[index] = uc
-			return 1
-		}
+//code 4: update failed as the cert is revoked
+//code 5: update failed to be stored
+func (a *api) updateCertCollection(uc certificate) int {
+	switch err := a.store.UpdateCert(uc); err {
+	case nil:
+		return 1
+	case errOwnerChange:
+		return 2
+	case errCertNotFound:
+		return 3
+	case errCertRevoked:
+		return 4
+	default:
+		log.Println("Error updating certificate", err)
+	}
+	return 5
+}
+
+//delete cert from collection given cert id and its owner, returns a status code
+//code 1: delete successful
+//code 2: delete failed as the cert has another owner
+//code 3: delete failed cert not found
+//code 4: delete failed as the cert is revoked and kept as evidence
+//code 5: delete failed to be stored
+func (a *api) deleteCertFromCollection(id string, ownerID string) int {
+	switch err := a.store.DeleteCert(id, ownerID); err {
+	case nil:
+		return 1
+	case errNotOwner:
+		return 2
+	case errCertNotFound:
+		return 3
+	case errCertRevoked:
+		return 4
+	default:
+		log.Println("Error deleting certificate", err)
 	}
-	return 3
+	return 5
 }
 
-//delete cert from collection given cert id, returns success bool
-func deleteCertFromCollection(id string) bool {
-	for index, element := range certs {
-		if element.ID == id {
-			//remove element at index; linear time, can be faster if maintaining order doesn't matter
-			certs = append(certs[:index], certs[index+1:]...)
-			return true
+//mayUpdate checks a user may make the changes between the stored cert and
+//the updated one, returning the reason if not. The owner edits the note; the
+//issuing artist edits the title, year and creation date. Both may also be
+//done by a user who manages certificates
+func (a *api) mayUpdate(u user, current certificate, updated certificate) (string, bool) {
+	if u.can(permManageCerts) {
+		return "", true
+	}
+	details := updated.Title != current.Title || updated.Year != current.Year ||
+		!updated.CreatedAt.Equal(current.CreatedAt)
+	//an update changing nothing is still only for the owner
+	if updated.Note != current.Note || !details {
+		if !u.can(permEditCerts) {
+			return missingPermission(u, permEditCerts), false
+		}
+		if current.OwnerID != u.ID {
+			return "Certificate belongs to another user", false
 		}
 	}
-	return false
+	if details {
+		if !u.can(permEditDetails) {
+			return missingPermission(u, permEditDetails), false
+		}
+		//whoever the certificate was issued to is its artist
+		if history, _ := a.store.GetProvenance(current.ID); len(history) == 0 || history[0].To != u.ID {
+			return "Only the issuing artist may change a certificate's Title, Year or CreatedAt", false
+		}
+	}
+	return "", true
 }
 
 //Handler functions
 // ~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
 
 //get all certificates
-func getAllCerts(w http.ResponseWriter, r *http.Request) {
+func (a *api) getAllCerts(w http.ResponseWriter, r *http.Request) {
 	log.Println("Printing All Certificates")
-	data, _ := json.Marshal(certs)
+	data, _ := json.Marshal(a.store.ListCerts())
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.WriteHeader(http.StatusOK)
@@ -66,13 +123,13 @@ func getAllCerts(w http.ResponseWriter, r *http.Request) {
 }
 
 //get certificate by id
-func getCert(w http.ResponseWriter, r *http.Request) {
+func (a *api) getCert(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	//log.Println(vars)
 	id := vars["id"] // id of certificate to be retrieved
 	log.Println("Get cert", id)
 
-	cert, found := lookupCert(id)
+	cert, found := a.lookupCert(id)
 
 	//if cert not found
 	if !found {
@@ -82,7 +139,14 @@ func getCert(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	data, _ := json.Marshal(cert) //convert data returned to json
+	var data []byte
+	//provenance is added to the response when asked for with ?include=provenance
+	if r.URL.Query().Get("include") == "provenance" {
+		history, _ := a.store.GetProvenance(id)
+		data, _ = json.Marshal(certWithProvenance{cert, history})
+	} else {
+		data, _ = json.Marshal(cert) //convert data returned to json
+	}
 
 	//create and write http response
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
@@ -93,8 +157,34 @@ func getCert(w http.ResponseWriter, r *http.Request) {
 
 }
 
+//get the chain of owners of a certificate, oldest first
+func (a *api) getProvenance(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"] // id of certificate whose owners are listed
+	log.Println("Get provenance of cert", id)
+
+	history, found := a.store.GetProvenance(id)
+
+	//if cert not found
+	if !found {
+		log.Println("Certificate not found")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404: Certificate not found"))
+		return
+	}
+
+	data, _ := json.Marshal(history) //convert data returned to json
+
+	//create and write http response
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+	return
+}
+
 //create certificate from data sent in request
-func createCert(w http.ResponseWriter, r *http.Request) {
+func (a *api) createCert(w http.ResponseWriter, r *http.Request) {
 	var newCert certificate
 	body, err := ioutil.ReadAll(r.Body)
 
@@ -118,18 +208,25 @@ func createCert(w http.ResponseWriter, r *http.Request) {
 
 	log.Println("New certificate create")
 
-	//owner of cert passed as a custom header
-	owner := r.Header.Get("OwnerID")
-
-	// ownerid header missing
-	if owner == "" {
-		log.Println("Header ownerID required to create certificate")
-		w.WriteHeader(http.StatusForbidden)
-		w.Write([]byte("Forbidden: Header ownerID required to create certificate"))
+	//the authed user owns what they create, whatever the body says
+	newCert.OwnerID = currentUser(r).ID
+	switch err := a.store.CreateCert(newCert); err {
+	case nil:
+	case errCertExists:
+		log.Println("Error creating certificate", err)
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("409: Certificate already exists"))
+		return
+	default:
+		log.Println("Error creating certificate", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Error creating certificate"))
 		return
 	}
-	newCert.OwnerID = owner
-	certs = append(certs, newCert)
+	//respond with the certificate as stored, signature and all
+	if stored, found := a.lookupCert(newCert.ID); found {
+		newCert = stored
+	}
 
 	//create and write http response
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
@@ -141,7 +238,7 @@ func createCert(w http.ResponseWriter, r *http.Request) {
 }
 
 //update certificate
-func updateCert(w http.ResponseWriter, r *http.Request) {
+func (a *api) updateCert(w http.ResponseWriter, r *http.Request) {
 	var updatedCert certificate
 	body, err := ioutil.ReadAll(r.Body)
 
@@ -165,32 +262,74 @@ func updateCert(w http.ResponseWriter, r *http.Request) {
 
 	log.Println("Updated certificate")
 
-	//changing owner is done by a transfer
-	//ownerid header not required for update UNLESS the record must be created
+	user := currentUser(r)
+	current, found := a.lookupCert(updatedCert.ID)
+	if found {
+		//changing owner is done by a transfer, so the owner always stays the same
+		if updatedCert.OwnerID != "" && updatedCert.OwnerID != current.OwnerID {
+			forbid(w, "Owner change attempted; Must be done by transfer")
+			return
+		}
+		if reason, allowed := a.mayUpdate(user, current, updatedCert); !allowed {
+			forbid(w, reason)
+			return
+		}
+		updatedCert.OwnerID = current.OwnerID
+	} else {
+		//not found, cert is created for the authed user
+		if !user.can(permIssueCerts) {
+			forbid(w, missingPermission(user, permIssueCerts))
+			return
+		}
+		updatedCert.OwnerID = user.ID
+	}
 
-	updateStatus := updateCertCollection(updatedCert)
+	updateStatus := 3
+	if found {
+		updateStatus = a.updateCertCollection(updatedCert)
+	}
 
-	//error owner change is attempted
+	//owner changed by a transfer since the cert was checked
 	if updateStatus == 2 {
-		log.Println("Owner change attempted; Must be done by transfer")
+		log.Println("Owner of cert", updatedCert.ID, "changed during update")
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("409: Certificate changed hands during the update, try again"))
+		return
+	}
+
+	//a revoked cert is kept as it was
+	if updateStatus == 4 {
+		log.Println("Cert", updatedCert.ID, "is revoked")
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("409: Certificate has been revoked"))
+		return
+	}
+
+	if updateStatus == 5 {
 		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Owner change attempted; Must be done by transfer"))
+		w.Write([]byte("Error updating certificate"))
 		return
 	}
 
-	//not found, cert must be created
 	if updateStatus == 3 {
-		owner := r.Header.Get("OwnerID")
-
-		// ownerid header missing
-		if owner == "" {
-			log.Println("Header ownerID required to create certificate")
-			w.WriteHeader(http.StatusForbidden)
-			w.Write([]byte("Forbidden: Record not found, thus header ownerID required to create certificate"))
+		switch err := a.store.CreateCert(updatedCert); err {
+		case nil:
+		case errCertExists:
+			//created by someone else since the cert was looked up
+			log.Println("Error creating certificate", err)
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte("409: Certificate already exists"))
+			return
+		default:
+			log.Println("Error creating certificate", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Error creating certificate"))
 			return
 		}
-		updatedCert.OwnerID = owner
-		certs = append(certs, updatedCert)
+	}
+	//respond with the certificate as stored, signature and all
+	if stored, found := a.lookupCert(updatedCert.ID); found {
+		updatedCert = stored
 	}
 
 	//create and write http response
@@ -203,23 +342,95 @@ func updateCert(w http.ResponseWriter, r *http.Request) {
 
 }
 
+//check a certificate document was signed by this server and has not been
+//altered since. Only the document and the server's keys are needed, so it
+//also tells whether a copy kept from earlier is still the current version
+func (a *api) verifyCert(w http.ResponseWriter, r *http.Request) {
+	var doc certificate
+	body, err := ioutil.ReadAll(r.Body)
+
+	if err != nil {
+		log.Println("Error verifying certificate", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Error verifying certificate"))
+		return
+	}
+
+	//unmarshal content of request body as a certificate
+	err = json.Unmarshal(body, &doc)
+
+	//bad json data
+	if err != nil {
+		log.Println("Error verifying certificate", err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Error verifying certificate, bad JSON data"))
+		return
+	}
+
+	log.Println("Verify signature of cert", doc.ID)
+
+	check := signatureCheck{KeyID: doc.KeyID}
+	if err := a.keys.verifyCert(doc); err != nil {
+		check.Reason = err.Error()
+	} else {
+		check.Valid = true
+		stored, found := a.lookupCert(doc.ID)
+		check.Current = found && bytes.Equal(canonicalCert(stored), canonicalCert(doc))
+		check.Revoked = stored.Revoked
+	}
+
+	//create and write http response
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	data, _ := json.Marshal(check)
+	w.Write(data)
+	return
+}
+
 //delete certificate
-func deleteCert(w http.ResponseWriter, r *http.Request) {
+func (a *api) deleteCert(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	//log.Println(vars)
 	id := vars["id"] // id of certificate to be deleted
 	log.Println("Attempt to delete cert", id)
 
-	found := deleteCertFromCollection(id)
+	//managers of certificates delete any, others only their own
+	user := currentUser(r)
+	ownerID := user.ID
+	if user.can(permManageCerts) {
+		ownerID = ""
+	}
+	deleteStatus := a.deleteCertFromCollection(id, ownerID)
+
+	//cert belongs to someone else
+	if deleteStatus == 2 {
+		forbid(w, "Certificate belongs to another user")
+		return
+	}
+
+	//revoked certs are kept as evidence
+	if deleteStatus == 4 {
+		log.Println("Certificate is revoked")
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("409: Certificate has been revoked and is kept as evidence"))
+		return
+	}
 
 	//if cert not found
-	if !found {
+	if deleteStatus == 3 {
 		log.Println("Certificate not found")
 		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte("404: Certificate not found"))
 		return
 	}
 
+	if deleteStatus == 5 {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Error deleting certificate"))
+		return
+	}
+
 	//create and write http response
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
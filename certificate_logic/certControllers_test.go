@@ -3,16 +3,50 @@ package certificates
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
-var router = NewRouter()
+func TestMain(m *testing.M) {
+	//full strength hashing makes every login in the tests slow
+	passwordIterations = 1000
+	os.Exit(m.Run())
+}
+
+//newTestStore returns a memory store loaded with the static data in which
+//rr01 has been made an admin
+func newTestStore() *memoryStore {
+	store := newSeededStore()
+	GrantAdmin(store, "rr01")
+	return store
+}
+
+//testStore backs the router shared by every test in this package
+var testStore = newTestStore()
+var router = NewRouter(testStore)
+
+//storedCert fetches a certificate straight from the test store
+func storedCert(t *testing.T, id string) certificate {
+	c, found := testStore.GetCert(id)
+	if !found {
+		t.Fatalf("Expected certificate '%s' to be stored", id)
+	}
+	return c
+}
 
 func executeRequest(req *http.Request) *httptest.ResponseRecorder {
+	return executeOn(router, req)
+}
+
+//executeOn runs a request against a router other than the shared one
+func executeOn(r http.Handler, req *http.Request) *httptest.ResponseRecorder {
 	rec := httptest.NewRecorder()
-	router.ServeHTTP(rec, req)
+	r.ServeHTTP(rec, req)
 
 	return rec
 }
@@ -61,7 +95,7 @@ func TestCreatCert(t *testing.T) {
 	testcert := []byte(`{"ID": "c003","Title": "The Yellow House","CreatedAt": "2009-11-17T20:34:58.651387237Z","OwnerID": "rr01","Year": 1888,"Note": "","Transfer": {"To": "","Status": ""}}`)
 
 	req, _ := http.NewRequest("POST", "/certificates/create", bytes.NewBuffer(testcert))
-	req.Header.Set("OwnerID", "rr01")
+	req.SetBasicAuth("rr01", "rrejh3294")
 	response := executeRequest(req)
 
 	checkResponseCode(t, http.StatusCreated, response.Code)
@@ -83,14 +117,30 @@ func TestCreatCert(t *testing.T) {
 
 }
 
-//TestCreateCertNoOwner tests sending a create request without the required owner header
+//TestCreateCertNoOwner tests sending a create request without credentials for its owner
 func TestCreateCertNoOwner(t *testing.T) {
 	testcert := []byte(`{"ID": "c003","Title": "The Yellow House","CreatedAt": "2009-11-17T20:34:58.651387237Z","OwnerID": "rr01","Year": 1888,"Note": "","Transfer": {"To": "","Status": ""}}`)
 
 	req, _ := http.NewRequest("POST", "/certificates/create", bytes.NewBuffer(testcert))
+	req.Header.Set("OwnerID", "rr01")
 	response := executeRequest(req)
 
-	checkResponseCode(t, http.StatusForbidden, response.Code)
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+}
+
+//TestCreateCertSpoofedOwner tests the owner comes from the credentials, not the header or body
+func TestCreateCertSpoofedOwner(t *testing.T) {
+	store := newTestStore()
+	testcert := []byte(`{"ID": "c011","Title": "Irises","OwnerID": "vvg01"}`)
+
+	req, _ := http.NewRequest("POST", "/certificates/create", bytes.NewBuffer(testcert))
+	req.Header.Set("OwnerID", "vvg01")
+	req.SetBasicAuth("rr01", "rrejh3294")
+	checkResponseCode(t, http.StatusCreated, executeOn(NewRouter(store), req).Code)
+
+	if c, _ := store.GetCert("c011"); c.OwnerID != "rr01" {
+		t.Errorf("Expected certificate to be owned by rr01. Got '%v'", c.OwnerID)
+	}
 }
 
 //TestUpdateCert tests a correct update of a certificate
@@ -98,6 +148,7 @@ func TestUpdateCert(t *testing.T) {
 	testcert := []byte(`{"ID": "c001","Title": "THE YELLOW HOUSE","CreatedAt": "2009-11-17T20:34:58.651387237Z","OwnerID": "rr01","Year": 1888,"Note": "","Transfer": {"To": "","Status": ""}}`)
 
 	req, _ := http.NewRequest("PUT", "/certificates/update", bytes.NewBuffer(testcert))
+	req.SetBasicAuth("rr01", "rrejh3294")
 	response := executeRequest(req)
 
 	checkResponseCode(t, http.StatusOK, response.Code)
@@ -105,7 +156,7 @@ func TestUpdateCert(t *testing.T) {
 	var m map[string]interface{}
 	json.Unmarshal(response.Body.Bytes(), &m)
 
-	if m["Title"] != certs[0].Title {
+	if m["Title"] != storedCert(t, "c001").Title {
 		t.Errorf("Expected certificate title to be 'THE YELLOW HOUSE'. Got '%v'", m["Title"])
 	}
 }
@@ -115,7 +166,7 @@ func TestUpdateCertNew(t *testing.T) {
 	testcert := []byte(`{"ID": "c003","Title": "THE YELLOW HOUSE","CreatedAt": "2009-11-17T20:34:58.651387237Z","OwnerID": "rr01","Year": 1888,"Note": "","Transfer": {"To": "","Status": ""}}`)
 
 	req, _ := http.NewRequest("PUT", "/certificates/update", bytes.NewBuffer(testcert))
-	req.Header.Set("OwnerID", "rr01")
+	req.SetBasicAuth("rr01", "rrejh3294")
 	response := executeRequest(req)
 
 	checkResponseCode(t, http.StatusOK, response.Code)
@@ -123,25 +174,48 @@ func TestUpdateCertNew(t *testing.T) {
 	var m map[string]interface{}
 	json.Unmarshal(response.Body.Bytes(), &m)
 
-	if m["Title"] != certs[2].Title {
+	if m["Title"] != storedCert(t, "c003").Title {
 		t.Errorf("Expected certificate title to be 'THE YELLOW HOUSE'. Got '%v'", m["Title"])
 	}
 }
 
-//TestUpdateCertNewNoOwner update a cert that does not exist, thereby attempting to create new one but omit owner ID header
+//TestUpdateCertNewNoOwner update a cert that does not exist, thereby attempting to create new one but omit credentials
 func TestUpdateCertNewNoOwner(t *testing.T) {
 	testcert := []byte(`{"ID": "c004","Title": "Wheatfield with Crows","CreatedAt": "2009-11-17T20:34:58.651387237Z","OwnerID": "rr01","Year": 1890,"Note": "","Transfer": {"To": "","Status": ""}}`)
 
 	req, _ := http.NewRequest("PUT", "/certificates/update", bytes.NewBuffer(testcert))
+	req.Header.Set("OwnerID", "rr01")
 	response := executeRequest(req)
 
-	checkResponseCode(t, http.StatusForbidden, response.Code)
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+
+}
+
+//TestUpdateCertNotOwner test updating another user's cert, with or without claiming it
+func TestUpdateCertNotOwner(t *testing.T) {
+	for _, testcert := range []string{`{"ID": "c001","Title": "Mine now"}`, `{"ID": "c001","Title": "Mine now","OwnerID": "vvg01"}`} {
+		req, _ := http.NewRequest("PUT", "/certificates/update", bytes.NewBufferString(testcert))
+		req.SetBasicAuth("vvg01", "vwh39043f")
+		checkResponseCode(t, http.StatusForbidden, executeRequest(req).Code)
+	}
+	if c := storedCert(t, "c001"); c.Title == "Mine now" || c.OwnerID != "rr01" {
+		t.Errorf("Expected c001 to be left alone. Got %+v", c)
+	}
+}
+
+//TestDeleteCertNotOwner test deleting another user's cert
+func TestDeleteCertNotOwner(t *testing.T) {
+	req, _ := http.NewRequest("DELETE", "/certificates/c003/delete", nil)
+	req.SetBasicAuth("vvg01", "vwh39043f")
+	checkResponseCode(t, http.StatusForbidden, executeRequest(req).Code)
 
+	storedCert(t, "c003")
 }
 
 //TestDeleteCert test delete
 func TestDeleteCert(t *testing.T) {
 	req, _ := http.NewRequest("DELETE", "/certificates/c003/delete", nil)
+	req.SetBasicAuth("rr01", "rrejh3294")
 	response := executeRequest(req)
 
 	checkResponseCode(t, http.StatusOK, response.Code)
@@ -150,7 +224,217 @@ func TestDeleteCert(t *testing.T) {
 //TestDeleteNonExistingCert test deleting a cert not in storage
 func TestDeleteNonExistingCert(t *testing.T) {
 	req, _ := http.NewRequest("DELETE", "/certificates/c-/delete", nil)
+	req.SetBasicAuth("rr01", "rrejh3294")
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
+//TestSeparateStores tests that two routers with their own stores do not share data
+func TestSeparateStores(t *testing.T) {
+	otherStore := newTestStore()
+	otherRouter := NewRouter(otherStore)
+	testcert := []byte(`{"ID": "c010","Title": "Irises","CreatedAt": "2009-11-17T20:34:58.651387237Z","Year": 1889,"Note": ""}`)
+
+	req, _ := http.NewRequest("POST", "/certificates/create", bytes.NewBuffer(testcert))
+	req.SetBasicAuth("rr01", "rrejh3294")
+	rec := executeOn(otherRouter, req)
+
+	checkResponseCode(t, http.StatusCreated, rec.Code)
+
+	if _, found := otherStore.GetCert("c010"); !found {
+		t.Errorf("Expected certificate 'c010' in the store it was created through")
+	}
+	if _, found := testStore.GetCert("c010"); found {
+		t.Errorf("Expected certificate 'c010' not to leak into another store")
+	}
+}
+
+//TestProvenance tests the chain of owners recorded as a certificate changes hands
+func TestProvenance(t *testing.T) {
+	r := NewRouter(newTestStore())
+	transferAction(r, "create", "rr01", "rrejh3294")
+	transferAction(r, "accept", "vvg01", "vwh39043f")
+
+	req, _ := http.NewRequest("GET", "/certificates/c001/provenance", nil)
+	response := executeOn(r, req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var chain []ownershipChange
+	json.Unmarshal(response.Body.Bytes(), &chain)
+	if len(chain) != 2 {
+		t.Fatalf("Expected issue and one transfer in provenance. Got %+v", chain)
+	}
+	if chain[0].From != "" || chain[0].To != "rr01" || chain[0].TransferID != "" {
+		t.Errorf("Expected provenance to start with the issue to rr01. Got %+v", chain[0])
+	}
+	if chain[1].From != "rr01" || chain[1].To != "vvg01" || chain[1].TransferID == "" {
+		t.Errorf("Expected transfer from rr01 to vvg01. Got %+v", chain[1])
+	}
+
+	//included in the certificate on request only
+	req, _ = http.NewRequest("GET", "/certificates/c001?include=provenance", nil)
+	var m map[string]interface{}
+	json.Unmarshal(executeOn(r, req).Body.Bytes(), &m)
+	if history, _ := m["Provenance"].([]interface{}); m["ID"] != "c001" || len(history) != 2 {
+		t.Errorf("Expected certificate with 2 provenance entries. Got %v", m)
+	}
+	req, _ = http.NewRequest("GET", "/certificates/c001", nil)
+	m = nil
+	json.Unmarshal(executeOn(r, req).Body.Bytes(), &m)
+	if _, included := m["Provenance"]; included {
+		t.Errorf("Expected no provenance unless asked for")
+	}
+}
+
+//TestProvenance404 tests fetching the provenance of a nonexistent certificate
+func TestProvenance404(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/certificates/c-1/provenance", nil)
 	response := executeRequest(req)
 
 	checkResponseCode(t, http.StatusNotFound, response.Code)
 }
+
+//certRequest sends a certificate create, update or delete to a router as a user
+func certRequest(r http.Handler, method string, url string, body string, userID string, pass string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+	req.SetBasicAuth(userID, pass)
+	return executeOn(r, req)
+}
+
+//TestCollectorCannotIssue tests a user without an issuing role cannot create certificates
+func TestCollectorCannotIssue(t *testing.T) {
+	store := newTestStore()
+	store.SetRoles("vvg01", []string{roleCollector})
+	r := NewRouter(store)
+
+	response := certRequest(r, "POST", "/certificates/create", `{"ID": "c020"}`, "vvg01", "vwh39043f")
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+	if !strings.Contains(response.Body.String(), string(permIssueCerts)) {
+		t.Errorf("Expected the missing permission in the reason. Got '%s'", response.Body.String())
+	}
+	response = certRequest(r, "PUT", "/certificates/update", `{"ID": "c020"}`, "vvg01", "vwh39043f")
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+}
+
+//TestIssuerEditsDetails tests the issuing artist edits the title after selling the
+//certificate while the new owner edits the note
+func TestIssuerEditsDetails(t *testing.T) {
+	store := newTestStore()
+	store.SetRoles("rr01", []string{roleArtist})
+	r := NewRouter(store)
+
+	response := certRequest(r, "POST", "/certificates/create", `{"ID": "c020", "Title": "Irises"}`, "vvg01", "vwh39043f")
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	tr := newTransfer("c020", "vvg01", "reshawnramjattan@gmail.com")
+	store.CreateTransfer(tr)
+	store.AcceptTransfer(tr.ID, tr.To, "rr01", time.Now())
+
+	response = certRequest(r, "PUT", "/certificates/update", `{"ID": "c020", "Title": "Irises (1889)"}`, "vvg01", "vwh39043f")
+	checkResponseCode(t, http.StatusOK, response.Code)
+	response = certRequest(r, "PUT", "/certificates/update", `{"ID": "c020", "Title": "Irises (1889)", "Note": "mine"}`, "vvg01", "vwh39043f")
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+
+	response = certRequest(r, "PUT", "/certificates/update", `{"ID": "c020", "Title": "Lilies"}`, "rr01", "rrejh3294")
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+	if !strings.Contains(response.Body.String(), "issuing artist") {
+		t.Errorf("Expected the reason to name the issuing artist. Got '%s'", response.Body.String())
+	}
+	response = certRequest(r, "PUT", "/certificates/update", `{"ID": "c020", "Title": "Irises (1889)", "Note": "hung in the hall"}`, "rr01", "rrejh3294")
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	c, _ := store.GetCert("c020")
+	if c.Title != "Irises (1889)" || c.Note != "hung in the hall" || c.OwnerID != "rr01" {
+		t.Errorf("Expected both edits kept and owner unchanged. Got %+v", c)
+	}
+}
+
+//TestDeleteNeedsAdmin tests owners cannot delete their certificates, only admins can
+func TestDeleteNeedsAdmin(t *testing.T) {
+	store := newTestStore()
+	r := NewRouter(store)
+
+	response := certRequest(r, "DELETE", "/certificates/c002/delete", "", "vvg01", "vwh39043f")
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+	if !strings.Contains(response.Body.String(), roleAdmin) {
+		t.Errorf("Expected the reason to name the admin role. Got '%s'", response.Body.String())
+	}
+	response = certRequest(r, "DELETE", "/certificates/c002/delete", "", "rr01", "rrejh3294")
+	checkResponseCode(t, http.StatusOK, response.Code)
+}
+
+//verifyDoc presents a certificate document to the verify endpoint
+func verifyDoc(t *testing.T, r http.Handler, doc []byte) signatureCheck {
+	req, _ := http.NewRequest("POST", "/certificates/verify", bytes.NewBuffer(doc))
+	response := executeOn(r, req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var check signatureCheck
+	json.Unmarshal(response.Body.Bytes(), &check)
+	return check
+}
+
+//TestVerifyCert tests a fetched certificate verifies, stops being current once
+//changed and stops being valid once altered by anyone but the server
+func TestVerifyCert(t *testing.T) {
+	store := newTestStore()
+	r := NewRouter(store)
+
+	req, _ := http.NewRequest("GET", "/certificates/c001", nil)
+	fetched := executeOn(r, req).Body.Bytes()
+	if check := verifyDoc(t, r, fetched); !check.Valid || !check.Current || check.KeyID == "" {
+		t.Errorf("Expected fetched certificate to be valid and current. Got %+v", check)
+	}
+
+	response := certRequest(r, "PUT", "/certificates/update", `{"ID": "c001", "Title": "Starry Night", "Note": "lent out", "Signature": "forged"}`, "rr01", "rrejh3294")
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if check := verifyDoc(t, r, response.Body.Bytes()); !check.Valid || !check.Current {
+		t.Errorf("Expected updated certificate to be signed again. Got %+v", check)
+	}
+	if check := verifyDoc(t, r, fetched); !check.Valid || check.Current {
+		t.Errorf("Expected earlier version to be valid but not current. Got %+v", check)
+	}
+
+	var doc map[string]interface{}
+	json.Unmarshal(fetched, &doc)
+	doc["OwnerID"] = "vvg01"
+	tampered, _ := json.Marshal(doc)
+	if check := verifyDoc(t, r, tampered); check.Valid || check.Reason == "" {
+		t.Errorf("Expected altered certificate to be invalid. Got %+v", check)
+	}
+	if check := verifyDoc(t, r, []byte(`{"ID": "c001"}`)); check.Valid {
+		t.Errorf("Expected unsigned certificate to be invalid. Got %+v", check)
+	}
+}
+
+//TestTransferSignsCert tests a certificate is signed for its new owner when a transfer is accepted
+func TestTransferSignsCert(t *testing.T) {
+	store := newTestStore()
+	r := NewRouter(store)
+	tr := newTransfer("c001", "rr01", "vvg@gmail.com")
+	store.CreateTransfer(tr)
+	store.AcceptTransfer(tr.ID, tr.To, "vvg01", time.Now())
+
+	req, _ := http.NewRequest("GET", "/certificates/c001", nil)
+	response := executeOn(r, req)
+	if check := verifyDoc(t, r, response.Body.Bytes()); !check.Valid || !check.Current {
+		t.Errorf("Expected transferred certificate to be signed. Got %+v", check)
+	}
+	if c, _ := store.GetCert("c001"); c.OwnerID != "vvg01" {
+		t.Errorf("Expected certificate owned by vvg01. Got '%v'", c.OwnerID)
+	}
+}
+
+//TestCreateCertStoreFailure tests a change the store fails to log is reported
+//as a server error, not as a duplicate certificate
+func TestCreateCertStoreFailure(t *testing.T) {
+	store := newTestStore()
+	store.journal = func(e logEntry) error { return errors.New("disk full") }
+	r := NewRouter(store)
+
+	checkResponseCode(t, http.StatusInternalServerError, certRequest(r, "POST", "/certificates/create", `{"ID": "c050"}`, "rr01", "rrejh3294").Code)
+	checkResponseCode(t, http.StatusConflict, certRequest(r, "POST", "/certificates/create", `{"ID": "c001"}`, "rr01", "rrejh3294").Code)
+	checkResponseCode(t, http.StatusInternalServerError, certRequest(r, "PUT", "/certificates/update", `{"ID": "c050"}`, "rr01", "rrejh3294").Code)
+	checkResponseCode(t, http.StatusInternalServerError, certRequest(r, "PUT", "/certificates/update", `{"ID": "c001", "Note": "x"}`, "rr01", "rrejh3294").Code)
+	checkResponseCode(t, http.StatusInternalServerError, certRequest(r, "DELETE", "/certificates/c001/delete", "", "rr01", "rrejh3294").Code)
+	checkResponseCode(t, http.StatusNotFound, certRequest(r, "DELETE", "/certificates/c050/delete", "", "rr01", "rrejh3294").Code)
+}
@@ -0,0 +1,49 @@
+package certificates
+
+import (
+	"encoding/hex"
+	"log"
+	"time"
+)
+
+//makeCheckpoint signs and stores a checkpoint of the ledger as it is, unless
+//nothing was added to it since the last one. It reports whether it did
+func makeCheckpoint(store CertificateStore, keys *KeyManager, now time.Time) (checkpoint, bool) {
+	events := store.GetEvents()
+	if checkpoints := store.ListCheckpoints(); len(events) == 0 ||
+		len(checkpoints) > 0 && checkpoints[len(checkpoints)-1].TreeSize == uint64(len(events)) {
+		return checkpoint{}, false
+	}
+	cp := keys.signCheckpoint(checkpoint{
+		TreeSize: uint64(len(events)),
+		RootHash: hex.EncodeToString(merkleRoot(eventLeaves(events))),
+		At:       now.UTC(),
+	})
+	//another checkpoint of as many events or more got in first
+	if err := store.AddCheckpoint(cp); err != nil {
+		return checkpoint{}, false
+	}
+	return cp, true
+}
+
+//StartCheckpointer checkpoints the ledger in the background every interval,
+//signing with the current key of keys and timing with now. Call the function
+//it returns to stop it
+func StartCheckpointer(store CertificateStore, keys *KeyManager, interval time.Duration, now func() time.Time) func() {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if cp, made := makeCheckpoint(store, keys, now().UTC()); made {
+					log.Println("Checkpoint of ledger:", cp.TreeSize, "events")
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
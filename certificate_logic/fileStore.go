@@ -0,0 +1,494 @@
+package certificates
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+//files kept inside the data directory
+const (
+	//snapshot of the whole store as of a log sequence number
+	stateFileName = "store.json"
+	//active write-ahead log holding every change made since the snapshot
+	walFileName = "store.wal"
+)
+
+//number of log entries after which the log is compacted into a new snapshot
+const defaultCompactEvery = 1000
+
+//userRecord is how a user is written to disk; user keeps its password
+//unexported so it can never leak through the JSON responses. Password holds
+//the hash, or plaintext for a user who has not logged in since hashing began
+type userRecord struct {
+	ID              string
+	Email           string
+	Name            string
+	Roles           []string
+	CreatedAt       time.Time
+	DeactivatedAt   time.Time
+	EmailVerifiedAt time.Time
+	Password        string
+}
+
+func newUserRecord(u user) userRecord {
+	return userRecord{u.ID, u.Email, u.Name, u.Roles, u.CreatedAt, u.DeactivatedAt, u.EmailVerifiedAt, u.password}
+}
+
+//account returns the user a record holds
+func (r userRecord) account() user {
+	return user{
+		ID:              r.ID,
+		Email:           r.Email,
+		Name:            r.Name,
+		Roles:           r.Roles,
+		CreatedAt:       r.CreatedAt,
+		DeactivatedAt:   r.DeactivatedAt,
+		EmailVerifiedAt: r.EmailVerifiedAt,
+		password:        r.Password,
+	}
+}
+
+//apiKeyRecord is how an API key is written to disk, along with its hash
+type apiKeyRecord struct {
+	apiKey
+	Hash string
+}
+
+func (r apiKeyRecord) key() apiKey {
+	k := r.apiKey
+	k.hash = r.Hash
+	return k
+}
+
+//diskState is the snapshot the file store persists. It is written as a single
+//file so certificates, users and transfers can never disagree after a crash
+type diskState struct {
+	//sequence number of the last log entry included in the snapshot
+	LastSeq   uint64
+	Certs     []certificate
+	Users     []userRecord
+	Transfers []transfer
+	//ownership changes of every certificate, oldest first within each
+	Provenance []ownershipChange
+	//sessions still live when the snapshot was taken
+	Sessions []session
+	APIKeys  []apiKeyRecord
+	//reset and verification tokens still usable when the snapshot was taken
+	Resets        []passwordReset
+	Verifications []verification
+	TwoFactors    []twoFactor
+	//every certificate event and checkpoint of them, oldest first
+	Ledger      []ledgerEvent
+	Checkpoints []checkpoint
+}
+
+//fileStore keeps the working set in memory. Every change is appended to a
+//checksummed write-ahead log before it is applied, and on startup the state
+//is rebuilt from the latest snapshot plus a replay of the log. Once the log
+//grows past compactEvery entries it is folded into a new snapshot and
+//archived, so replay stays short while the full history is kept for auditing
+type fileStore struct {
+	*memoryStore
+	dir          string
+	compactEvery int
+
+	//guards the log file and the counters below; appends from changes to
+	//different certificates are serialized here and nowhere else
+	walMu        sync.Mutex
+	wal          *os.File
+	seq          uint64 //sequence number of the last entry written
+	sinceCompact int
+}
+
+//NewFileStore returns a CertificateStore persisted in dir. The directory is
+//created and loaded with the static data if it holds no state yet
+func NewFileStore(dir string) (CertificateStore, error) {
+	return openFileStore(dir, defaultCompactEvery)
+}
+
+func openFileStore(dir string, compactEvery int) (*fileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	removeTempFiles(dir)
+
+	s := &fileStore{dir: dir, compactEvery: compactEvery}
+	data, err := ioutil.ReadFile(filepath.Join(dir, stateFileName))
+	switch {
+	case os.IsNotExist(err):
+		s.memoryStore = newSeededStore()
+		if err := s.saveSnapshot(); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	default:
+		var state diskState
+		if err := json.Unmarshal(data, &state); err != nil {
+			return nil, err
+		}
+		s.memoryStore = s.restore(state)
+		s.seq = state.LastSeq
+	}
+
+	if err := s.openLog(); err != nil {
+		return nil, err
+	}
+	s.memoryStore.journal = s.appendLog
+	return s, nil
+}
+
+//openLog opens the active log, replays the entries newer than the snapshot
+//and cuts off a torn record left by a crash in the middle of an append
+func (s *fileStore) openLog() error {
+	f, err := os.OpenFile(filepath.Join(s.dir, walFileName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	entries, end, err := readRecords(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	for _, e := range entries {
+		//entries already folded into the snapshot are still in the log if the
+		//process died between writing the snapshot and archiving the log
+		if e.Seq <= s.seq {
+			continue
+		}
+		//a change is only logged once its checks pass, so it applies again here.
+		//If it does not, going on would leave the next snapshot missing it
+		if err := s.memoryStore.apply(e); err != nil {
+			f.Close()
+			return fmt.Errorf("replaying write-ahead log entry %d (%s): %v", e.Seq, e.Op, err)
+		}
+		s.seq = e.Seq
+		s.sinceCompact++
+	}
+	if info, err := f.Stat(); err == nil && info.Size() > end {
+		log.Println("Truncating torn write-ahead log record at offset", end)
+		if err := f.Truncate(end); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if _, err := f.Seek(end, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	s.wal = f
+	return nil
+}
+
+//leftovers from a write that was interrupted before its rename never
+//replaced the real file, so they can simply be dropped
+func removeTempFiles(dir string) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), "."+stateFileName) {
+			os.Remove(filepath.Join(dir, f.Name()))
+		}
+	}
+}
+
+//snapshot copies the in-memory state into its on-disk form. Callers make
+//sure no change is in flight
+func (s *fileStore) snapshot() diskState {
+	state := diskState{
+		LastSeq:   s.seq,
+		Certs:     s.ListCerts(),
+		Users:     []userRecord{},
+		Transfers: s.ListTransfers(transferFilter{}),
+		Sessions:  s.liveSessions(time.Now()),
+		Resets:    s.pendingResets(time.Now()),
+	}
+	for _, c := range state.Certs {
+		history, _ := s.GetProvenance(c.ID)
+		state.Provenance = append(state.Provenance, history...)
+	}
+	state.Verifications = s.pendingVerifications(time.Now())
+	state.TwoFactors = s.allTwoFactors()
+	state.Ledger = s.ledgerEvents()
+	state.Checkpoints = s.ListCheckpoints()
+	for _, k := range s.allAPIKeys() {
+		state.APIKeys = append(state.APIKeys, apiKeyRecord{k, k.hash})
+	}
+	for _, u := range s.ListUsers() {
+		state.Users = append(state.Users, newUserRecord(u))
+	}
+	return state
+}
+
+//restore builds the in-memory state saved in a snapshot
+func (s *fileStore) restore(state diskState) *memoryStore {
+	users := userCollection{}
+	for _, u := range state.Users {
+		users = append(users, u.account())
+	}
+	m := newMemoryStore(certCollection(state.Certs), users)
+	m.restoreTransfers(transferCollection(state.Transfers))
+	m.restoreProvenance(state.Provenance)
+	for _, sess := range state.Sessions {
+		m.sessions[sess.ID] = sess
+	}
+	for _, k := range state.APIKeys {
+		m.putAPIKey(k.key())
+	}
+	for _, p := range state.Resets {
+		m.resets[p.ID] = p
+	}
+	for _, v := range state.Verifications {
+		m.verifyTokens[v.ID] = v
+	}
+	for _, tf := range state.TwoFactors {
+		m.twoFactors[tf.UserID] = tf
+	}
+	for i := range state.Ledger {
+		m.appendEvent(&state.Ledger[i])
+	}
+	m.checkpoints = state.Checkpoints
+	return m
+}
+
+//saveSnapshot writes the current state to disk
+func (s *fileStore) saveSnapshot() error {
+	data, err := json.MarshalIndent(s.snapshot(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(s.dir, stateFileName), data)
+}
+
+//compact writes a snapshot covering every logged entry, then moves the log
+//aside as an archived segment named after its last sequence number and
+//starts a new empty one. Changes are held off while it runs
+func (s *fileStore) compact() error {
+	s.commitMu.Lock()
+	defer s.commitMu.Unlock()
+	s.walMu.Lock()
+	defer s.walMu.Unlock()
+
+	if s.sinceCompact < s.compactEvery {
+		//another change got here first
+		return nil
+	}
+	if err := s.saveSnapshot(); err != nil {
+		return err
+	}
+	archived := filepath.Join(s.dir, fmt.Sprintf("store-%020d.wal", s.seq))
+	if err := os.Rename(filepath.Join(s.dir, walFileName), archived); err != nil {
+		return err
+	}
+	s.wal.Close()
+	if err := syncDir(s.dir); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(s.dir, walFileName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	s.wal = f
+	s.sinceCompact = 0
+	return nil
+}
+
+//appendLog is the memoryStore journal: it durably logs a change before the
+//change is applied
+func (s *fileStore) appendLog(e logEntry) error {
+	s.walMu.Lock()
+	defer s.walMu.Unlock()
+	e.Seq = s.seq + 1
+	e.Time = time.Now().UTC()
+	if err := appendRecord(s.wal, e); err != nil {
+		return err
+	}
+	s.seq = e.Seq
+	s.sinceCompact++
+	return nil
+}
+
+//afterChange compacts the log once enough changes have built up. It runs
+//once a change is fully applied since compaction waits for those in flight
+func (s *fileStore) afterChange(err error) error {
+	s.walMu.Lock()
+	due := s.sinceCompact >= s.compactEvery
+	s.walMu.Unlock()
+	if due {
+		if err := s.compact(); err != nil {
+			//the changes themselves are already durable in the log
+			log.Println("Error compacting write-ahead log", err)
+		}
+	}
+	return err
+}
+
+func (s *fileStore) CreateCert(c certificate) error {
+	return s.afterChange(s.memoryStore.CreateCert(c))
+}
+
+func (s *fileStore) UpdateCert(c certificate) error {
+	return s.afterChange(s.memoryStore.UpdateCert(c))
+}
+
+func (s *fileStore) DeleteCert(id string, ownerID string) error {
+	return s.afterChange(s.memoryStore.DeleteCert(id, ownerID))
+}
+
+func (s *fileStore) RevokeCert(id string, r revocation) error {
+	return s.afterChange(s.memoryStore.RevokeCert(id, r))
+}
+
+func (s *fileStore) SetSigner(sign func(c certificate) certificate) error {
+	return s.afterChange(s.memoryStore.SetSigner(sign))
+}
+
+func (s *fileStore) ResignCerts(keyID string) error {
+	return s.afterChange(s.memoryStore.ResignCerts(keyID))
+}
+
+func (s *fileStore) AddCheckpoint(cp checkpoint) error {
+	return s.afterChange(s.memoryStore.AddCheckpoint(cp))
+}
+
+func (s *fileStore) CreateTransfer(t transfer) error {
+	return s.afterChange(s.memoryStore.CreateTransfer(t))
+}
+
+func (s *fileStore) AcceptTransfer(id string, email string, newOwnerID string, at time.Time) error {
+	return s.afterChange(s.memoryStore.AcceptTransfer(id, email, newOwnerID, at))
+}
+
+func (s *fileStore) SetPassword(id string, current string, hash string) error {
+	return s.afterChange(s.memoryStore.SetPassword(id, current, hash))
+}
+
+func (s *fileStore) SetRoles(id string, roles []string) error {
+	return s.afterChange(s.memoryStore.SetRoles(id, roles))
+}
+
+func (s *fileStore) CreateUser(u user) error {
+	return s.afterChange(s.memoryStore.CreateUser(u))
+}
+
+func (s *fileStore) UpdateProfile(id string, email string, name string) error {
+	return s.afterChange(s.memoryStore.UpdateProfile(id, email, name))
+}
+
+func (s *fileStore) DeactivateUser(id string, at time.Time) error {
+	return s.afterChange(s.memoryStore.DeactivateUser(id, at))
+}
+
+func (s *fileStore) CreateReset(p passwordReset) error {
+	return s.afterChange(s.memoryStore.CreateReset(p))
+}
+
+func (s *fileStore) ResetPassword(id string, hash string, password string, at time.Time) error {
+	return s.afterChange(s.memoryStore.ResetPassword(id, hash, password, at))
+}
+
+func (s *fileStore) CreateVerification(v verification) error {
+	return s.afterChange(s.memoryStore.CreateVerification(v))
+}
+
+func (s *fileStore) VerifyEmail(id string, hash string, at time.Time) error {
+	return s.afterChange(s.memoryStore.VerifyEmail(id, hash, at))
+}
+
+func (s *fileStore) SetTwoFactor(tf twoFactor) error {
+	return s.afterChange(s.memoryStore.SetTwoFactor(tf))
+}
+
+func (s *fileStore) RemoveTwoFactor(userID string) error {
+	return s.afterChange(s.memoryStore.RemoveTwoFactor(userID))
+}
+
+func (s *fileStore) UseTwoFactor(userID string, step uint64, recoveryHash string) error {
+	return s.afterChange(s.memoryStore.UseTwoFactor(userID, step, recoveryHash))
+}
+
+func (s *fileStore) CreateAPIKey(k apiKey) error {
+	return s.afterChange(s.memoryStore.CreateAPIKey(k))
+}
+
+func (s *fileStore) RevokeAPIKey(id string, at time.Time) error {
+	return s.afterChange(s.memoryStore.RevokeAPIKey(id, at))
+}
+
+func (s *fileStore) TouchAPIKey(id string, at time.Time) error {
+	return s.afterChange(s.memoryStore.TouchAPIKey(id, at))
+}
+
+func (s *fileStore) CreateSession(sess session) error {
+	return s.afterChange(s.memoryStore.CreateSession(sess))
+}
+
+func (s *fileStore) RefreshSession(id string, current string, hash string, expiresAt time.Time) error {
+	return s.afterChange(s.memoryStore.RefreshSession(id, current, hash, expiresAt))
+}
+
+func (s *fileStore) RevokeSession(id string, at time.Time) error {
+	return s.afterChange(s.memoryStore.RevokeSession(id, at))
+}
+
+func (s *fileStore) CloseTransfer(id string, status string, at time.Time) error {
+	return s.afterChange(s.memoryStore.CloseTransfer(id, status, at))
+}
+
+//writeFileAtomic replaces path with data so that a reader, or a restart after
+//a crash, sees either the old contents or the new ones and never a mix.
+//The data goes to a temp file in the same directory which is synced and
+//then renamed over the original; the directory is synced so the rename
+//itself is durable
+func writeFileAtomic(path string, data []byte) error {
+	dir, name := filepath.Split(path)
+	tmp, err := ioutil.TempFile(dir, "."+name)
+	if err != nil {
+		return err
+	}
+	//no-op once the rename has happened
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+//syncDir flushes a directory entry change such as a rename to disk
+func syncDir(dir string) error {
+	if dir == "" {
+		dir = "."
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
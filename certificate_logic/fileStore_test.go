@@ -0,0 +1,622 @@
+package certificates
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tempDataDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "certstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+//TestFileStoreSeeds tests that an empty data directory starts with the static data
+func TestFileStoreSeeds(t *testing.T) {
+	dir := tempDataDir(t)
+	defer os.RemoveAll(dir)
+
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(store.ListCerts()); n != 2 {
+		t.Errorf("Expected 2 seeded certificates. Got %d", n)
+	}
+	if _, err := os.Stat(filepath.Join(dir, stateFileName)); err != nil {
+		t.Errorf("Expected state file to be written. Got %v", err)
+	}
+}
+
+//TestFileStoreReload tests that changes survive reopening the data directory
+func TestFileStoreReload(t *testing.T) {
+	dir := tempDataDir(t)
+	defer os.RemoveAll(dir)
+
+	store, _ := NewFileStore(dir)
+	store.CreateCert(certificate{ID: "c003", Title: "The Yellow House", OwnerID: "rr01", CreatedAt: time.Now().UTC()})
+	store.DeleteCert("c002", "vvg01")
+	store.CreateTransfer(newTransfer("c001", "rr01", "vvg@gmail.com"))
+
+	reopened, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := reopened.GetCert("c003"); !found {
+		t.Errorf("Expected created certificate to be reloaded")
+	}
+	if _, found := reopened.GetCert("c002"); found {
+		t.Errorf("Expected deleted certificate to stay deleted")
+	}
+	pending, found := reopened.GetCurrentTransfer("c001")
+	if !found {
+		t.Errorf("Expected pending transfer to be reloaded")
+	}
+	if err := reopened.AcceptTransfer(pending.ID, "vvg@gmail.com", "vvg01", time.Now()); err != nil {
+		t.Errorf("Expected reloaded transfer to be accepted. Got %v", err)
+	}
+	if u, _ := reopened.GetUser("rr01"); u.password != "rrejh3294" {
+		t.Errorf("Expected user password to be reloaded")
+	}
+}
+
+//TestFileStoreInterruptedWrite tests that a temp file left by a crash mid-write is ignored
+func TestFileStoreInterruptedWrite(t *testing.T) {
+	dir := tempDataDir(t)
+	defer os.RemoveAll(dir)
+
+	store, _ := NewFileStore(dir)
+	store.CreateCert(certificate{ID: "c003", OwnerID: "rr01"})
+
+	torn := filepath.Join(dir, "."+stateFileName+"123")
+	ioutil.WriteFile(torn, []byte(`{"Certs": [{"ID": "c0`), 0600)
+
+	reopened, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := reopened.GetCert("c003"); !found {
+		t.Errorf("Expected last committed state to be loaded")
+	}
+	if _, err := os.Stat(torn); !os.IsNotExist(err) {
+		t.Errorf("Expected interrupted temp file to be removed")
+	}
+}
+
+//TestFileStoreReplay tests that changes are rebuilt from the log without a new snapshot
+func TestFileStoreReplay(t *testing.T) {
+	dir := tempDataDir(t)
+	defer os.RemoveAll(dir)
+
+	store, _ := openFileStore(dir, defaultCompactEvery)
+	store.UpdateCert(certificate{ID: "c001", Title: "Starry Night", OwnerID: "rr01"})
+	tr := newTransfer("c001", "rr01", "vvg@gmail.com")
+	store.CreateTransfer(tr)
+	store.AcceptTransfer(tr.ID, "vvg@gmail.com", "vvg01", time.Now())
+
+	reopened, err := openFileStore(dir, defaultCompactEvery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := reopened.GetCert("c001")
+	if c.Title != "Starry Night" || c.OwnerID != "vvg01" {
+		t.Errorf("Expected replayed update and transfer. Got %+v", c)
+	}
+	if reopened.seq != 3 {
+		t.Errorf("Expected 3 replayed entries. Got %d", reopened.seq)
+	}
+	if history, _ := reopened.GetProvenance("c001"); len(history) != 2 || history[1].TransferID != tr.ID {
+		t.Errorf("Expected replayed provenance. Got %+v", history)
+	}
+
+	//and again once it is all in a snapshot
+	reopened.saveSnapshot()
+	os.Truncate(filepath.Join(dir, walFileName), 0)
+	again, _ := openFileStore(dir, defaultCompactEvery)
+	if history, _ := again.GetProvenance("c001"); len(history) != 2 || history[1].To != "vvg01" {
+		t.Errorf("Expected provenance in snapshot. Got %+v", history)
+	}
+}
+
+//TestFileStoreTornRecord tests that a partially written trailing record is dropped
+func TestFileStoreTornRecord(t *testing.T) {
+	dir := tempDataDir(t)
+	defer os.RemoveAll(dir)
+
+	store, _ := openFileStore(dir, defaultCompactEvery)
+	store.CreateCert(certificate{ID: "c003", OwnerID: "rr01"})
+	store.CreateCert(certificate{ID: "c004", OwnerID: "rr01"})
+	store.wal.Close()
+
+	walPath := filepath.Join(dir, walFileName)
+	info, _ := os.Stat(walPath)
+	//chop the last record in half as a crash mid-append would
+	os.Truncate(walPath, info.Size()-10)
+
+	reopened, err := openFileStore(dir, defaultCompactEvery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := reopened.GetCert("c003"); !found {
+		t.Errorf("Expected complete record to be replayed")
+	}
+	if _, found := reopened.GetCert("c004"); found {
+		t.Errorf("Expected torn record to be discarded")
+	}
+
+	//the log keeps working after the torn record is cut off
+	reopened.CreateCert(certificate{ID: "c005", OwnerID: "rr01"})
+	again, _ := openFileStore(dir, defaultCompactEvery)
+	if _, found := again.GetCert("c005"); !found {
+		t.Errorf("Expected record appended after truncation to be replayed")
+	}
+}
+
+//TestFileStoreCorruptMiddleRecord tests that a bad record with more of the log
+//after it stops the store from opening instead of cutting the rest off
+func TestFileStoreCorruptMiddleRecord(t *testing.T) {
+	dir := tempDataDir(t)
+	defer os.RemoveAll(dir)
+
+	store, _ := openFileStore(dir, defaultCompactEvery)
+	store.CreateCert(certificate{ID: "c003", OwnerID: "rr01"})
+	store.CreateCert(certificate{ID: "c004", OwnerID: "rr01"})
+	store.CreateCert(certificate{ID: "c005", OwnerID: "rr01"})
+	store.wal.Close()
+
+	walPath := filepath.Join(dir, walFileName)
+	data, _ := ioutil.ReadFile(walPath)
+	//flip a byte in the payload of the second record
+	first := walHeaderSize + int(binary.BigEndian.Uint32(data[0:4]))
+	data[first+walHeaderSize+1] ^= 0xff
+	ioutil.WriteFile(walPath, data, 0600)
+
+	if _, err := openFileStore(dir, defaultCompactEvery); err == nil {
+		t.Errorf("Expected a corrupt record in the middle of the log to fail the open")
+	}
+	if after, _ := ioutil.ReadFile(walPath); len(after) != len(data) {
+		t.Errorf("Expected the log to be left alone. Got %d bytes of %d", len(after), len(data))
+	}
+}
+
+//TestFileStoreReplayFailure tests that an entry failing to apply stops the
+//store from opening rather than being left out of the next snapshot
+func TestFileStoreReplayFailure(t *testing.T) {
+	dir := tempDataDir(t)
+	defer os.RemoveAll(dir)
+
+	store, _ := openFileStore(dir, defaultCompactEvery)
+	store.CreateCert(certificate{ID: "c003", OwnerID: "rr01"})
+	//a second create of the same certificate can never apply
+	appendRecord(store.wal, logEntry{Seq: 2, Op: opCreateCert, Cert: &certificate{ID: "c003", OwnerID: "rr01"}})
+	store.wal.Close()
+
+	if _, err := openFileStore(dir, defaultCompactEvery); err == nil || !strings.Contains(err.Error(), "entry 2 (create_certificate)") {
+		t.Errorf("Expected replay to fail naming the entry. Got %v", err)
+	}
+}
+
+//TestFileStoreCorruptRecord tests that a last record failing its checksum ends the replay
+func TestFileStoreCorruptRecord(t *testing.T) {
+	dir := tempDataDir(t)
+	defer os.RemoveAll(dir)
+
+	store, _ := openFileStore(dir, defaultCompactEvery)
+	store.CreateCert(certificate{ID: "c003", OwnerID: "rr01"})
+	store.wal.Close()
+
+	walPath := filepath.Join(dir, walFileName)
+	data, _ := ioutil.ReadFile(walPath)
+	data[len(data)-2] ^= 0xff
+	ioutil.WriteFile(walPath, data, 0600)
+
+	reopened, _ := openFileStore(dir, defaultCompactEvery)
+	if _, found := reopened.GetCert("c003"); found {
+		t.Errorf("Expected corrupt record to be discarded")
+	}
+	if info, _ := os.Stat(walPath); info.Size() != 0 {
+		t.Errorf("Expected corrupt record to be truncated. Log is %d bytes", info.Size())
+	}
+}
+
+//TestFileStoreCompaction tests that the log is folded into a snapshot and archived
+func TestFileStoreCompaction(t *testing.T) {
+	dir := tempDataDir(t)
+	defer os.RemoveAll(dir)
+
+	store, _ := openFileStore(dir, 2)
+	store.CreateCert(certificate{ID: "c003", OwnerID: "rr01"})
+	store.CreateCert(certificate{ID: "c004", OwnerID: "rr01"})
+	store.CreateCert(certificate{ID: "c005", OwnerID: "rr01"})
+
+	if _, err := os.Stat(filepath.Join(dir, "store-00000000000000000002.wal")); err != nil {
+		t.Errorf("Expected compacted log to be archived. Got %v", err)
+	}
+
+	reopened, _ := openFileStore(dir, 2)
+	for _, id := range []string{"c003", "c004", "c005"} {
+		if _, found := reopened.GetCert(id); !found {
+			t.Errorf("Expected certificate '%s' after compaction", id)
+		}
+	}
+	if reopened.sinceCompact != 1 {
+		t.Errorf("Expected only 1 entry to replay after compaction. Got %d", reopened.sinceCompact)
+	}
+}
+
+//TestFileStoreStaleLog tests that entries already in the snapshot are not applied twice
+func TestFileStoreStaleLog(t *testing.T) {
+	dir := tempDataDir(t)
+	defer os.RemoveAll(dir)
+
+	store, _ := openFileStore(dir, defaultCompactEvery)
+	store.CreateTransfer(newTransfer("c001", "rr01", "vvg@gmail.com"))
+	//as if the process died after the snapshot but before the log was archived
+	store.saveSnapshot()
+
+	reopened, _ := openFileStore(dir, defaultCompactEvery)
+	if reopened.seq != 1 || reopened.sinceCompact != 0 {
+		t.Errorf("Expected stale entry to be skipped. Got sequence %d", reopened.seq)
+	}
+	pending, _ := reopened.GetCurrentTransfer("c001")
+	if err := reopened.AcceptTransfer(pending.ID, "vvg@gmail.com", "vvg01", time.Now()); err != nil {
+		t.Errorf("Expected pending transfer to be accepted. Got %v", err)
+	}
+}
+
+//TestFileStoreReplayClosedTransfer tests that a rejected transfer stays rejected after reload
+func TestFileStoreReplayClosedTransfer(t *testing.T) {
+	dir := tempDataDir(t)
+	defer os.RemoveAll(dir)
+
+	store, _ := openFileStore(dir, defaultCompactEvery)
+	tr := newTransfer("c001", "rr01", "vvg@gmail.com")
+	store.CreateTransfer(tr)
+	store.CloseTransfer(tr.ID, transferRejected, time.Now())
+
+	reopened, _ := openFileStore(dir, defaultCompactEvery)
+	if current, _ := reopened.GetCurrentTransfer("c001"); current.Status != transferRejected {
+		t.Errorf("Expected rejected transfer after reload. Got '%v'", current.Status)
+	}
+	if err := reopened.AcceptTransfer(tr.ID, "vvg@gmail.com", "vvg01", time.Now()); err != errTransferClosed {
+		t.Errorf("Expected rejected transfer to stay closed. Got %v", err)
+	}
+}
+
+//TestFileStoreReplayPassword tests that a changed password is kept as its hash
+func TestFileStoreReplayPassword(t *testing.T) {
+	dir := tempDataDir(t)
+	defer os.RemoveAll(dir)
+
+	store, _ := openFileStore(dir, defaultCompactEvery)
+	hash := hashPassword("sunflowers1888")
+	if err := store.SetPassword("vvg01", "stale", hash); err != errPasswordChanged {
+		t.Errorf("Expected stale password to be refused. Got %v", err)
+	}
+	store.SetPassword("vvg01", "vwh39043f", hash)
+
+	reopened, _ := openFileStore(dir, defaultCompactEvery)
+	if u, _ := reopened.GetUser("vvg01"); u.password != hash {
+		t.Errorf("Expected replayed password hash. Got '%s'", u.password)
+	}
+	reopened.saveSnapshot()
+	os.Truncate(filepath.Join(dir, walFileName), 0)
+	again, _ := openFileStore(dir, defaultCompactEvery)
+	if ok, _ := checkPassword(again.users["vvg01"].password, "sunflowers1888"); !ok {
+		t.Errorf("Expected password hash in snapshot")
+	}
+}
+
+//TestFileStoreReplaySessions tests that sessions survive a restart in their latest state
+func TestFileStoreReplaySessions(t *testing.T) {
+	dir := tempDataDir(t)
+	defer os.RemoveAll(dir)
+
+	store, _ := openFileStore(dir, defaultCompactEvery)
+	now := time.Now().UTC()
+	live := session{ID: "s1", UserID: "rr01", RefreshHash: "a", CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	store.CreateSession(live)
+	store.RefreshSession("s1", "a", "b", now.Add(2*time.Hour))
+	store.CreateSession(session{ID: "s2", UserID: "rr01", RefreshHash: "c", CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	store.RevokeSession("s2", now)
+
+	reopened, _ := openFileStore(dir, defaultCompactEvery)
+	if sess, _ := reopened.GetSession("s1"); sess.RefreshHash != "b" || !sess.active(now) {
+		t.Errorf("Expected refreshed session after replay. Got %+v", sess)
+	}
+	if sess, _ := reopened.GetSession("s2"); sess.active(now) {
+		t.Errorf("Expected revoked session to stay revoked")
+	}
+
+	//only live sessions are kept in a snapshot
+	reopened.saveSnapshot()
+	os.Truncate(filepath.Join(dir, walFileName), 0)
+	again, _ := openFileStore(dir, defaultCompactEvery)
+	if _, found := again.GetSession("s1"); !found {
+		t.Errorf("Expected live session in snapshot")
+	}
+	if _, found := again.GetSession("s2"); found {
+		t.Errorf("Expected revoked session to be dropped from snapshot")
+	}
+}
+
+//TestFileStoreReplayRoles tests that role changes survive a restart
+func TestFileStoreReplayRoles(t *testing.T) {
+	dir := tempDataDir(t)
+	defer os.RemoveAll(dir)
+
+	store, _ := openFileStore(dir, defaultCompactEvery)
+	store.SetRoles("vvg01", []string{roleGallery})
+
+	reopened, _ := openFileStore(dir, defaultCompactEvery)
+	if u, _ := reopened.GetUser("vvg01"); len(u.Roles) != 1 || u.Roles[0] != roleGallery {
+		t.Errorf("Expected replayed roles. Got %v", u.Roles)
+	}
+	reopened.saveSnapshot()
+	os.Truncate(filepath.Join(dir, walFileName), 0)
+	again, _ := openFileStore(dir, defaultCompactEvery)
+	if u, _ := again.GetUser("vvg01"); !u.hasRole(roleGallery) || u.hasRole(roleArtist) {
+		t.Errorf("Expected roles in snapshot. Got %v", u.Roles)
+	}
+}
+
+//TestFileStoreReplayUsers tests that registrations, profile changes and
+//deactivations survive a restart
+func TestFileStoreReplayUsers(t *testing.T) {
+	dir := tempDataDir(t)
+	defer os.RemoveAll(dir)
+
+	deactivated := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	store, _ := openFileStore(dir, defaultCompactEvery)
+	store.CreateUser(user{ID: "kh01", Email: "kh@gmail.com", Roles: []string{roleCollector}, password: "hash"})
+	store.UpdateProfile("kh01", "hokusai@gmail.com", "Katsushika Hokusai")
+	store.DeactivateUser("vvg01", deactivated)
+
+	check := func(s CertificateStore, when string) {
+		if u, _ := s.GetUserByEmail("hokusai@gmail.com"); u.ID != "kh01" || u.Name != "Katsushika Hokusai" || u.password != "hash" {
+			t.Errorf("Expected registered user %s. Got %+v", when, u)
+		}
+		if u, _ := s.GetUser("vvg01"); !u.DeactivatedAt.Equal(deactivated) {
+			t.Errorf("Expected deactivated user %s. Got %+v", when, u)
+		}
+	}
+	reopened, _ := openFileStore(dir, defaultCompactEvery)
+	check(reopened, "after replay")
+	reopened.saveSnapshot()
+	os.Truncate(filepath.Join(dir, walFileName), 0)
+	again, _ := openFileStore(dir, defaultCompactEvery)
+	check(again, "in snapshot")
+	if err := again.CreateUser(user{ID: "kh02", Email: "vvg@gmail.com"}); err != errEmailTaken {
+		t.Errorf("Expected the deactivated user's email to stay taken. Got %v", err)
+	}
+}
+
+//TestFileStoreReplayResets tests that a used reset token stays used and
+//the password it set survives a restart
+func TestFileStoreReplayResets(t *testing.T) {
+	dir := tempDataDir(t)
+	defer os.RemoveAll(dir)
+
+	now := time.Now().UTC()
+	store, _ := openFileStore(dir, defaultCompactEvery)
+	store.CreateReset(passwordReset{ID: "r1", UserID: "vvg01", Hash: "h1", CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	store.CreateReset(passwordReset{ID: "r2", UserID: "vvg01", Hash: "h2", CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	store.CreateSession(session{ID: "s1", UserID: "vvg01", ExpiresAt: now.Add(time.Hour)})
+	if err := store.ResetPassword("r1", "h1", "hash", now); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, _ := openFileStore(dir, defaultCompactEvery)
+	if u, _ := reopened.GetUser("vvg01"); u.password != "hash" {
+		t.Errorf("Expected replayed password. Got '%s'", u.password)
+	}
+	if sess, _ := reopened.GetSession("s1"); sess.active(now) {
+		t.Errorf("Expected session revoked by the reset")
+	}
+	if err := reopened.ResetPassword("r1", "h1", "other", now); err != errResetInvalid {
+		t.Errorf("Expected used token to stay used. Got %v", err)
+	}
+	reopened.saveSnapshot()
+	os.Truncate(filepath.Join(dir, walFileName), 0)
+	again, _ := openFileStore(dir, defaultCompactEvery)
+	if _, found := again.GetReset("r1"); found {
+		t.Errorf("Expected used token to be dropped from snapshot")
+	}
+	if err := again.ResetPassword("r2", "h2", "other", now); err != nil {
+		t.Errorf("Expected unused token in snapshot. Got %v", err)
+	}
+}
+
+//TestFileStoreReplayVerification tests that a verified email survives a restart
+func TestFileStoreReplayVerification(t *testing.T) {
+	dir := tempDataDir(t)
+	defer os.RemoveAll(dir)
+
+	now := time.Now().UTC()
+	store, _ := openFileStore(dir, defaultCompactEvery)
+	store.CreateUser(user{ID: "kh01", Email: "kh@gmail.com"})
+	store.CreateVerification(verification{ID: "v1", UserID: "kh01", Email: "kh@gmail.com", Hash: "h1", ExpiresAt: now.Add(time.Hour)})
+	store.CreateVerification(verification{ID: "v2", UserID: "kh01", Email: "kh@gmail.com", Hash: "h2", ExpiresAt: now.Add(time.Hour)})
+	if err := store.VerifyEmail("v1", "h1", now); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, _ := openFileStore(dir, defaultCompactEvery)
+	if u, _ := reopened.GetUser("kh01"); !u.EmailVerifiedAt.Equal(now) {
+		t.Errorf("Expected replayed verification. Got %v", u.EmailVerifiedAt)
+	}
+	reopened.saveSnapshot()
+	os.Truncate(filepath.Join(dir, walFileName), 0)
+	again, _ := openFileStore(dir, defaultCompactEvery)
+	if u, _ := again.GetUser("kh01"); !u.emailVerified() {
+		t.Errorf("Expected verification in snapshot")
+	}
+	if err := again.VerifyEmail("v2", "h2", now); err != errEmailVerified {
+		t.Errorf("Expected unused token in snapshot for a verified email. Got %v", err)
+	}
+}
+
+//TestFileStoreReplayTwoFactor tests that enrolments and used codes survive a restart
+func TestFileStoreReplayTwoFactor(t *testing.T) {
+	dir := tempDataDir(t)
+	defer os.RemoveAll(dir)
+
+	store, _ := openFileStore(dir, defaultCompactEvery)
+	store.SetTwoFactor(twoFactor{UserID: "rr01", Secret: "S", Recovery: []string{"h1", "h2"}, LastStep: 5, EnabledAt: time.Now()})
+	store.UseTwoFactor("rr01", 7, "")
+	store.UseTwoFactor("rr01", 0, "h1")
+
+	check := func(s CertificateStore, when string) {
+		if err := s.UseTwoFactor("rr01", 7, ""); err != errCodeUsed {
+			t.Errorf("Expected used step to stay used %s. Got %v", when, err)
+		}
+		if tf, _ := s.GetTwoFactor("rr01"); len(tf.Recovery) != 1 || tf.Recovery[0] != "h2" {
+			t.Errorf("Expected used recovery code to be gone %s. Got %v", when, tf.Recovery)
+		}
+	}
+	reopened, _ := openFileStore(dir, defaultCompactEvery)
+	check(reopened, "after replay")
+	reopened.saveSnapshot()
+	os.Truncate(filepath.Join(dir, walFileName), 0)
+	again, _ := openFileStore(dir, defaultCompactEvery)
+	check(again, "in snapshot")
+}
+
+//TestFileStoreReplayAPIKeys tests that API keys keep their hash, last use and revocation
+func TestFileStoreReplayAPIKeys(t *testing.T) {
+	dir := tempDataDir(t)
+	defer os.RemoveAll(dir)
+
+	store, _ := openFileStore(dir, defaultCompactEvery)
+	now := time.Now().UTC()
+	store.CreateAPIKey(apiKey{ID: "k1", UserID: "rr01", Scopes: []string{"transfers:read"}, CreatedAt: now, hash: "h1"})
+	store.CreateAPIKey(apiKey{ID: "k2", UserID: "rr01", Scopes: []string{"transfers:read"}, CreatedAt: now, hash: "h2"})
+	store.TouchAPIKey("k1", now)
+	store.RevokeAPIKey("k2", now)
+
+	check := func(s CertificateStore) {
+		k1, _ := s.GetAPIKey("k1")
+		k2, _ := s.GetAPIKey("k2")
+		if k1.hash != "h1" || !k1.LastUsedAt.Equal(now) || !k1.active(now) {
+			t.Errorf("Expected used live key. Got %+v", k1)
+		}
+		if k2.active(now) {
+			t.Errorf("Expected revoked key to stay revoked")
+		}
+		if keys := s.ListAPIKeys("rr01"); len(keys) != 2 {
+			t.Errorf("Expected 2 keys of rr01. Got %d", len(keys))
+		}
+	}
+	reopened, _ := openFileStore(dir, defaultCompactEvery)
+	check(reopened)
+	reopened.saveSnapshot()
+	os.Truncate(filepath.Join(dir, walFileName), 0)
+	again, _ := openFileStore(dir, defaultCompactEvery)
+	check(again)
+}
+
+//TestFileStoreReplaySignatures tests signatures made before a restart still
+//verify with the same key, including one made on accepting a transfer
+func TestFileStoreReplaySignatures(t *testing.T) {
+	dir := tempDataDir(t)
+	defer os.RemoveAll(dir)
+	keys := newKeyManager()
+
+	store, _ := openFileStore(dir, defaultCompactEvery)
+	store.SetSigner(keys.signCert)
+	tr := newTransfer("c001", "rr01", "vvg@gmail.com")
+	store.CreateTransfer(tr)
+	store.AcceptTransfer(tr.ID, tr.To, "vvg01", time.Now())
+
+	reopened, _ := openFileStore(dir, defaultCompactEvery)
+	for _, c := range reopened.ListCerts() {
+		if err := keys.verifyCert(c); err != nil {
+			t.Errorf("Expected %s to verify after reload. Got %v", c.ID, err)
+		}
+	}
+}
+
+//TestFileStoreReplayLedger tests the ledger comes back the same from the log
+//and from a snapshot
+func TestFileStoreReplayLedger(t *testing.T) {
+	dir := tempDataDir(t)
+	defer os.RemoveAll(dir)
+
+	store, _ := openFileStore(dir, 3)
+	store.CreateCert(certificate{ID: "c003", OwnerID: "rr01"})
+	store.UpdateCert(certificate{ID: "c003", OwnerID: "rr01", Note: "on loan"})
+	store.DeleteCert("c002", "")
+	tr := newTransfer("c001", "rr01", "vvg@gmail.com")
+	store.CreateTransfer(tr)
+	store.AcceptTransfer(tr.ID, tr.To, "vvg01", time.Now())
+	events, _ := store.GetLedger()
+
+	reopened, _ := openFileStore(dir, 3)
+	replayed, certs := reopened.GetLedger()
+	if len(replayed) != len(events) || replayed[len(events)-1].Hash != events[len(events)-1].Hash {
+		t.Errorf("Expected the same ledger after reload. Got %+v", replayed)
+	}
+	if check := checkLedger(replayed, certs); !check.Valid {
+		t.Errorf("Expected reloaded ledger to be valid. Got %+v", check)
+	}
+}
+
+//TestFileStoreCheckpoints tests checkpoints are kept and still only move forward after reload
+func TestFileStoreCheckpoints(t *testing.T) {
+	dir := tempDataDir(t)
+	defer os.RemoveAll(dir)
+	keys := newKeyManager()
+
+	store, _ := openFileStore(dir, defaultCompactEvery)
+	cp, _ := makeCheckpoint(store, keys, time.Now())
+
+	reopened, _ := openFileStore(dir, defaultCompactEvery)
+	if checkpoints := reopened.ListCheckpoints(); len(checkpoints) != 1 || checkpoints[0] != cp {
+		t.Errorf("Expected checkpoint after reload. Got %+v", checkpoints)
+	}
+	if err := reopened.AddCheckpoint(cp); err != errCheckpointStale {
+		t.Errorf("Expected repeated checkpoint to be refused. Got %v", err)
+	}
+}
+
+//TestFileStoreReplayRevocation tests a revocation comes back from the log and
+//from a snapshot, including after the revoked certificate is signed again
+func TestFileStoreReplayRevocation(t *testing.T) {
+	dir := tempDataDir(t)
+	defer os.RemoveAll(dir)
+	keys := newKeyManager()
+
+	store, _ := openFileStore(dir, defaultCompactEvery)
+	store.SetSigner(keys.signCert)
+	store.RevokeCert("c001", revocation{Reason: revokeFraudulent, RevokedAt: time.Now().UTC(), RevokedBy: "rr01"})
+	keyID := keys.current().ID
+	keys.Revoke(keyID)
+	store.ResignCerts(keyID)
+
+	check := func(s *fileStore, where string) {
+		c, _ := s.GetCert("c001")
+		if c.Revoked == nil || c.Revoked.Reason != revokeFraudulent || keys.verifyCert(c) != nil {
+			t.Errorf("Expected c001 revoked and signed again %s. Got %+v", where, c)
+		}
+		if revocations := s.ListRevocations(); len(revocations) != 1 {
+			t.Errorf("Expected one revocation %s. Got %+v", where, revocations)
+		}
+		if check := checkLedger(s.GetLedger()); !check.Valid {
+			t.Errorf("Expected valid ledger %s. Got %+v", where, check)
+		}
+	}
+	reopened, _ := openFileStore(dir, defaultCompactEvery)
+	check(reopened, "after replay")
+
+	reopened.saveSnapshot()
+	os.Truncate(filepath.Join(dir, walFileName), 0)
+	again, _ := openFileStore(dir, defaultCompactEvery)
+	check(again, "in snapshot")
+}
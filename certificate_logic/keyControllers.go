@@ -0,0 +1,110 @@
+package certificates
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//rotation is the body of a request to rotate the signing key
+type rotation struct {
+	ActivatesAt time.Time //when the new key takes over, straight away if zero
+}
+
+//keyInfo describes a signing key without giving away the private key
+type keyInfo struct {
+	ID          string
+	ActivatesAt time.Time
+	RetiresAt   time.Time
+	RevokedAt   time.Time
+}
+
+//Handler functions
+// ~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+
+//get the public keys signatures are checked with as a JSON Web Key Set
+func (a *api) getJWKS(w http.ResponseWriter, r *http.Request) {
+	log.Println("Get public keys")
+	data, _ := json.Marshal(a.keys.publicKeys())
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+	return
+}
+
+//add a signing key to take over from the current one
+func (a *api) rotateSigningKey(w http.ResponseWriter, r *http.Request) {
+	var req rotation
+	body, err := ioutil.ReadAll(r.Body)
+
+	if err != nil {
+		log.Println("Error rotating signing key", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Error rotating signing key"))
+		return
+	}
+
+	//an empty body rotates straight away
+	if len(body) > 0 && json.Unmarshal(body, &req) != nil {
+		log.Println("Error rotating signing key, bad JSON data")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Error rotating signing key, bad JSON data"))
+		return
+	}
+
+	k, err := a.keys.Rotate(req.ActivatesAt)
+	if err != nil {
+		log.Println("Error saving signing keys", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Error rotating signing key"))
+		return
+	}
+	log.Println("Signing key", k.ID, "takes over at", k.ActivatesAt)
+
+	//create and write http response
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusCreated)
+	data, _ := json.Marshal(keyInfo{k.ID, k.ActivatesAt, k.RetiresAt, k.RevokedAt})
+	w.Write(data)
+	return
+}
+
+//revoke a compromised signing key. Certificates signed with it are signed
+//again with the current key, anything else it signed stops verifying
+func (a *api) revokeSigningKey(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["keyID"] // id of key to be revoked
+	log.Println("Attempt to revoke signing key", id)
+
+	switch err := a.keys.Revoke(id); err {
+	case nil:
+	case errSigningKeyNotFound:
+		log.Println("Signing key not found")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404: Signing key not found"))
+		return
+	default:
+		log.Println("Error saving signing keys", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Error revoking signing key"))
+		return
+	}
+	if err := a.store.ResignCerts(id); err != nil {
+		log.Println("Error signing certificates again", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Signing key revoked, error signing certificates again"))
+		return
+	}
+
+	//create and write http response
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Signing Key Revoked"))
+	return
+}
@@ -0,0 +1,68 @@
+package certificates
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+//TestJWKS tests the public keys are served as a JSON Web Key Set
+func TestJWKS(t *testing.T) {
+	keys := newKeyManager()
+	r := NewRouter(newTestStore(), WithKeyManager(keys))
+
+	var set jwkSet
+	ledgerRequest(t, r, "/.well-known/jwks.json", &set)
+	if len(set.Keys) != 1 || set.Keys[0].KeyID != keys.current().ID {
+		t.Errorf("Expected the key set of the router. Got %+v", set)
+	}
+}
+
+//TestRotateSigningKey tests only admins rotate the key, and certificates and
+//access tokens signed before rotating still verify after
+func TestRotateSigningKey(t *testing.T) {
+	keys := newKeyManager()
+	r := NewRouter(newTestStore(), WithKeyManager(keys))
+	old := keys.current()
+	tokens := login(t, r, "rr01", "rrejh3294")
+	before := certRequest(r, "GET", "/certificates/c001", "", "", "").Body.Bytes()
+
+	checkResponseCode(t, http.StatusForbidden, certRequest(r, "POST", "/signing-keys/rotate", "", "vvg01", "vwh39043f").Code)
+	response := certRequest(r, "POST", "/signing-keys/rotate", "", "rr01", "rrejh3294")
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	var k keyInfo
+	json.Unmarshal(response.Body.Bytes(), &k)
+	if k.ID == old.ID || keys.current().ID != k.ID {
+		t.Errorf("Expected a new key to sign straight away. Got %+v", k)
+	}
+
+	checkResponseCode(t, http.StatusOK, withBearer(r, tokens.AccessToken))
+	if check := verifyDoc(t, r, before); !check.Valid || check.KeyID != old.ID {
+		t.Errorf("Expected certificate signed before rotating to verify. Got %+v", check)
+	}
+	var c certificate
+	json.Unmarshal(certRequest(r, "POST", "/certificates/create", `{"ID": "c030"}`, "rr01", "rrejh3294").Body.Bytes(), &c)
+	if c.KeyID != k.ID {
+		t.Errorf("Expected new certificate signed with the new key. Got %s", c.KeyID)
+	}
+	checkResponseCode(t, http.StatusBadRequest, certRequest(r, "POST", "/signing-keys/rotate", "{", "rr01", "rrejh3294").Code)
+}
+
+//TestRevokeSigningKey tests revoking a key signs certificates again with a
+//new key and ends access tokens it signed
+func TestRevokeSigningKey(t *testing.T) {
+	keys := newKeyManager()
+	r := NewRouter(newTestStore(), WithKeyManager(keys))
+	old := keys.current()
+	tokens := login(t, r, "rr01", "rrejh3294")
+
+	response := certRequest(r, "DELETE", "/signing-keys/"+old.ID, "", "rr01", "rrejh3294")
+	checkResponseCode(t, http.StatusOK, response.Code)
+	checkResponseCode(t, http.StatusUnauthorized, withBearer(r, tokens.AccessToken))
+
+	doc := certRequest(r, "GET", "/certificates/c001", "", "", "").Body.Bytes()
+	if check := verifyDoc(t, r, doc); !check.Valid || check.KeyID == old.ID {
+		t.Errorf("Expected certificate signed again with a new key. Got %+v", check)
+	}
+	checkResponseCode(t, http.StatusNotFound, certRequest(r, "DELETE", "/signing-keys/"+old.ID, "", "rr01", "rrejh3294").Code)
+}
@@ -0,0 +1,285 @@
+package certificates
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+//errors returned by the key manager
+var (
+	errSigningKeyNotFound = errors.New("signing key not found")
+	errSigningKeyRevoked  = errors.New("signing key has been revoked")
+)
+
+//signingKey is one of the Ed25519 keys of a KeyManager. A key signs from
+//ActivatesAt until RetiresAt and verifies what it signed until RevokedAt
+type signingKey struct {
+	ID          string
+	Private     ed25519.PrivateKey
+	CreatedAt   time.Time
+	ActivatesAt time.Time
+	RetiresAt   time.Time //zero while no later key has taken over
+	RevokedAt   time.Time //zero unless the key was compromised
+}
+
+func (k signingKey) public() ed25519.PublicKey {
+	return k.Private.Public().(ed25519.PublicKey)
+}
+
+//revoked reports whether a key may no longer be trusted at the time given
+func (k signingKey) revoked(at time.Time) bool {
+	return !k.RevokedAt.IsZero() && !at.Before(k.RevokedAt)
+}
+
+//signs reports whether a key is the one to sign with at the time given
+func (k signingKey) signs(at time.Time) bool {
+	return !at.Before(k.ActivatesAt) && (k.RetiresAt.IsZero() || at.Before(k.RetiresAt)) && !k.revoked(at)
+}
+
+//KeyManager holds the keys certificates, ledger checkpoints and access
+//tokens are signed with. It signs with the current key and verifies with
+//any key not revoked, so rotating to a new key leaves everything signed with
+//the old ones valid. Keys are saved to a file, if it has one, on every change
+type KeyManager struct {
+	path string
+	//now tells the time; tests swap it for a clock they control
+	now func() time.Time
+
+	mu   sync.RWMutex
+	keys []signingKey //oldest first
+}
+
+//NewKeyManager returns a key manager keeping its keys in the file at path,
+//which is created with a new key if it does not exist. A file holding a
+//single PEM encoded key is taken over as the first key. With an empty path
+//a new key is kept in memory only
+func NewKeyManager(path string) (*KeyManager, error) {
+	if path == "" {
+		return newKeyManager(), nil
+	}
+	m := &KeyManager{path: path, now: time.Now}
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		keys := []signingKey{m.newKey(m.now())}
+		return m, m.save(keys)
+	case err != nil:
+		return nil, err
+	case bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN")):
+		key, err := parsePEMKey(data)
+		if err != nil {
+			return nil, err
+		}
+		keys := []signingKey{{ID: keyIDOf(key.Public().(ed25519.PublicKey)), Private: key, CreatedAt: m.now().UTC()}}
+		return m, m.save(keys)
+	}
+	if err := json.Unmarshal(data, &m.keys); err != nil {
+		return nil, err
+	}
+	if len(m.keys) == 0 {
+		return nil, errors.New("no keys in signing key file")
+	}
+	return m, nil
+}
+
+//newKeyManager returns a key manager holding a single new key in memory only
+func newKeyManager() *KeyManager {
+	m := &KeyManager{now: time.Now}
+	m.keys = []signingKey{m.newKey(m.now())}
+	return m
+}
+
+//parsePEMKey reads a PKCS #8 Ed25519 key
+func parsePEMKey(data []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data in signing key file")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("signing key is not an Ed25519 key")
+	}
+	return key, nil
+}
+
+//newKey generates a key signing from the time given
+func (m *KeyManager) newKey(activatesAt time.Time) signingKey {
+	key := newSigningKey()
+	return signingKey{
+		ID:          keyIDOf(key.Public().(ed25519.PublicKey)),
+		Private:     key,
+		CreatedAt:   m.now().UTC(),
+		ActivatesAt: activatesAt.UTC(),
+	}
+}
+
+//save writes keys to the file, if any, and makes them the keys in use once
+//they are written, so a key that failed to save is never used; callers hold mu
+func (m *KeyManager) save(keys []signingKey) error {
+	if m.path != "" {
+		data, err := json.MarshalIndent(keys, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(m.path, data); err != nil {
+			return err
+		}
+	}
+	m.keys = keys
+	return nil
+}
+
+//current returns the key to sign with now: of the keys signing now the one
+//activated last, or failing that the newest key not revoked
+func (m *KeyManager) current() signingKey {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	now := m.now()
+	var current *signingKey
+	for i, k := range m.keys {
+		if k.signs(now) && (current == nil || !k.ActivatesAt.Before(current.ActivatesAt)) {
+			current = &m.keys[i]
+		}
+	}
+	if current == nil {
+		for i := len(m.keys) - 1; i >= 0 && current == nil; i-- {
+			if !m.keys[i].revoked(now) {
+				current = &m.keys[i]
+			}
+		}
+	}
+	if current == nil {
+		return m.keys[len(m.keys)-1]
+	}
+	return *current
+}
+
+//sign signs a message with the current key, returning the key's ID and the signature
+func (m *KeyManager) sign(message []byte) (string, []byte) {
+	k := m.current()
+	return k.ID, ed25519.Sign(k.Private, message)
+}
+
+//verify checks sig is the signature of message by the key keyID, which
+//must not be revoked
+func (m *KeyManager) verify(keyID string, message []byte, sig []byte) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, k := range m.keys {
+		if k.ID != keyID {
+			continue
+		}
+		if k.revoked(m.now()) {
+			return errSigningKeyRevoked
+		}
+		if !ed25519.Verify(k.public(), message, sig) {
+			return errBadSignature
+		}
+		return nil
+	}
+	return errUnknownKey
+}
+
+//Rotate adds a new key taking over signing at activatesAt, or straight away
+//if that has passed. The keys signing until then retire at that time
+func (m *KeyManager) Rotate(activatesAt time.Time) (signingKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	if activatesAt.Before(now) {
+		activatesAt = now
+	}
+	keys := append([]signingKey(nil), m.keys...)
+	for i, k := range keys {
+		if k.RetiresAt.IsZero() || k.RetiresAt.After(activatesAt) {
+			keys[i].RetiresAt = activatesAt.UTC()
+		}
+	}
+	k := m.newKey(activatesAt)
+	if err := m.save(append(keys, k)); err != nil {
+		return signingKey{}, err
+	}
+	return k, nil
+}
+
+//Revoke stops a key from signing or verifying anything from now on. If no
+//other key is left to sign with, a new key takes over straight away
+func (m *KeyManager) Revoke(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	keys := append([]signingKey(nil), m.keys...)
+	found := false
+	for i, k := range keys {
+		if k.ID == id && !k.revoked(now) {
+			keys[i].RevokedAt = now.UTC()
+			found = true
+		}
+	}
+	if !found {
+		return errSigningKeyNotFound
+	}
+	for _, k := range keys {
+		if k.signs(now) {
+			return m.save(keys)
+		}
+	}
+	return m.save(append(keys, m.newKey(now)))
+}
+
+//jwk is a public key as a JSON Web Key (RFC 8037), along with when it signs
+type jwk struct {
+	KeyType     string `json:"kty"`
+	Curve       string `json:"crv"`
+	X           string `json:"x"`
+	KeyID       string `json:"kid"`
+	Use         string `json:"use"`
+	Algorithm   string `json:"alg"`
+	ActivatesAt string `json:"activates_at"`
+	RetiresAt   string `json:"retires_at,omitempty"`
+}
+
+//jwkSet is the body of the well-known JWKS URL
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+//publicKeys returns every key not revoked, including those not signing yet
+//so verifiers can pick them up before they are used
+func (m *KeyManager) publicKeys() jwkSet {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	set := jwkSet{Keys: []jwk{}}
+	for _, k := range m.keys {
+		if k.revoked(m.now()) {
+			continue
+		}
+		key := jwk{
+			KeyType:     "OKP",
+			Curve:       "Ed25519",
+			X:           base64.RawURLEncoding.EncodeToString(k.public()),
+			KeyID:       k.ID,
+			Use:         "sig",
+			Algorithm:   "EdDSA",
+			ActivatesAt: k.ActivatesAt.UTC().Format(time.RFC3339),
+		}
+		if !k.RetiresAt.IsZero() {
+			key.RetiresAt = k.RetiresAt.UTC().Format(time.RFC3339)
+		}
+		set.Keys = append(set.Keys, key)
+	}
+	return set
+}
@@ -0,0 +1,155 @@
+package certificates
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//fixedClock returns a clock standing still at the time it points to
+func fixedClock(at *time.Time) func() time.Time {
+	return func() time.Time { return *at }
+}
+
+//TestKeyRotation tests a rotated key takes over signing when it activates
+//while what the old key signed still verifies
+func TestKeyRotation(t *testing.T) {
+	keys := newKeyManager()
+	now := keys.current().ActivatesAt
+	keys.now = fixedClock(&now)
+	old := keys.signCert(certificate{ID: "c001", OwnerID: "rr01"})
+
+	next, err := keys.Rotate(now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := keys.signCert(certificate{ID: "c001"}); c.KeyID != old.KeyID {
+		t.Errorf("Expected the old key to sign until the new one activates. Got %s", c.KeyID)
+	}
+	now = now.Add(time.Hour)
+	if c := keys.signCert(certificate{ID: "c001"}); c.KeyID != next.ID {
+		t.Errorf("Expected the new key %s to sign once active. Got %s", next.ID, c.KeyID)
+	}
+	if err := keys.verifyCert(old); err != nil {
+		t.Errorf("Expected certificate signed with the retired key to verify. Got %v", err)
+	}
+}
+
+//TestKeyRevocation tests a revoked key verifies nothing and another key
+//takes over signing
+func TestKeyRevocation(t *testing.T) {
+	keys := newKeyManager()
+	c := keys.signCert(certificate{ID: "c001", OwnerID: "rr01"})
+
+	if err := keys.Revoke(c.KeyID); err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.verifyCert(c); err != errSigningKeyRevoked {
+		t.Errorf("Expected certificate signed with a revoked key to fail. Got %v", err)
+	}
+	resigned := keys.signCert(c)
+	if resigned.KeyID == c.KeyID || keys.verifyCert(resigned) != nil {
+		t.Errorf("Expected a new key to sign after revocation. Got %s", resigned.KeyID)
+	}
+	if err := keys.Revoke(c.KeyID); err != errSigningKeyNotFound {
+		t.Errorf("Expected revoking a revoked key to fail. Got %v", err)
+	}
+	for _, k := range keys.publicKeys().Keys {
+		if k.KeyID == c.KeyID {
+			t.Errorf("Expected revoked key left out of the key set")
+		}
+	}
+}
+
+//TestKeyManagerFile tests keys are saved on change and read back after,
+//and a PEM key file from before rotation is taken over
+func TestKeyManagerFile(t *testing.T) {
+	dir := tempDataDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "signing.key")
+
+	created, err := NewKeyManager(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := created.signCert(certificate{ID: "c001", OwnerID: "rr01"})
+	created.Rotate(time.Now())
+	loaded, err := NewKeyManager(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loaded.verifyCert(c); err != nil {
+		t.Errorf("Expected the saved keys to be loaded. Got %v", err)
+	}
+	if got := len(loaded.publicKeys().Keys); got != 2 {
+		t.Errorf("Expected 2 keys after reload. Got %d", got)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+		t.Errorf("Expected key file readable by its owner only. Got %v", info.Mode())
+	}
+
+	key := newSigningKey()
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	imported, err := NewKeyManager(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := imported.current().ID; id != keyIDOf(key.Public().(ed25519.PublicKey)) {
+		t.Errorf("Expected the PEM key to keep its ID. Got %s", id)
+	}
+
+	ioutil.WriteFile(path, []byte("not a key"), 0600)
+	if _, err := NewKeyManager(path); err == nil {
+		t.Errorf("Expected a malformed key file to fail")
+	}
+}
+
+func TestKeyManagerSaveFailure(t *testing.T) {
+	dir := tempDataDir(t)
+	keys, err := NewKeyManager(filepath.Join(dir, "signing.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll(dir)
+	id := keys.current().ID
+
+	if _, err := keys.Rotate(time.Now()); err == nil {
+		t.Errorf("Expected rotating to fail when the keys cannot be saved")
+	}
+	if err := keys.Revoke(id); err == nil {
+		t.Errorf("Expected revoking to fail when the keys cannot be saved")
+	}
+	if got := len(keys.publicKeys().Keys); got != 1 {
+		t.Errorf("Expected the unsaved keys to be dropped. Got %d keys", got)
+	}
+	if got := keys.current().ID; got != id {
+		t.Errorf("Expected to keep signing with %s. Got %s", id, got)
+	}
+	c := keys.signCert(certificate{ID: "c001", OwnerID: "rr01"})
+	if err := keys.verifyCert(c); err != nil {
+		t.Errorf("Expected the key to stay unrevoked. Got %v", err)
+	}
+}
+
+//TestPublicKeys tests the key set holds each public key as a JWK
+func TestPublicKeys(t *testing.T) {
+	keys := newKeyManager()
+	k := keys.current()
+	set := keys.publicKeys()
+	if len(set.Keys) != 1 {
+		t.Fatalf("Expected one key. Got %+v", set)
+	}
+	got := set.Keys[0]
+	x, _ := base64.RawURLEncoding.DecodeString(got.X)
+	if got.KeyID != k.ID || got.KeyType != "OKP" || got.Curve != "Ed25519" || got.Algorithm != "EdDSA" ||
+		!k.public().Equal(ed25519.PublicKey(x)) {
+		t.Errorf("Expected JWK of %s. Got %+v", k.ID, got)
+	}
+}
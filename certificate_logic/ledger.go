@@ -0,0 +1,86 @@
+package certificates
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+//ledgerCheck is the outcome of checking the whole ledger
+type ledgerCheck struct {
+	Valid    bool
+	Events   int
+	Head     string //hash of the last event, which covers every event before it
+	BrokenAt uint64 `json:",omitempty"` //first event failing the check
+	Reason   string `json:",omitempty"`
+}
+
+//hashEvent is the hex SHA-256 of an event's JSON with its Hash left empty
+func hashEvent(ev ledgerEvent) string {
+	ev.Hash = ""
+	data, _ := json.Marshal(ev)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+//eventCert is the state of a certificate as kept in an event: its signature
+//is left out, being redone whenever the signing key changes
+func eventCert(c certificate) *certificate {
+	c.KeyID, c.Signature = "", ""
+	c.CreatedAt = c.CreatedAt.UTC()
+	return &c
+}
+
+//checkLedger recomputes the hash of every event and checks the links between
+//them, then checks each certificate is as the last of its events left it.
+//Certificates with no events were stored before the ledger was kept
+func checkLedger(events []ledgerEvent, certs certCollection) ledgerCheck {
+	check := ledgerCheck{Events: len(events)}
+	last := map[string]ledgerEvent{}
+	prev := ""
+	for i, ev := range events {
+		reason := ""
+		switch {
+		case ev.Seq != uint64(i+1):
+			reason = fmt.Sprintf("event %d is out of sequence", ev.Seq)
+		case ev.PrevHash != prev:
+			reason = fmt.Sprintf("event %d does not follow event %d", ev.Seq, i)
+		case ev.PrevCertHash != last[ev.CertID].Hash:
+			reason = fmt.Sprintf("event %d does not follow the last event of %s", ev.Seq, ev.CertID)
+		case ev.Hash != hashEvent(ev):
+			reason = fmt.Sprintf("event %d has been altered", ev.Seq)
+		}
+		if reason != "" {
+			check.BrokenAt, check.Reason = uint64(i+1), reason
+			return check
+		}
+		prev = ev.Hash
+		last[ev.CertID] = ev
+	}
+	check.Head = prev
+
+	stored := map[string]certificate{}
+	for _, c := range certs {
+		stored[c.ID] = c
+	}
+	for _, ev := range events {
+		//only the last event of each certificate is compared
+		if last[ev.CertID].Seq != ev.Seq {
+			continue
+		}
+		c, found := stored[ev.CertID]
+		if ev.Kind == eventDeleted && !found {
+			continue
+		}
+		if ev.Kind == eventDeleted || !found || ev.Cert == nil || !bytes.Equal(canonicalCert(c), canonicalCert(*ev.Cert)) ||
+			!sameRevocation(c.Revoked, ev.Cert.Revoked) {
+			check.BrokenAt = ev.Seq
+			check.Reason = fmt.Sprintf("certificate %s does not match its last event", ev.CertID)
+			return check
+		}
+	}
+	check.Valid = true
+	return check
+}
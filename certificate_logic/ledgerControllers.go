@@ -0,0 +1,181 @@
+package certificates
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+//inclusion proves an event is among those summarized by a checkpoint
+type inclusion struct {
+	Seq        uint64
+	LeafHash   string
+	Proof      []string //hashes from the leaf up to the root, see merkle.go
+	Checkpoint checkpoint
+}
+
+//consistency proves a checkpoint's events are the start of a later one's
+type consistency struct {
+	From  checkpoint
+	To    checkpoint
+	Proof []string
+}
+
+//Data altering functions
+// ~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+
+//findCheckpoint returns the checkpoint covering size events, given as a
+//query parameter, or the latest if size is empty
+func (a *api) findCheckpoint(size string) (checkpoint, bool) {
+	checkpoints := a.store.ListCheckpoints()
+	if size == "" && len(checkpoints) > 0 {
+		return checkpoints[len(checkpoints)-1], true
+	}
+	for _, cp := range checkpoints {
+		if strconv.FormatUint(cp.TreeSize, 10) == size {
+			return cp, true
+		}
+	}
+	return checkpoint{}, false
+}
+
+//Handler functions
+// ~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+
+//get the ledger events of a certificate, oldest first. Each names the hash
+//of the certificate's event before it, so the chain can be checked on its own
+func (a *api) getCertEvents(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"] // id of certificate whose events are listed
+	log.Println("Get events of cert", id)
+
+	events := a.store.GetCertEvents(id)
+
+	//a deleted certificate still has its events
+	if _, found := a.lookupCert(id); !found && len(events) == 0 {
+		log.Println("Certificate not found")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404: Certificate not found"))
+		return
+	}
+
+	data, _ := json.Marshal(events) //convert data returned to json
+
+	//create and write http response
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+	return
+}
+
+//check the hash chain of the whole ledger and that every certificate is as
+//its events say it should be
+func (a *api) verifyLedger(w http.ResponseWriter, r *http.Request) {
+	log.Println("Verify ledger")
+	check := checkLedger(a.store.GetLedger())
+	if !check.Valid {
+		log.Println("Ledger check failed:", check.Reason)
+	}
+
+	data, _ := json.Marshal(check) //convert data returned to json
+
+	//create and write http response
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+	return
+}
+
+//list the signed checkpoints of the ledger, oldest first
+func (a *api) listCheckpoints(w http.ResponseWriter, r *http.Request) {
+	log.Println("List checkpoints")
+	data, _ := json.Marshal(a.store.ListCheckpoints())
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+	return
+}
+
+//prove the event numbered seq is included in the checkpoint of size events,
+//the latest checkpoint if no size is given
+func (a *api) getInclusionProof(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	log.Println("Inclusion proof of event", query.Get("seq"), "in checkpoint", query.Get("size"))
+
+	cp, found := a.findCheckpoint(query.Get("size"))
+	if !found {
+		log.Println("Checkpoint not found")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404: Checkpoint not found"))
+		return
+	}
+	seq, err := strconv.ParseUint(query.Get("seq"), 10, 64)
+	if err != nil || seq == 0 || seq > cp.TreeSize {
+		log.Println("Event not in checkpoint")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Error proving inclusion, seq must be an event covered by the checkpoint"))
+		return
+	}
+
+	events := a.store.GetEvents()
+	leaves := eventLeaves(events[:cp.TreeSize])
+	proof := inclusion{
+		Seq:        seq,
+		LeafHash:   hex.EncodeToString(leaves[seq-1]),
+		Proof:      hexHashes(inclusionProof(int(seq-1), leaves)),
+		Checkpoint: cp,
+	}
+
+	//create and write http response
+	data, _ := json.Marshal(proof)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+	return
+}
+
+//prove the checkpoint of from events is consistent with the later one of to
+//events: the ledger only grew in between, nothing in it was changed
+func (a *api) getConsistencyProof(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	log.Println("Consistency proof from checkpoint", query.Get("from"), "to", query.Get("to"))
+
+	from, foundFrom := a.findCheckpoint(query.Get("from"))
+	to, foundTo := a.findCheckpoint(query.Get("to"))
+	if query.Get("from") == "" || !foundFrom || !foundTo {
+		log.Println("Checkpoint not found")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404: Checkpoint not found"))
+		return
+	}
+	if from.TreeSize > to.TreeSize {
+		log.Println("Checkpoints out of order")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Error proving consistency, from must be the earlier checkpoint"))
+		return
+	}
+
+	events := a.store.GetEvents()
+	leaves := eventLeaves(events[:to.TreeSize])
+	proof := consistency{
+		From:  from,
+		To:    to,
+		Proof: hexHashes(consistencyProof(int(from.TreeSize), leaves)),
+	}
+
+	//create and write http response
+	data, _ := json.Marshal(proof)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+	return
+}
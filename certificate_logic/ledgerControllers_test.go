@@ -0,0 +1,170 @@
+package certificates
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+//ledgerRequest fetches a ledger endpoint and decodes the response into v
+func ledgerRequest(t *testing.T, r http.Handler, url string, v interface{}) {
+	req, _ := http.NewRequest("GET", url, nil)
+	response := executeOn(r, req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	json.Unmarshal(response.Body.Bytes(), v)
+}
+
+//TestCertEvents tests every change to a certificate is chained in its events,
+//which outlive the certificate
+func TestCertEvents(t *testing.T) {
+	store := newTestStore()
+	r := NewRouter(store)
+
+	certRequest(r, "POST", "/certificates/create", `{"ID": "c020", "Title": "Irises"}`, "vvg01", "vwh39043f")
+	certRequest(r, "PUT", "/certificates/update", `{"ID": "c020", "Title": "Irises", "Note": "framed"}`, "vvg01", "vwh39043f")
+	tr := newTransfer("c020", "vvg01", "reshawnramjattan@gmail.com")
+	store.CreateTransfer(tr)
+	store.AcceptTransfer(tr.ID, tr.To, "rr01", time.Now())
+	response := certRequest(r, "DELETE", "/certificates/c020/delete", "", "rr01", "rrejh3294")
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var events []ledgerEvent
+	ledgerRequest(t, r, "/certificates/c020/events", &events)
+	kinds := []string{eventCreated, eventUpdated, eventTransferred, eventDeleted}
+	if len(events) != len(kinds) {
+		t.Fatalf("Expected %d events. Got %+v", len(kinds), events)
+	}
+	prev := ""
+	for i, ev := range events {
+		if ev.Kind != kinds[i] || ev.PrevCertHash != prev || ev.Hash != hashEvent(ev) {
+			t.Errorf("Expected %s event chained to the one before. Got %+v", kinds[i], ev)
+		}
+		prev = ev.Hash
+	}
+	if events[2].Cert.OwnerID != "rr01" || events[2].TransferID != tr.ID {
+		t.Errorf("Expected transfer event to hold the new owner. Got %+v", events[2])
+	}
+
+	req, _ := http.NewRequest("GET", "/certificates/c404/events", nil)
+	checkResponseCode(t, http.StatusNotFound, executeOn(r, req).Code)
+}
+
+//TestVerifyLedger tests rewriting a past event, or a certificate behind the
+//ledger's back, is caught
+func TestVerifyLedger(t *testing.T) {
+	store := newTestStore()
+	r := NewRouter(store)
+	tr := newTransfer("c001", "rr01", "vvg@gmail.com")
+	store.CreateTransfer(tr)
+	store.AcceptTransfer(tr.ID, tr.To, "vvg01", time.Now())
+
+	var check ledgerCheck
+	ledgerRequest(t, r, "/ledger/verify", &check)
+	if !check.Valid || check.Events != 3 || check.Head != store.ledger[2].Hash {
+		t.Errorf("Expected a valid ledger of 3 events. Got %+v", check)
+	}
+
+	//hand the certificate back to its first owner in history
+	store.ledger[2].Cert.OwnerID = "rr01"
+	check = ledgerCheck{}
+	ledgerRequest(t, r, "/ledger/verify", &check)
+	if check.Valid || check.BrokenAt != 3 {
+		t.Errorf("Expected altered event to be caught. Got %+v", check)
+	}
+	store.ledger[2].Cert.OwnerID = "vvg01"
+
+	store.certs["c001"].cert.OwnerID = "rr01"
+	check = ledgerCheck{}
+	ledgerRequest(t, r, "/ledger/verify", &check)
+	if check.Valid || check.BrokenAt != 3 {
+		t.Errorf("Expected certificate changed outside the ledger to be caught. Got %+v", check)
+	}
+}
+
+//decodeHashes turns hex hashes from a response back into bytes
+func decodeHashes(encoded []string) [][]byte {
+	hashes := make([][]byte, len(encoded))
+	for i, h := range encoded {
+		hashes[i], _ = hex.DecodeString(h)
+	}
+	return hashes
+}
+
+//TestCheckpointProofs tests an event is proved to be in a signed checkpoint
+//and an earlier checkpoint to be consistent with a later one
+func TestCheckpointProofs(t *testing.T) {
+	store := newTestStore()
+	keys := newKeyManager()
+	r := NewRouter(store, WithKeyManager(keys))
+
+	first, made := makeCheckpoint(store, keys, time.Now())
+	if !made || first.TreeSize != 2 {
+		t.Fatalf("Expected checkpoint of the 2 seeded events. Got %+v", first)
+	}
+	if _, made := makeCheckpoint(store, keys, time.Now()); made {
+		t.Errorf("Expected no checkpoint while the ledger is unchanged")
+	}
+	for _, id := range []string{"c020", "c021", "c022"} {
+		certRequest(r, "POST", "/certificates/create", `{"ID": "`+id+`"}`, "rr01", "rrejh3294")
+	}
+	second, _ := makeCheckpoint(store, keys, time.Now())
+
+	var checkpoints []checkpoint
+	ledgerRequest(t, r, "/ledger/checkpoints", &checkpoints)
+	if len(checkpoints) != 2 || checkpoints[1].TreeSize != 5 {
+		t.Fatalf("Expected checkpoints of 2 and 5 events. Got %+v", checkpoints)
+	}
+	sig, _ := base64.StdEncoding.DecodeString(checkpoints[1].Signature)
+	if err := keys.verify(checkpoints[1].KeyID, canonicalCheckpoint(checkpoints[1]), sig); err != nil {
+		t.Errorf("Expected checkpoint signature to verify. Got %v", err)
+	}
+
+	var in inclusion
+	ledgerRequest(t, r, "/ledger/proofs/inclusion?seq=4", &in)
+	events := store.GetCertEvents("c021")
+	leaf, _ := hex.DecodeString(in.LeafHash)
+	root, _ := hex.DecodeString(second.RootHash)
+	if in.Checkpoint.TreeSize != 5 || hex.EncodeToString(leafHash(events[0])) != in.LeafHash ||
+		!checkInclusion(leaf, 3, 5, decodeHashes(in.Proof), root) {
+		t.Errorf("Expected event 4 to be proved in the latest checkpoint. Got %+v", in)
+	}
+
+	var c consistency
+	ledgerRequest(t, r, "/ledger/proofs/consistency?from=2&to=5", &c)
+	old, _ := hex.DecodeString(first.RootHash)
+	if !checkConsistency(2, 5, old, root, decodeHashes(c.Proof)) {
+		t.Errorf("Expected checkpoint of 2 to be consistent with checkpoint of 5. Got %+v", c)
+	}
+
+	for url, code := range map[string]int{
+		"/ledger/proofs/inclusion?seq=4&size=2":   http.StatusBadRequest,
+		"/ledger/proofs/inclusion?seq=1&size=3":   http.StatusNotFound,
+		"/ledger/proofs/consistency?from=5&to=2":  http.StatusBadRequest,
+		"/ledger/proofs/consistency?from=3&to=5":  http.StatusNotFound,
+		"/ledger/proofs/consistency?to=5":         http.StatusNotFound,
+		"/ledger/proofs/inclusion?seq=one&size=5": http.StatusBadRequest,
+	} {
+		req, _ := http.NewRequest("GET", url, nil)
+		if got := executeOn(r, req).Code; got != code {
+			t.Errorf("Expected %d for %s. Got %d", code, url, got)
+		}
+	}
+}
+
+//TestCheckpointer tests the background checkpointer signs the ledger
+func TestCheckpointer(t *testing.T) {
+	store := newTestStore()
+	stop := StartCheckpointer(store, newKeyManager(), time.Millisecond, time.Now)
+	defer stop()
+
+	deadline := time.Now().Add(time.Second)
+	for len(store.ListCheckpoints()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if checkpoints := store.ListCheckpoints(); len(checkpoints) != 1 || checkpoints[0].TreeSize != 2 {
+		t.Errorf("Expected one checkpoint of the seeded events. Got %+v", checkpoints)
+	}
+}
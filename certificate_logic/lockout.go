@@ -0,0 +1,210 @@
+package certificates
+
+import (
+	"container/list"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//LockoutPolicy sets how failed password attempts are answered. Once a user
+//ID or a client IP reaches its threshold of failures it is locked out for
+//BaseDelay, doubling with each further failure up to MaxDelay. Failures are
+//forgotten once none has happened for Window
+type LockoutPolicy struct {
+	UserThreshold int //failures for one user ID; zero turns lockout off
+	IPThreshold   int //failures from one client IP, over any user IDs
+	BaseDelay     time.Duration
+	MaxDelay      time.Duration
+	Window        time.Duration
+}
+
+//DefaultLockoutPolicy is used unless configured otherwise
+var DefaultLockoutPolicy = LockoutPolicy{
+	UserThreshold: 5,
+	IPThreshold:   20,
+	BaseDelay:     30 * time.Second,
+	MaxDelay:      time.Hour,
+	Window:        24 * time.Hour,
+}
+
+//failures is the record of failed attempts for one user ID or client IP
+type failures struct {
+	key         string
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+//guardLimit is how many user IDs, and how many client IPs, are tracked at
+//most. Past it the one that failed longest ago is forgotten, so guessing at
+//random user IDs from many clients cannot fill memory
+const guardLimit = 10000
+
+//failureLog holds the failures of user IDs or of client IPs, ordered from
+//the one that failed longest ago to the latest
+type failureLog struct {
+	limit   int
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+func newFailureLog(limit int) *failureLog {
+	return &failureLog{limit: limit, entries: map[string]*list.Element{}, order: list.New()}
+}
+
+//get returns the failures of a key, nil if it has none
+func (l *failureLog) get(key string) *failures {
+	if el, found := l.entries[key]; found {
+		return el.Value.(*failures)
+	}
+	return nil
+}
+
+//touch returns the failures of a key, adding them if missing, and moves
+//them to the latest. Adding to a full log forgets the oldest
+func (l *failureLog) touch(key string) *failures {
+	if el, found := l.entries[key]; found {
+		l.order.MoveToBack(el)
+		return el.Value.(*failures)
+	}
+	if l.order.Len() >= l.limit {
+		l.remove(l.order.Front().Value.(*failures).key)
+	}
+	f := &failures{key: key}
+	l.entries[key] = l.order.PushBack(f)
+	return f
+}
+
+//remove forgets the failures of a key
+func (l *failureLog) remove(key string) {
+	if el, found := l.entries[key]; found {
+		l.order.Remove(el)
+		delete(l.entries, key)
+	}
+}
+
+//loginGuard tracks failed password attempts in memory; a restart forgets them
+type loginGuard struct {
+	policy LockoutPolicy
+	mu     sync.Mutex
+	byUser *failureLog
+	byIP   *failureLog
+}
+
+func newLoginGuard(policy LockoutPolicy) *loginGuard {
+	return &loginGuard{policy: policy, byUser: newFailureLog(guardLimit), byIP: newFailureLog(guardLimit)}
+}
+
+//lockedFor returns how long a user ID or client IP stays locked out, zero if neither is
+func (g *loginGuard) lockedFor(userID string, ip string, at time.Time) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var wait time.Duration
+	for _, f := range []*failures{g.byUser.get(userID), g.byIP.get(ip)} {
+		if f != nil && f.lockedUntil.Sub(at) > wait {
+			wait = f.lockedUntil.Sub(at)
+		}
+	}
+	return wait
+}
+
+//fail records a failed attempt against both a user ID and a client IP
+func (g *loginGuard) fail(userID string, ip string, at time.Time) {
+	if g.policy.UserThreshold <= 0 {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.count(g.byUser, userID, g.policy.UserThreshold, at) {
+		log.Println("Locking out user", userID, "after repeated failed logins")
+	}
+	if g.count(g.byIP, ip, g.policy.IPThreshold, at) {
+		log.Println("Locking out client", ip, "after repeated failed logins")
+	}
+}
+
+//count adds a failure to an entry, locking it once past the threshold;
+//callers hold mu. It reports whether the entry is now locked
+func (g *loginGuard) count(l *failureLog, key string, threshold int, at time.Time) bool {
+	f := l.touch(key)
+	if at.Sub(f.last) > g.policy.Window {
+		f.count, f.lockedUntil = 0, time.Time{}
+	}
+	f.count++
+	f.last = at
+	if threshold <= 0 || f.count < threshold {
+		return false
+	}
+	//doubles with each failure past the threshold
+	delay := time.Duration(float64(g.policy.BaseDelay) * math.Pow(2, float64(f.count-threshold)))
+	if delay > g.policy.MaxDelay || delay <= 0 {
+		delay = g.policy.MaxDelay
+	}
+	f.lockedUntil = at.Add(delay)
+	return true
+}
+
+//succeed forgets the failures of a user ID. Those of the client IP stand,
+//so one working account cannot be used to keep guessing at others
+func (g *loginGuard) succeed(userID string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.byUser.remove(userID)
+}
+
+//unlock lifts the lockout of a user ID, for passwords and one-time codes
+func (g *loginGuard) unlock(userID string) {
+	g.succeed(userID)
+	g.succeed(codeGuardKey(userID))
+}
+
+//lockedError is returned when credentials are not even checked because the
+//user ID or client IP is locked out
+type lockedError struct {
+	retryAfter time.Duration
+}
+
+func (e lockedError) Error() string {
+	return fmt.Sprintf("locked out for %v", e.retryAfter)
+}
+
+//clientIP returns the address a request came from
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+//checkPasswordFrom authenticates a user by password as authenticate does,
+//counting failures against the user ID and the client IP of the request.
+//While either is locked out it fails with a lockedError without looking at
+//the password
+func (a *api) checkPasswordFrom(r *http.Request, id string, pass string) (user, error) {
+	ip := clientIP(r)
+	if wait := a.guard.lockedFor(id, ip, a.now()); wait > 0 {
+		return user{}, lockedError{wait}
+	}
+	u, valid := a.authenticate(id, pass)
+	if !valid {
+		a.guard.fail(id, ip, a.now())
+		return user{}, errBadCredentials
+	}
+	a.guard.succeed(id)
+	return u, nil
+}
+
+//tooManyAttempts answers a request refused by a lockout
+func tooManyAttempts(w http.ResponseWriter, err lockedError) {
+	log.Println("Locked out:", err)
+	seconds := int(math.Ceil(err.retryAfter.Seconds()))
+	w.Header().Set("Retry-After", fmt.Sprint(seconds))
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write([]byte(fmt.Sprintf("429: Too many failed attempts, try again in %d seconds", seconds)))
+}
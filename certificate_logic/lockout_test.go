@@ -0,0 +1,146 @@
+package certificates
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+//router, executeRequest and checkResponseCode are defined in certControllers_test.go
+//this file of unit tests can be considered an extension of that and is separated solely
+//for the purposes of separating duties and logic
+
+//lockoutPolicy locks a user after 3 failures and a client after 5
+var lockoutPolicy = LockoutPolicy{
+	UserThreshold: 3,
+	IPThreshold:   5,
+	BaseDelay:     time.Minute,
+	MaxDelay:      10 * time.Minute,
+	Window:        time.Hour,
+}
+
+//basicAuth lists a user's outgoing transfers on a router with basic auth
+func basicAuth(r http.Handler, userID string, pass string) *http.Response {
+	req, _ := http.NewRequest("GET", "/users/"+userID+"/transfers/outgoing", nil)
+	req.SetBasicAuth(userID, pass)
+	return executeOn(r, req).Result()
+}
+
+//TestLockout test a user is locked out after repeated failures, even with the
+//right password, until the delay passes
+func TestLockout(t *testing.T) {
+	clock := newTestClock()
+	r := NewRouter(newTestStore(), WithClock(clock.Now), WithLockout(lockoutPolicy))
+	for i := 0; i < lockoutPolicy.UserThreshold; i++ {
+		checkResponseCode(t, http.StatusUnauthorized, basicAuth(r, "rr01", "guess").StatusCode)
+	}
+
+	response := basicAuth(r, "rr01", "rrejh3294")
+	checkResponseCode(t, http.StatusTooManyRequests, response.StatusCode)
+	if retry := response.Header.Get("Retry-After"); retry != "60" {
+		t.Errorf("Expected Retry-After of 60. Got '%s'", retry)
+	}
+	//login is locked out as well
+	checkResponseCode(t, http.StatusTooManyRequests, loginCode(r, "rr01", "rrejh3294"))
+
+	clock.Advance(time.Minute)
+	checkResponseCode(t, http.StatusOK, basicAuth(r, "rr01", "rrejh3294").StatusCode)
+}
+
+//TestLockoutBackoff test each failure past the threshold doubles the delay,
+//up to the maximum
+func TestLockoutBackoff(t *testing.T) {
+	clock := newTestClock()
+	r := NewRouter(newTestStore(), WithClock(clock.Now), WithLockout(lockoutPolicy))
+	for i := 0; i < lockoutPolicy.UserThreshold; i++ {
+		basicAuth(r, "rr01", "guess")
+	}
+
+	delay := time.Minute
+	for _, want := range []string{"120", "240", "480", "600"} {
+		clock.Advance(delay)
+		checkResponseCode(t, http.StatusUnauthorized, basicAuth(r, "rr01", "guess").StatusCode)
+		response := basicAuth(r, "rr01", "rrejh3294")
+		checkResponseCode(t, http.StatusTooManyRequests, response.StatusCode)
+		if retry := response.Header.Get("Retry-After"); retry != want {
+			t.Errorf("Expected Retry-After of %s. Got '%s'", want, retry)
+		}
+		delay, _ = time.ParseDuration(want + "s")
+	}
+}
+
+//TestLockoutByIP test a client guessing at many user IDs is locked out, while
+//other clients are not
+func TestLockoutByIP(t *testing.T) {
+	r := NewRouter(newTestStore(), WithLockout(lockoutPolicy))
+	for i := 0; i < lockoutPolicy.IPThreshold; i++ {
+		basicAuth(r, fmt.Sprintf("u%03d", i), "guess")
+	}
+	checkResponseCode(t, http.StatusTooManyRequests, basicAuth(r, "vvg01", "vwh39043f").StatusCode)
+
+	req, _ := http.NewRequest("GET", "/users/vvg01/transfers/outgoing", nil)
+	req.SetBasicAuth("vvg01", "vwh39043f")
+	req.RemoteAddr = "198.51.100.7:4321"
+	checkResponseCode(t, http.StatusOK, executeOn(r, req).Code)
+}
+
+//TestUnlockUser test an admin can lift the lockout of a user
+func TestUnlockUser(t *testing.T) {
+	r := NewRouter(newTestStore(), WithLockout(lockoutPolicy))
+	for i := 0; i < lockoutPolicy.UserThreshold; i++ {
+		basicAuth(r, "vvg01", "guess")
+	}
+	checkResponseCode(t, http.StatusTooManyRequests, basicAuth(r, "vvg01", "vwh39043f").StatusCode)
+
+	//from another client, as this one is locked out as well
+	unlock := func(userID string, pass string, target string) int {
+		req, _ := http.NewRequest("DELETE", "/users/"+target+"/lockout", nil)
+		req.SetBasicAuth(userID, pass)
+		req.RemoteAddr = "198.51.100.7:4321"
+		return executeOn(r, req).Code
+	}
+	checkResponseCode(t, http.StatusNotFound, unlock("rr01", "rrejh3294", "kh01"))
+	checkResponseCode(t, http.StatusOK, unlock("rr01", "rrejh3294", "vvg01"))
+	checkResponseCode(t, http.StatusOK, basicAuth(r, "vvg01", "vwh39043f").StatusCode)
+}
+
+//TestLockoutLimit test the guard tracks no more user IDs or client IPs
+//than its limit, forgetting the ones that failed longest ago
+func TestLockoutLimit(t *testing.T) {
+	g := newLoginGuard(lockoutPolicy)
+	g.byUser, g.byIP = newFailureLog(3), newFailureLog(3)
+	at := time.Now()
+	for _, id := range []string{"u1", "u2", "u1", "u3", "u4"} {
+		g.fail(id, "ip-"+id, at)
+	}
+	for _, l := range []*failureLog{g.byUser, g.byIP} {
+		if l.order.Len() != 3 || len(l.entries) != 3 {
+			t.Errorf("Expected 3 entries tracked. Got %d", len(l.entries))
+		}
+	}
+	if g.byUser.get("u2") != nil || g.byIP.get("ip-u2") != nil {
+		t.Errorf("Expected the oldest failure to be forgotten")
+	}
+	if f := g.byUser.get("u1"); f == nil || f.count != 2 {
+		t.Errorf("Expected u1 to keep its 2 failures. Got %+v", f)
+	}
+}
+
+//TestLockoutDisabled test a zero threshold turns lockout off
+func TestLockoutDisabled(t *testing.T) {
+	r := NewRouter(newTestStore(), WithLockout(LockoutPolicy{}))
+	for i := 0; i < 10; i++ {
+		basicAuth(r, "rr01", "guess")
+	}
+	checkResponseCode(t, http.StatusOK, basicAuth(r, "rr01", "rrejh3294").StatusCode)
+}
+
+//loginCode logs a user in on a router and returns the response code
+func loginCode(r http.Handler, userID string, pass string) int {
+	body, _ := json.Marshal(credentials{UserID: userID, Password: pass})
+	req, _ := http.NewRequest("POST", "/auth/login", bytes.NewBuffer(body))
+	return executeOn(r, req).Code
+}
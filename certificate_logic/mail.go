@@ -0,0 +1,112 @@
+package certificates
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Message is an email to a single recipient
+type Message struct {
+	To      string
+	Subject string
+	Body    string //plain text
+}
+
+//Mailer sends the email the API writes to users, such as password reset
+//tokens. NewRouter keeps mail in an in-memory Outbox unless given one with
+//WithMailer
+type Mailer interface {
+	Send(m Message) error
+}
+
+//SMTPMailer sends mail through an SMTP server
+type SMTPMailer struct {
+	Addr string //host:port of the server
+	From string
+	Auth smtp.Auth //nil to send without logging in
+}
+
+//NewSMTPMailer returns a mailer for the server at addr, logging in with
+//username and password unless username is empty
+func NewSMTPMailer(addr string, from string, username string, password string) *SMTPMailer {
+	m := &SMTPMailer{Addr: addr, From: from}
+	if username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		m.Auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m
+}
+
+//Send delivers a message to the server
+func (m *SMTPMailer) Send(msg Message) error {
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{msg.To}, formatMessage(m.From, msg, time.Now()))
+}
+
+//formatMessage writes a message out with the headers a mail server expects
+func formatMessage(from string, msg Message, at time.Time) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", at.Format(time.RFC1123Z))
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(strings.Replace(msg.Body, "\n", "\r\n", -1))
+	return b.Bytes()
+}
+
+//outboxLimit is how many messages an Outbox holds in memory; older ones are
+//dropped so tokens never delivered do not pile up
+const outboxLimit = 100
+
+//Outbox keeps mail instead of sending it, for tests and local development.
+//The latest messages are held in memory and, when a directory is given, each
+//is also written there as an .eml file that any mail client can open
+type Outbox struct {
+	dir      string
+	mu       sync.Mutex
+	messages []Message
+}
+
+//NewOutbox returns an outbox writing to dir, or only to memory if dir is empty
+func NewOutbox(dir string) (*Outbox, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+	return &Outbox{dir: dir}, nil
+}
+
+//Send adds a message to the outbox
+func (o *Outbox) Send(msg Message) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.messages = append(o.messages, msg)
+	if len(o.messages) > outboxLimit {
+		o.messages = append([]Message(nil), o.messages[len(o.messages)-outboxLimit:]...)
+	}
+	if o.dir == "" {
+		return nil
+	}
+	now := time.Now()
+	//a random part keeps names apart across restarts; the time sorts them
+	name := fmt.Sprintf("%s-%s.eml", now.UTC().Format("20060102T150405.000000000"), newID(""))
+	log.Println("Mail to", msg.To, "kept in", name)
+	return ioutil.WriteFile(filepath.Join(o.dir, name), formatMessage("certificates@localhost", msg, now), 0600)
+}
+
+//Messages returns the latest mail sent, oldest first
+func (o *Outbox) Messages() []Message {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]Message(nil), o.messages...)
+}
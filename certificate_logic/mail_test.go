@@ -0,0 +1,129 @@
+package certificates
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//TestOutboxDir test mail kept in an outbox directory is written out as .eml files
+func TestOutboxDir(t *testing.T) {
+	dir := tempDataDir(t)
+	defer os.RemoveAll(dir)
+
+	outbox, err := NewOutbox(filepath.Join(dir, "outbox"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbox.Send(Message{To: "vvg@gmail.com", Subject: "Hello", Body: "line one\nline two"})
+	files, _ := filepath.Glob(filepath.Join(dir, "outbox", "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("Expected one .eml file. Got %v", files)
+	}
+	data, _ := ioutil.ReadFile(files[0])
+	if !bytes.Contains(data, []byte("To: vvg@gmail.com\r\n")) || !bytes.HasSuffix(data, []byte("\r\n\r\nline one\r\nline two")) {
+		t.Errorf("Expected headers and body. Got '%s'", data)
+	}
+
+	//an outbox opened again after a restart adds to the mail kept before
+	reopened, _ := NewOutbox(filepath.Join(dir, "outbox"))
+	reopened.Send(Message{To: "vvg@gmail.com", Subject: "Again"})
+	if files, _ := filepath.Glob(filepath.Join(dir, "outbox", "*.eml")); len(files) != 2 {
+		t.Errorf("Expected mail from before the restart kept. Got %v", files)
+	}
+}
+
+//TestOutboxLimit test an outbox only holds the latest messages in memory
+func TestOutboxLimit(t *testing.T) {
+	outbox, _ := NewOutbox("")
+	for i := 0; i < outboxLimit+5; i++ {
+		outbox.Send(Message{To: "vvg@gmail.com", Subject: fmt.Sprint(i)})
+	}
+	messages := outbox.Messages()
+	if len(messages) != outboxLimit || messages[0].Subject != "5" {
+		t.Errorf("Expected the latest %d messages. Got %d starting at %s", outboxLimit, len(messages), messages[0].Subject)
+	}
+}
+
+//TestFormatMessage test a message is written with its headers and CRLF line endings
+func TestFormatMessage(t *testing.T) {
+	at := time.Date(2009, 11, 17, 20, 34, 58, 0, time.UTC)
+	got := string(formatMessage("certificates@example.com", Message{To: "vvg@gmail.com", Subject: "Hello", Body: "one\ntwo"}, at))
+	want := "From: certificates@example.com\r\nTo: vvg@gmail.com\r\nSubject: Hello\r\n" +
+		"Date: Tue, 17 Nov 2009 20:34:58 +0000\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\none\r\ntwo"
+	if got != want {
+		t.Errorf("Expected message '%s'. Got '%s'", want, got)
+	}
+}
+
+//fakeSMTP accepts a single mail on a local port, passing what it received
+//to the channel once the client quits
+func fakeSMTP(t *testing.T) (string, chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan string, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tp := textproto.NewConn(conn)
+		var envelope []string
+		tp.PrintfLine("220 localhost ESMTP")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			switch verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); verb {
+			case "EHLO", "HELO":
+				tp.PrintfLine("250 localhost")
+			case "MAIL", "RCPT":
+				envelope = append(envelope, line)
+				tp.PrintfLine("250 OK")
+			case "DATA":
+				tp.PrintfLine("354 Go ahead")
+				data, _ := ioutil.ReadAll(bufio.NewReader(tp.DotReader()))
+				envelope = append(envelope, string(data))
+				tp.PrintfLine("250 OK")
+			case "QUIT":
+				tp.PrintfLine("221 Bye")
+				received <- strings.Join(envelope, "\n")
+				return
+			default:
+				tp.PrintfLine("250 OK")
+			}
+		}
+	}()
+	return l.Addr().String(), received
+}
+
+//TestSMTPMailer test a message is handed to the SMTP server for its recipient
+func TestSMTPMailer(t *testing.T) {
+	addr, received := fakeSMTP(t)
+	m := NewSMTPMailer(addr, "certificates@example.com", "", "")
+	if err := m.Send(Message{To: "vvg@gmail.com", Subject: "Hello", Body: "line one"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-received:
+		if !strings.Contains(got, "MAIL FROM:<certificates@example.com>") || !strings.Contains(got, "RCPT TO:<vvg@gmail.com>") ||
+			!strings.Contains(got, "Subject: Hello\n") || !strings.HasSuffix(got, "line one\n") {
+			t.Errorf("Expected envelope and message. Got '%s'", got)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected mail at the server")
+	}
+}
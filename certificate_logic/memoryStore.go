@@ -0,0 +1,1272 @@
+package certificates
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+//certEntry is a stored certificate together with the lock serializing
+//changes to it. Operations on different certificates never wait on each other
+type certEntry struct {
+	mu      sync.Mutex
+	cert    certificate
+	latest  string //ID of the most recent transfer, if any
+	history []ownershipChange
+	deleted bool   //entry was removed while a caller was waiting on mu
+	order   uint64 //insertion order, used to list certificates stably
+}
+
+//memoryStore keeps everything in memory; nothing survives a restart
+//unless a journal is set to record each change
+type memoryStore struct {
+	//held shared by every change for its whole duration and exclusively by
+	//anything needing a view of the store with no change half applied
+	commitMu sync.RWMutex
+
+	//guards the certs map, the insertion counter and the user indexes.
+	//Nothing takes it while holding a certEntry lock, so DeleteCert may
+	//wait on one under it
+	mu           sync.RWMutex
+	certs        map[string]*certEntry
+	inserted     uint64
+	users        map[string]user
+	usersByEmail map[string]string //email to user ID
+
+	//guards the transfers map and its indexes by sender user ID and
+	//recipient email. Transfers are only changed while holding the lock of
+	//their certificate, this is taken briefly to read or store one
+	transferMu  sync.Mutex
+	transfers   map[string]transfer
+	bySender    map[string][]string
+	byRecipient map[string][]string
+
+	//guards the password resets. It is taken under mu, and sessionMu under it
+	resetMu sync.Mutex
+	resets  map[string]passwordReset
+
+	//guards the email verifications. It is taken under mu
+	verifyMu     sync.Mutex
+	verifyTokens map[string]verification
+
+	//guards the two-factor authenticators, by user ID
+	twoFactorMu sync.Mutex
+	twoFactors  map[string]twoFactor
+
+	//guards the sessions map
+	sessionMu sync.Mutex
+	sessions  map[string]session
+
+	//guards the API keys and their index by user ID
+	keyMu     sync.Mutex
+	apiKeys   map[string]apiKey
+	keyByUser map[string][]string
+
+	//guards byOwner, which maps an OwnerID to the certificates it holds. It
+	//is taken last, under any other lock, so it changes along with the owner
+	ownerMu sync.Mutex
+	byOwner map[string]map[string]*certEntry
+
+	//journal, when set, is handed every change after its checks pass and
+	//before it is applied; an error aborts the change
+	journal func(e logEntry) error
+
+	//guards sign, which when set signs every certificate as it is stored.
+	//It is taken briefly, under any other lock
+	signMu sync.RWMutex
+	sign   func(c certificate) certificate
+
+	//guards the ledger of certificate events and its index by certificate
+	//ID. A change to a certificate holds it from making its event until the
+	//event is appended, logging included, so the ledger and the log agree on
+	//the order of events. It is taken under a certificate's lock
+	ledgerMu     sync.Mutex
+	ledger       []ledgerEvent
+	ledgerByCert map[string][]int //certificate ID to positions in ledger
+	checkpoints  []checkpoint
+}
+
+//NewMemoryStore returns an in-memory CertificateStore loaded with the static data
+func NewMemoryStore() CertificateStore {
+	return newSeededStore()
+}
+
+//newSeededStore returns a memory store holding the static data, each
+//certificate's provenance starting with its issue
+func newSeededStore() *memoryStore {
+	s := newMemoryStore(seedCerts(), seedUsers())
+	for _, e := range s.certs {
+		e.history = []ownershipChange{issued(e.cert)}
+	}
+	//the ledger starts with the issue of each, in a fixed order
+	for _, c := range s.ListCerts() {
+		s.appendEvent(s.nextEvent(eventCreated, c.ID, &c, "", c.CreatedAt, nil))
+	}
+	return s
+}
+
+//issued is the first link of a certificate's provenance
+func issued(c certificate) ownershipChange {
+	return ownershipChange{CertID: c.ID, To: c.OwnerID, At: c.CreatedAt}
+}
+
+func newMemoryStore(certs certCollection, users userCollection) *memoryStore {
+	s := &memoryStore{
+		certs:        make(map[string]*certEntry, len(certs)),
+		users:        make(map[string]user, len(users)),
+		usersByEmail: make(map[string]string, len(users)),
+		byOwner:      map[string]map[string]*certEntry{},
+		transfers:    map[string]transfer{},
+		bySender:     map[string][]string{},
+		byRecipient:  map[string][]string{},
+		sessions:     map[string]session{},
+		resets:       map[string]passwordReset{},
+		verifyTokens: map[string]verification{},
+		twoFactors:   map[string]twoFactor{},
+		apiKeys:      map[string]apiKey{},
+		keyByUser:    map[string][]string{},
+		ledgerByCert: map[string][]int{},
+	}
+	for _, c := range certs {
+		s.insert(c)
+	}
+	for _, u := range users {
+		s.users[u.ID] = u
+		s.usersByEmail[u.Email] = u.ID
+	}
+	return s
+}
+
+//insert adds a certificate entry; callers hold mu for writing
+func (s *memoryStore) insert(c certificate) *certEntry {
+	s.inserted++
+	e := &certEntry{cert: c, order: s.inserted}
+	s.certs[c.ID] = e
+	s.indexOwner(e, "", c.OwnerID)
+	return e
+}
+
+//indexOwner moves a certificate between owners in the byOwner index
+func (s *memoryStore) indexOwner(e *certEntry, from string, to string) {
+	s.ownerMu.Lock()
+	defer s.ownerMu.Unlock()
+	if owned, found := s.byOwner[from]; found {
+		delete(owned, e.cert.ID)
+		if len(owned) == 0 {
+			delete(s.byOwner, from)
+		}
+	}
+	if to == "" {
+		return
+	}
+	if s.byOwner[to] == nil {
+		s.byOwner[to] = map[string]*certEntry{}
+	}
+	s.byOwner[to][e.cert.ID] = e
+}
+
+//record passes a change to the journal, if any
+func (s *memoryStore) record(e logEntry) error {
+	if s.journal == nil {
+		return nil
+	}
+	return s.journal(e)
+}
+
+//signed returns c signed by the signer, if any; otherwise c is kept as it is
+func (s *memoryStore) signed(c certificate) certificate {
+	s.signMu.RLock()
+	defer s.signMu.RUnlock()
+	if s.sign == nil {
+		return c
+	}
+	return s.sign(c)
+}
+
+//SetSigner has certificates signed with sign from now on, signing those
+//stored without a signature
+func (s *memoryStore) SetSigner(sign func(c certificate) certificate) error {
+	s.signMu.Lock()
+	s.sign = sign
+	s.signMu.Unlock()
+	return s.ResignCerts("")
+}
+
+func (s *memoryStore) ResignCerts(keyID string) error {
+	s.mu.RLock()
+	entries := make([]*certEntry, 0, len(s.certs))
+	for _, e := range s.certs {
+		entries = append(entries, e)
+	}
+	s.mu.RUnlock()
+	for _, e := range entries {
+		if err := s.signEntry(e, keyID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//signEntry signs a stored certificate again if it was signed with the key
+//keyID, or has no signature if keyID is empty, logging it as an update
+func (s *memoryStore) signEntry(e *certEntry, keyID string) error {
+	s.commitMu.RLock()
+	defer s.commitMu.RUnlock()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.deleted || e.cert.KeyID != keyID {
+		return nil
+	}
+	c := s.signed(e.cert)
+	if err := s.record(logEntry{Op: opUpdateCert, Cert: &c}); err != nil {
+		return err
+	}
+	e.cert = c
+	return nil
+}
+
+//entry returns the entry for a certificate id with its lock held
+func (s *memoryStore) entry(id string) (*certEntry, bool) {
+	s.mu.RLock()
+	e, found := s.certs[id]
+	s.mu.RUnlock()
+	if !found {
+		return nil, false
+	}
+	e.mu.Lock()
+	if e.deleted {
+		e.mu.Unlock()
+		return nil, false
+	}
+	return e, true
+}
+
+//sortedCerts returns the certificates in entries that match keep, in
+//insertion order
+func sortedCerts(entries []*certEntry, keep func(c certificate) bool) certCollection {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].order < entries[j].order })
+	list := make(certCollection, 0, len(entries))
+	for _, e := range entries {
+		e.mu.Lock()
+		if !e.deleted && keep(e.cert) {
+			list = append(list, e.cert)
+		}
+		e.mu.Unlock()
+	}
+	return list
+}
+
+func (s *memoryStore) GetCert(id string) (certificate, bool) {
+	e, found := s.entry(id)
+	if !found {
+		return certificate{}, false
+	}
+	defer e.mu.Unlock()
+	return e.cert, true
+}
+
+func (s *memoryStore) ListCerts() certCollection {
+	s.mu.RLock()
+	entries := make([]*certEntry, 0, len(s.certs))
+	for _, e := range s.certs {
+		entries = append(entries, e)
+	}
+	s.mu.RUnlock()
+	return sortedCerts(entries, func(c certificate) bool { return true })
+}
+
+func (s *memoryStore) ListCertsByOwner(ownerID string) certCollection {
+	s.ownerMu.Lock()
+	entries := make([]*certEntry, 0, len(s.byOwner[ownerID]))
+	for _, e := range s.byOwner[ownerID] {
+		entries = append(entries, e)
+	}
+	s.ownerMu.Unlock()
+	//the owner may have changed between reading the index and locking the entry
+	return sortedCerts(entries, func(c certificate) bool { return c.OwnerID == ownerID })
+}
+
+func (s *memoryStore) CreateCert(c certificate) error {
+	return s.createCert(c, nil)
+}
+
+//createCert is CreateCert, given the logged entry when replaying the log
+func (s *memoryStore) createCert(c certificate, replay *logEntry) error {
+	s.commitMu.RLock()
+	defer s.commitMu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, found := s.certs[c.ID]; found {
+		return errCertExists
+	}
+	c.Revoked = nil
+	c = s.signed(c)
+	s.ledgerMu.Lock()
+	defer s.ledgerMu.Unlock()
+	ev := s.nextEvent(eventCreated, c.ID, &c, "", time.Now(), replay)
+	if err := s.record(logEntry{Op: opCreateCert, Cert: &c, Event: ev}); err != nil {
+		return err
+	}
+	s.appendEvent(ev)
+	e := s.insert(c)
+	e.history = []ownershipChange{issued(c)}
+	return nil
+}
+
+func (s *memoryStore) UpdateCert(c certificate) error {
+	return s.updateCert(c, nil)
+}
+
+//updateCert is UpdateCert, given the logged entry when replaying the log
+func (s *memoryStore) updateCert(c certificate, replay *logEntry) error {
+	s.commitMu.RLock()
+	defer s.commitMu.RUnlock()
+	e, found := s.entry(c.ID)
+	if !found {
+		return errCertNotFound
+	}
+	defer e.mu.Unlock()
+
+	if e.cert.OwnerID != c.OwnerID {
+		return errOwnerChange
+	}
+	//signing a revoked certificate again is logged as an update, so is replayed
+	if e.cert.Revoked != nil && replay == nil {
+		return errCertRevoked
+	}
+	c.Revoked = e.cert.Revoked
+	c = s.signed(c)
+	s.ledgerMu.Lock()
+	defer s.ledgerMu.Unlock()
+	ev := s.nextEvent(eventUpdated, c.ID, &c, "", time.Now(), replay)
+	if err := s.record(logEntry{Op: opUpdateCert, Cert: &c, Event: ev}); err != nil {
+		return err
+	}
+	s.appendEvent(ev)
+	e.cert = c
+	return nil
+}
+
+func (s *memoryStore) DeleteCert(id string, ownerID string) error {
+	return s.deleteCert(id, ownerID, nil)
+}
+
+//deleteCert is DeleteCert, given the logged entry when replaying the log
+func (s *memoryStore) deleteCert(id string, ownerID string, replay *logEntry) error {
+	s.commitMu.RLock()
+	defer s.commitMu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, found := s.certs[id]
+	if !found {
+		return errCertNotFound
+	}
+	//wait out anyone in the middle of changing this certificate
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if ownerID != "" && e.cert.OwnerID != ownerID {
+		return errNotOwner
+	}
+	if e.cert.Revoked != nil {
+		return errCertRevoked
+	}
+	s.ledgerMu.Lock()
+	defer s.ledgerMu.Unlock()
+	ev := s.nextEvent(eventDeleted, id, nil, "", time.Now(), replay)
+	if err := s.record(logEntry{Op: opDeleteCert, CertID: id, OwnerID: ownerID, Event: ev}); err != nil {
+		return err
+	}
+	s.appendEvent(ev)
+	e.deleted = true
+	delete(s.certs, id)
+	s.indexOwner(e, e.cert.OwnerID, "")
+	return nil
+}
+
+func (s *memoryStore) RevokeCert(id string, r revocation) error {
+	return s.revokeCert(id, r, nil)
+}
+
+//revokeCert is RevokeCert, given the logged entry when replaying the log.
+//What was signed does not change, so the certificate keeps its signature
+func (s *memoryStore) revokeCert(id string, r revocation, replay *logEntry) error {
+	s.commitMu.RLock()
+	defer s.commitMu.RUnlock()
+	e, found := s.entry(id)
+	if !found {
+		return errCertNotFound
+	}
+	defer e.mu.Unlock()
+
+	if e.cert.Revoked != nil {
+		return errCertRevoked
+	}
+	c := e.cert
+	c.Revoked = &r
+	s.ledgerMu.Lock()
+	defer s.ledgerMu.Unlock()
+	ev := s.nextEvent(eventRevoked, id, &c, "", r.RevokedAt, replay)
+	if err := s.record(logEntry{Op: opRevokeCert, CertID: id, Revocation: &r, Event: ev}); err != nil {
+		return err
+	}
+	s.appendEvent(ev)
+	e.cert = c
+	return nil
+}
+
+func (s *memoryStore) GetProvenance(certID string) ([]ownershipChange, bool) {
+	e, found := s.entry(certID)
+	if !found {
+		return nil, false
+	}
+	defer e.mu.Unlock()
+	history := make([]ownershipChange, len(e.history))
+	copy(history, e.history)
+	return history, true
+}
+
+//restoreProvenance loads saved ownership changes, oldest first
+func (s *memoryStore) restoreProvenance(history []ownershipChange) {
+	for _, change := range history {
+		if e, found := s.certs[change.CertID]; found {
+			e.history = append(e.history, change)
+		}
+	}
+}
+
+func (s *memoryStore) GetUser(id string) (user, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, found := s.users[id]
+	return u, found
+}
+
+func (s *memoryStore) GetUserByEmail(email string) (user, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, found := s.users[s.usersByEmail[email]]
+	return u, found
+}
+
+func (s *memoryStore) SetPassword(id string, current string, hash string) error {
+	s.commitMu.RLock()
+	defer s.commitMu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, found := s.users[id]
+	if !found {
+		return errUserNotFound
+	}
+	if u.password != current {
+		return errPasswordChanged
+	}
+	if err := s.record(logEntry{Op: opSetPassword, UserID: id, Password: hash}); err != nil {
+		return err
+	}
+	u.password = hash
+	s.users[id] = u
+	return nil
+}
+
+func (s *memoryStore) SetRoles(id string, roles []string) error {
+	s.commitMu.RLock()
+	defer s.commitMu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, found := s.users[id]
+	if !found {
+		return errUserNotFound
+	}
+	if err := s.record(logEntry{Op: opSetRoles, UserID: id, Roles: roles}); err != nil {
+		return err
+	}
+	//the caller keeps its slice, which must not change what is stored
+	u.Roles = append([]string(nil), roles...)
+	s.users[id] = u
+	return nil
+}
+
+func (s *memoryStore) CreateUser(u user) error {
+	s.commitMu.RLock()
+	defer s.commitMu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, found := s.users[u.ID]; found {
+		return errUserExists
+	}
+	if _, taken := s.usersByEmail[u.Email]; taken {
+		return errEmailTaken
+	}
+	record := newUserRecord(u)
+	if err := s.record(logEntry{Op: opRegisterUser, User: &record}); err != nil {
+		return err
+	}
+	u.Roles = append([]string(nil), u.Roles...)
+	s.users[u.ID] = u
+	s.usersByEmail[u.Email] = u.ID
+	return nil
+}
+
+func (s *memoryStore) UpdateProfile(id string, email string, name string) error {
+	s.commitMu.RLock()
+	defer s.commitMu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, found := s.users[id]
+	if !found {
+		return errUserNotFound
+	}
+	if !u.active() {
+		return errUserDeactivated
+	}
+	if owner, taken := s.usersByEmail[email]; taken && owner != id {
+		return errEmailTaken
+	}
+	if err := s.record(logEntry{Op: opUpdateProfile, UserID: id, Email: email, Name: name}); err != nil {
+		return err
+	}
+	delete(s.usersByEmail, u.Email)
+	s.usersByEmail[email] = id
+	if email != u.Email {
+		u.EmailVerifiedAt = time.Time{}
+	}
+	u.Email = email
+	u.Name = name
+	s.users[id] = u
+	return nil
+}
+
+func (s *memoryStore) DeactivateUser(id string, at time.Time) error {
+	s.commitMu.RLock()
+	defer s.commitMu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, found := s.users[id]
+	if !found {
+		return errUserNotFound
+	}
+	if !u.active() {
+		return errUserDeactivated
+	}
+	if err := s.record(logEntry{Op: opDeactivateUser, UserID: id, At: at}); err != nil {
+		return err
+	}
+	u.DeactivatedAt = at
+	s.users[id] = u
+	return nil
+}
+
+func (s *memoryStore) ListUsers() userCollection {
+	s.mu.RLock()
+	all := make(userCollection, 0, len(s.users))
+	for _, u := range s.users {
+		all = append(all, u)
+	}
+	s.mu.RUnlock()
+	sort.Slice(all, func(i, j int) bool { return all[i].ID < all[j].ID })
+	return all
+}
+
+func (s *memoryStore) CreateReset(p passwordReset) error {
+	s.commitMu.RLock()
+	defer s.commitMu.RUnlock()
+	s.resetMu.Lock()
+	defer s.resetMu.Unlock()
+
+	if err := s.record(logEntry{Op: opCreateReset, Reset: &p}); err != nil {
+		return err
+	}
+	s.resets[p.ID] = p
+	return nil
+}
+
+func (s *memoryStore) GetReset(id string) (passwordReset, bool) {
+	s.resetMu.Lock()
+	defer s.resetMu.Unlock()
+	p, found := s.resets[id]
+	return p, found
+}
+
+func (s *memoryStore) ResetPassword(id string, hash string, password string, at time.Time) error {
+	s.commitMu.RLock()
+	defer s.commitMu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.resetMu.Lock()
+	defer s.resetMu.Unlock()
+
+	p, found := s.resets[id]
+	if !found || !sameHash(p.Hash, hash) || !p.usable(at) {
+		return errResetInvalid
+	}
+	u, found := s.users[p.UserID]
+	if !found {
+		return errUserNotFound
+	}
+	if !u.active() {
+		return errUserDeactivated
+	}
+	if err := s.record(logEntry{Op: opResetPassword, ResetID: id, Password: password, At: at}); err != nil {
+		return err
+	}
+	p.UsedAt = at
+	s.resets[id] = p
+	u.password = password
+	s.users[u.ID] = u
+
+	//whoever knew the old password is logged out
+	s.sessionMu.Lock()
+	defer s.sessionMu.Unlock()
+	for _, sess := range s.sessions {
+		if sess.UserID == u.ID && sess.RevokedAt.IsZero() {
+			sess.RevokedAt = at
+			s.sessions[sess.ID] = sess
+		}
+	}
+	return nil
+}
+
+//pendingResets returns the reset tokens still usable at the time given
+func (s *memoryStore) pendingResets(at time.Time) []passwordReset {
+	s.resetMu.Lock()
+	defer s.resetMu.Unlock()
+	pending := []passwordReset{}
+	for _, p := range s.resets {
+		if p.usable(at) {
+			pending = append(pending, p)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].CreatedAt.Before(pending[j].CreatedAt) })
+	return pending
+}
+
+func (s *memoryStore) CreateVerification(v verification) error {
+	s.commitMu.RLock()
+	defer s.commitMu.RUnlock()
+	s.verifyMu.Lock()
+	defer s.verifyMu.Unlock()
+
+	if err := s.record(logEntry{Op: opVerifyRequest, Verify: &v}); err != nil {
+		return err
+	}
+	s.verifyTokens[v.ID] = v
+	return nil
+}
+
+func (s *memoryStore) GetVerification(id string) (verification, bool) {
+	s.verifyMu.Lock()
+	defer s.verifyMu.Unlock()
+	v, found := s.verifyTokens[id]
+	return v, found
+}
+
+func (s *memoryStore) VerifyEmail(id string, hash string, at time.Time) error {
+	s.commitMu.RLock()
+	defer s.commitMu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.verifyMu.Lock()
+	defer s.verifyMu.Unlock()
+
+	v, found := s.verifyTokens[id]
+	if !found || !sameHash(v.Hash, hash) || !v.usable(at) {
+		return errVerifyInvalid
+	}
+	u, found := s.users[v.UserID]
+	if !found || u.Email != v.Email || !u.active() {
+		return errVerifyInvalid
+	}
+	if u.emailVerified() {
+		return errEmailVerified
+	}
+	if err := s.record(logEntry{Op: opVerifyEmail, VerifyID: id, At: at}); err != nil {
+		return err
+	}
+	v.UsedAt = at
+	s.verifyTokens[id] = v
+	u.EmailVerifiedAt = at
+	s.users[u.ID] = u
+	return nil
+}
+
+//pendingVerifications returns the verification tokens still usable at the time given
+func (s *memoryStore) pendingVerifications(at time.Time) []verification {
+	s.verifyMu.Lock()
+	defer s.verifyMu.Unlock()
+	pending := []verification{}
+	for _, v := range s.verifyTokens {
+		if v.usable(at) {
+			pending = append(pending, v)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].CreatedAt.Before(pending[j].CreatedAt) })
+	return pending
+}
+
+func (s *memoryStore) GetTwoFactor(userID string) (twoFactor, bool) {
+	s.twoFactorMu.Lock()
+	defer s.twoFactorMu.Unlock()
+	tf, found := s.twoFactors[userID]
+	return tf, found
+}
+
+//allTwoFactors returns every stored authenticator, ordered by user ID
+func (s *memoryStore) allTwoFactors() []twoFactor {
+	s.twoFactorMu.Lock()
+	defer s.twoFactorMu.Unlock()
+	all := []twoFactor{}
+	for _, tf := range s.twoFactors {
+		all = append(all, tf)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].UserID < all[j].UserID })
+	return all
+}
+
+func (s *memoryStore) SetTwoFactor(tf twoFactor) error {
+	s.commitMu.RLock()
+	defer s.commitMu.RUnlock()
+	s.twoFactorMu.Lock()
+	defer s.twoFactorMu.Unlock()
+
+	if err := s.record(logEntry{Op: opEnable2FA, TwoFactor: &tf}); err != nil {
+		return err
+	}
+	tf.Recovery = append([]string(nil), tf.Recovery...)
+	s.twoFactors[tf.UserID] = tf
+	return nil
+}
+
+func (s *memoryStore) RemoveTwoFactor(userID string) error {
+	s.commitMu.RLock()
+	defer s.commitMu.RUnlock()
+	s.twoFactorMu.Lock()
+	defer s.twoFactorMu.Unlock()
+
+	if _, found := s.twoFactors[userID]; !found {
+		return errTwoFactorOff
+	}
+	if err := s.record(logEntry{Op: opDisable2FA, UserID: userID}); err != nil {
+		return err
+	}
+	delete(s.twoFactors, userID)
+	return nil
+}
+
+func (s *memoryStore) UseTwoFactor(userID string, step uint64, recoveryHash string) error {
+	s.commitMu.RLock()
+	defer s.commitMu.RUnlock()
+	s.twoFactorMu.Lock()
+	defer s.twoFactorMu.Unlock()
+
+	tf, found := s.twoFactors[userID]
+	if !found || !tf.enabled() {
+		return errTwoFactorOff
+	}
+	used := -1
+	for i, hash := range tf.Recovery {
+		if recoveryHash != "" && sameHash(hash, recoveryHash) {
+			used = i
+		}
+	}
+	if (recoveryHash == "" && step <= tf.LastStep) || (recoveryHash != "" && used < 0) {
+		return errCodeUsed
+	}
+	if err := s.record(logEntry{Op: opUse2FA, UserID: userID, Step: step, Recovery: recoveryHash}); err != nil {
+		return err
+	}
+	if recoveryHash != "" {
+		tf.Recovery = append(append([]string(nil), tf.Recovery[:used]...), tf.Recovery[used+1:]...)
+	} else {
+		tf.LastStep = step
+	}
+	s.twoFactors[userID] = tf
+	return nil
+}
+
+func (s *memoryStore) CreateSession(sess session) error {
+	s.commitMu.RLock()
+	defer s.commitMu.RUnlock()
+	s.sessionMu.Lock()
+	defer s.sessionMu.Unlock()
+
+	if err := s.record(logEntry{Op: opCreateSession, Session: &sess}); err != nil {
+		return err
+	}
+	s.sessions[sess.ID] = sess
+	return nil
+}
+
+func (s *memoryStore) GetSession(id string) (session, bool) {
+	s.sessionMu.Lock()
+	defer s.sessionMu.Unlock()
+	sess, found := s.sessions[id]
+	return sess, found
+}
+
+func (s *memoryStore) RefreshSession(id string, current string, hash string, expiresAt time.Time) error {
+	s.commitMu.RLock()
+	defer s.commitMu.RUnlock()
+	s.sessionMu.Lock()
+	defer s.sessionMu.Unlock()
+
+	sess, found := s.sessions[id]
+	if !found {
+		return errSessionNotFound
+	}
+	if !sess.RevokedAt.IsZero() {
+		return errSessionRevoked
+	}
+	if !sameHash(sess.RefreshHash, current) {
+		return errRefreshReused
+	}
+	sess.RefreshHash = hash
+	sess.ExpiresAt = expiresAt
+	if err := s.record(logEntry{Op: opRefreshSession, Session: &sess}); err != nil {
+		return err
+	}
+	s.sessions[id] = sess
+	return nil
+}
+
+func (s *memoryStore) RevokeSession(id string, at time.Time) error {
+	s.commitMu.RLock()
+	defer s.commitMu.RUnlock()
+	s.sessionMu.Lock()
+	defer s.sessionMu.Unlock()
+
+	sess, found := s.sessions[id]
+	if !found {
+		return errSessionNotFound
+	}
+	if !sess.RevokedAt.IsZero() {
+		return errSessionRevoked
+	}
+	if err := s.record(logEntry{Op: opRevokeSession, SessionID: id, At: at}); err != nil {
+		return err
+	}
+	sess.RevokedAt = at
+	s.sessions[id] = sess
+	return nil
+}
+
+//liveSessions returns the sessions still usable at the time given
+func (s *memoryStore) liveSessions(at time.Time) []session {
+	s.sessionMu.Lock()
+	defer s.sessionMu.Unlock()
+	list := []session{}
+	for _, sess := range s.sessions {
+		if sess.active(at) {
+			list = append(list, sess)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+//putAPIKey stores a key, indexing it by user the first time; callers hold keyMu
+func (s *memoryStore) putAPIKey(k apiKey) {
+	if _, found := s.apiKeys[k.ID]; !found {
+		s.keyByUser[k.UserID] = append(s.keyByUser[k.UserID], k.ID)
+	}
+	s.apiKeys[k.ID] = k
+}
+
+func (s *memoryStore) CreateAPIKey(k apiKey) error {
+	s.commitMu.RLock()
+	defer s.commitMu.RUnlock()
+	s.keyMu.Lock()
+	defer s.keyMu.Unlock()
+
+	if err := s.record(logEntry{Op: opCreateAPIKey, APIKey: &apiKeyRecord{k, k.hash}}); err != nil {
+		return err
+	}
+	s.putAPIKey(k)
+	return nil
+}
+
+func (s *memoryStore) GetAPIKey(id string) (apiKey, bool) {
+	s.keyMu.Lock()
+	defer s.keyMu.Unlock()
+	k, found := s.apiKeys[id]
+	return k, found
+}
+
+func (s *memoryStore) ListAPIKeys(userID string) []apiKey {
+	s.keyMu.Lock()
+	defer s.keyMu.Unlock()
+	list := make([]apiKey, 0, len(s.keyByUser[userID]))
+	for _, id := range s.keyByUser[userID] {
+		list = append(list, s.apiKeys[id])
+	}
+	return list
+}
+
+func (s *memoryStore) RevokeAPIKey(id string, at time.Time) error {
+	s.commitMu.RLock()
+	defer s.commitMu.RUnlock()
+	s.keyMu.Lock()
+	defer s.keyMu.Unlock()
+
+	k, found := s.apiKeys[id]
+	if !found {
+		return errKeyNotFound
+	}
+	if !k.RevokedAt.IsZero() {
+		return errKeyRevoked
+	}
+	if err := s.record(logEntry{Op: opRevokeAPIKey, KeyID: id, At: at}); err != nil {
+		return err
+	}
+	k.RevokedAt = at
+	s.apiKeys[id] = k
+	return nil
+}
+
+func (s *memoryStore) TouchAPIKey(id string, at time.Time) error {
+	s.commitMu.RLock()
+	defer s.commitMu.RUnlock()
+	s.keyMu.Lock()
+	defer s.keyMu.Unlock()
+
+	k, found := s.apiKeys[id]
+	if !found {
+		return errKeyNotFound
+	}
+	if !at.After(k.LastUsedAt) {
+		return nil
+	}
+	if err := s.record(logEntry{Op: opTouchAPIKey, KeyID: id, At: at}); err != nil {
+		return err
+	}
+	k.LastUsedAt = at
+	s.apiKeys[id] = k
+	return nil
+}
+
+//allAPIKeys returns every key, grouped by user in the order they were made
+func (s *memoryStore) allAPIKeys() []apiKey {
+	s.keyMu.Lock()
+	users := make([]string, 0, len(s.keyByUser))
+	for id := range s.keyByUser {
+		users = append(users, id)
+	}
+	s.keyMu.Unlock()
+	sort.Strings(users)
+	list := []apiKey{}
+	for _, id := range users {
+		list = append(list, s.ListAPIKeys(id)...)
+	}
+	return list
+}
+
+//putTransfer stores a transfer record, replacing any with the same ID
+func (s *memoryStore) putTransfer(t transfer) {
+	s.transferMu.Lock()
+	defer s.transferMu.Unlock()
+	//sender and recipient never change, so a transfer is indexed once
+	if _, found := s.transfers[t.ID]; !found {
+		s.bySender[t.From] = append(s.bySender[t.From], t.ID)
+		s.byRecipient[t.To] = append(s.byRecipient[t.To], t.ID)
+	}
+	s.transfers[t.ID] = t
+}
+
+//restoreTransfers loads saved transfer records, oldest first, pointing each
+//certificate at its most recent one
+func (s *memoryStore) restoreTransfers(transfers transferCollection) {
+	for _, t := range transfers {
+		s.putTransfer(t)
+		if e, found := s.certs[t.CertID]; found {
+			e.latest = t.ID
+		}
+	}
+}
+
+func (s *memoryStore) ListTransfers(f transferFilter) transferCollection {
+	s.transferMu.Lock()
+	all := transferCollection{}
+	//narrow the search down with an index when the filter allows it
+	var ids []string
+	switch {
+	case f.From != "":
+		ids = s.bySender[f.From]
+	case f.To != "":
+		ids = s.byRecipient[f.To]
+	default:
+		for _, t := range s.transfers {
+			if f.matches(t) {
+				all = append(all, t)
+			}
+		}
+	}
+	for _, id := range ids {
+		if t := s.transfers[id]; f.matches(t) {
+			all = append(all, t)
+		}
+	}
+	s.transferMu.Unlock()
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].CreatedAt.Equal(all[j].CreatedAt) {
+			return all[i].ID < all[j].ID
+		}
+		return all[i].CreatedAt.Before(all[j].CreatedAt)
+	})
+	return all
+}
+
+func (s *memoryStore) CreateTransfer(t transfer) error {
+	s.commitMu.RLock()
+	defer s.commitMu.RUnlock()
+	e, found := s.entry(t.CertID)
+	if !found {
+		return errCertNotFound
+	}
+	defer e.mu.Unlock()
+
+	if e.cert.OwnerID != t.From {
+		return errNotOwner
+	}
+	if e.cert.Revoked != nil {
+		return errCertRevoked
+	}
+	current, found := s.GetTransfer(e.latest)
+	pending := found && current.Status == transferPending
+	if pending && !current.overdue(t.CreatedAt) {
+		return errTransferPending
+	}
+	if err := s.record(logEntry{Op: opCreateTransfer, Transfer: &t}); err != nil {
+		return err
+	}
+	if pending {
+		current.Status = transferExpired
+		current.UpdatedAt = t.CreatedAt
+		s.putTransfer(current)
+	}
+	s.putTransfer(t)
+	e.latest = t.ID
+	return nil
+}
+
+func (s *memoryStore) GetTransfer(id string) (transfer, bool) {
+	s.transferMu.Lock()
+	defer s.transferMu.Unlock()
+	t, found := s.transfers[id]
+	return t, found
+}
+
+func (s *memoryStore) GetCurrentTransfer(certID string) (transfer, bool) {
+	e, found := s.entry(certID)
+	if !found {
+		return transfer{}, false
+	}
+	latest := e.latest
+	e.mu.Unlock()
+	return s.GetTransfer(latest)
+}
+
+//lockTransfer returns a transfer along with its certificate entry, locked.
+//Transfers only change under that lock so the record returned is current
+func (s *memoryStore) lockTransfer(id string) (transfer, *certEntry, error) {
+	t, found := s.GetTransfer(id)
+	if !found {
+		return transfer{}, nil, errTransferNotFound
+	}
+	e, found := s.entry(t.CertID)
+	if !found {
+		return transfer{}, nil, errCertNotFound
+	}
+	t, _ = s.GetTransfer(id)
+	return t, e, nil
+}
+
+func (s *memoryStore) AcceptTransfer(id string, email string, newOwnerID string, at time.Time) error {
+	return s.acceptTransfer(id, email, newOwnerID, at, nil)
+}
+
+//acceptTransfer is AcceptTransfer, given the logged entry when replaying the
+//log. The certificate is then left as signed rather than signed again
+func (s *memoryStore) acceptTransfer(id string, email string, newOwnerID string, at time.Time, replay *logEntry) error {
+	s.commitMu.RLock()
+	defer s.commitMu.RUnlock()
+	t, e, err := s.lockTransfer(id)
+	if err != nil {
+		return err
+	}
+	defer e.mu.Unlock()
+
+	if t.To != email {
+		return errNotRecipient
+	}
+	if !canTransition(t.Status, transferAccepted) {
+		return errTransferClosed
+	}
+	if t.overdue(at) {
+		return errTransferExpired
+	}
+	if e.cert.Revoked != nil {
+		return errCertRevoked
+	}
+	c := e.cert
+	c.OwnerID = newOwnerID
+	//the old signature is for the old owner; without a signer it is left unsigned
+	c.KeyID, c.Signature = "", ""
+	if replay != nil && replay.Cert != nil {
+		c = *replay.Cert
+	} else {
+		c = s.signed(c)
+	}
+	s.ledgerMu.Lock()
+	defer s.ledgerMu.Unlock()
+	ev := s.nextEvent(eventTransferred, c.ID, &c, id, at, replay)
+	if err := s.record(logEntry{Op: opAcceptTransfer, TransferID: id, Email: email, OwnerID: newOwnerID, Cert: &c, Event: ev, At: at}); err != nil {
+		return err
+	}
+	s.appendEvent(ev)
+	t.Status = transferAccepted
+	t.UpdatedAt = at
+	s.putTransfer(t)
+	e.history = append(e.history, ownershipChange{
+		CertID:     t.CertID,
+		From:       e.cert.OwnerID,
+		To:         newOwnerID,
+		At:         at,
+		TransferID: id,
+	})
+	s.indexOwner(e, e.cert.OwnerID, newOwnerID)
+	e.cert = c
+	return nil
+}
+
+func (s *memoryStore) CloseTransfer(id string, status string, at time.Time) error {
+	s.commitMu.RLock()
+	defer s.commitMu.RUnlock()
+	t, e, err := s.lockTransfer(id)
+	if err != nil {
+		return err
+	}
+	defer e.mu.Unlock()
+
+	//accepting also changes the owner, which only AcceptTransfer does
+	if status == transferAccepted || !canTransition(t.Status, status) {
+		return errTransferClosed
+	}
+	if err := s.record(logEntry{Op: opCloseTransfer, TransferID: id, Status: status, At: at}); err != nil {
+		return err
+	}
+	t.Status = status
+	t.UpdatedAt = at
+	s.putTransfer(t)
+	return nil
+}
+
+//nextEvent makes the ledger event of a change to a certificate, c being the
+//certificate after it. When replaying the log the logged event is used
+//instead, if there is one. Callers hold ledgerMu
+func (s *memoryStore) nextEvent(kind string, certID string, c *certificate, transferID string, at time.Time, replay *logEntry) *ledgerEvent {
+	if replay != nil {
+		return replay.Event
+	}
+	ev := ledgerEvent{
+		Seq:        uint64(len(s.ledger) + 1),
+		Kind:       kind,
+		CertID:     certID,
+		TransferID: transferID,
+		At:         at.UTC(),
+	}
+	if c != nil {
+		ev.Cert = eventCert(*c)
+	}
+	if len(s.ledger) > 0 {
+		ev.PrevHash = s.ledger[len(s.ledger)-1].Hash
+	}
+	if positions := s.ledgerByCert[certID]; len(positions) > 0 {
+		ev.PrevCertHash = s.ledger[positions[len(positions)-1]].Hash
+	}
+	ev.Hash = hashEvent(ev)
+	return &ev
+}
+
+//appendEvent adds an event, if any, to the end of the ledger. Callers hold ledgerMu
+func (s *memoryStore) appendEvent(ev *ledgerEvent) {
+	if ev == nil {
+		return
+	}
+	s.ledgerByCert[ev.CertID] = append(s.ledgerByCert[ev.CertID], len(s.ledger))
+	s.ledger = append(s.ledger, *ev)
+}
+
+func (s *memoryStore) GetLedger() ([]ledgerEvent, certCollection) {
+	//no change may be half applied between reading the two
+	s.commitMu.Lock()
+	defer s.commitMu.Unlock()
+	return s.ledgerEvents(), s.ListCerts()
+}
+
+func (s *memoryStore) GetEvents() []ledgerEvent {
+	return s.ledgerEvents()
+}
+
+//ledgerEvents returns a copy of the ledger
+func (s *memoryStore) ledgerEvents() []ledgerEvent {
+	s.ledgerMu.Lock()
+	defer s.ledgerMu.Unlock()
+	events := make([]ledgerEvent, len(s.ledger))
+	copy(events, s.ledger)
+	return events
+}
+
+func (s *memoryStore) AddCheckpoint(cp checkpoint) error {
+	s.commitMu.RLock()
+	defer s.commitMu.RUnlock()
+	s.ledgerMu.Lock()
+	defer s.ledgerMu.Unlock()
+
+	if cp.TreeSize > uint64(len(s.ledger)) {
+		return errCheckpointStale
+	}
+	if n := len(s.checkpoints); n > 0 && cp.TreeSize <= s.checkpoints[n-1].TreeSize {
+		return errCheckpointStale
+	}
+	if err := s.record(logEntry{Op: opCheckpoint, Checkpoint: &cp}); err != nil {
+		return err
+	}
+	s.checkpoints = append(s.checkpoints, cp)
+	return nil
+}
+
+func (s *memoryStore) ListCheckpoints() []checkpoint {
+	s.ledgerMu.Lock()
+	defer s.ledgerMu.Unlock()
+	checkpoints := make([]checkpoint, len(s.checkpoints))
+	copy(checkpoints, s.checkpoints)
+	return checkpoints
+}
+
+func (s *memoryStore) ListRevocations() []ledgerEvent {
+	s.ledgerMu.Lock()
+	defer s.ledgerMu.Unlock()
+	events := []ledgerEvent{}
+	for _, ev := range s.ledger {
+		if ev.Kind == eventRevoked {
+			events = append(events, ev)
+		}
+	}
+	return events
+}
+
+func (s *memoryStore) GetCertEvents(certID string) []ledgerEvent {
+	s.ledgerMu.Lock()
+	defer s.ledgerMu.Unlock()
+	events := make([]ledgerEvent, 0, len(s.ledgerByCert[certID]))
+	for _, i := range s.ledgerByCert[certID] {
+		events = append(events, s.ledger[i])
+	}
+	return events
+}
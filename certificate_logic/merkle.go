@@ -0,0 +1,101 @@
+package certificates
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+//The ledger forms a Merkle tree as in RFC 6962, the leaves being its events
+//in order. A leaf is hashed with a 0x00 prefix and a node with 0x01, so one
+//can never be passed off as the other
+
+//leafHash is the hash of an event as a leaf of the tree. The event's own hash
+//already covers the whole event
+func leafHash(ev ledgerEvent) []byte {
+	data, _ := hex.DecodeString(ev.Hash)
+	sum := sha256.Sum256(append([]byte{0}, data...))
+	return sum[:]
+}
+
+//nodeHash is the hash of an inner node of the tree
+func nodeHash(left []byte, right []byte) []byte {
+	data := append(append([]byte{1}, left...), right...)
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+//eventLeaves hashes each event as a leaf
+func eventLeaves(events []ledgerEvent) [][]byte {
+	leaves := make([][]byte, len(events))
+	for i, ev := range events {
+		leaves[i] = leafHash(ev)
+	}
+	return leaves
+}
+
+//splitPoint is the largest power of two smaller than n, n > 1
+func splitPoint(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+//merkleRoot is the Merkle tree hash of the leaves
+func merkleRoot(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	case 1:
+		return leaves[0]
+	}
+	k := splitPoint(len(leaves))
+	return nodeHash(merkleRoot(leaves[:k]), merkleRoot(leaves[k:]))
+}
+
+//inclusionProof is the audit path of leaf m in the tree of the leaves: the
+//hashes needed along with the leaf to rebuild the root, from the bottom up
+func inclusionProof(m int, leaves [][]byte) [][]byte {
+	if len(leaves) <= 1 {
+		return [][]byte{}
+	}
+	k := splitPoint(len(leaves))
+	if m < k {
+		return append(inclusionProof(m, leaves[:k]), merkleRoot(leaves[k:]))
+	}
+	return append(inclusionProof(m-k, leaves[k:]), merkleRoot(leaves[:k]))
+}
+
+//consistencyProof shows the tree of the first m leaves is a prefix of the
+//tree of all of them, 0 < m <= len(leaves)
+func consistencyProof(m int, leaves [][]byte) [][]byte {
+	return subProof(m, leaves, true)
+}
+
+//subProof is SUBPROOF of RFC 6962; whole is set while the first m leaves
+//are a whole subtree the verifier already has the hash of
+func subProof(m int, leaves [][]byte, whole bool) [][]byte {
+	n := len(leaves)
+	if m == n {
+		if whole {
+			return [][]byte{}
+		}
+		return [][]byte{merkleRoot(leaves)}
+	}
+	k := splitPoint(n)
+	if m <= k {
+		return append(subProof(m, leaves[:k], whole), merkleRoot(leaves[k:]))
+	}
+	return append(subProof(m-k, leaves[k:], false), merkleRoot(leaves[:k]))
+}
+
+//hexHashes encodes hashes for a response
+func hexHashes(hashes [][]byte) []string {
+	encoded := make([]string, len(hashes))
+	for i, h := range hashes {
+		encoded[i] = hex.EncodeToString(h)
+	}
+	return encoded
+}
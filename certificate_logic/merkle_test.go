@@ -0,0 +1,123 @@
+package certificates
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"testing"
+)
+
+//testLeaves makes n distinct leaf hashes
+func testLeaves(n int) [][]byte {
+	leaves := make([][]byte, n)
+	for i := range leaves {
+		sum := sha256.Sum256([]byte(fmt.Sprint(i)))
+		leaves[i] = sum[:]
+	}
+	return leaves
+}
+
+//checkInclusion verifies an audit path as a client would, following RFC 9162
+func checkInclusion(leaf []byte, index int, size int, proof [][]byte, root []byte) bool {
+	fn, sn, r := index, size-1, leaf
+	for _, p := range proof {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			r = nodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = nodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(r, root)
+}
+
+//checkConsistency verifies a consistency proof as a client would, following RFC 9162
+func checkConsistency(m int, n int, first []byte, second []byte, proof [][]byte) bool {
+	if m == n {
+		return len(proof) == 0 && bytes.Equal(first, second)
+	}
+	if m&(m-1) == 0 {
+		proof = append([][]byte{first}, proof...)
+	}
+	if len(proof) == 0 {
+		return false
+	}
+	fn, sn := m-1, n-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+	fr, sr := proof[0], proof[0]
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = nodeHash(c, fr)
+			sr = nodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = nodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(fr, first) && bytes.Equal(sr, second)
+}
+
+//TestInclusionProof tests the audit path of every leaf of trees of up to 20
+//leaves verifies, and fails against another leaf
+func TestInclusionProof(t *testing.T) {
+	for n := 1; n <= 20; n++ {
+		leaves := testLeaves(n)
+		root := merkleRoot(leaves)
+		for m := 0; m < n; m++ {
+			proof := inclusionProof(m, leaves)
+			if !checkInclusion(leaves[m], m, n, proof, root) {
+				t.Errorf("Expected proof of leaf %d in tree of %d to verify", m, n)
+			}
+			if n > 1 && checkInclusion(leaves[(m+1)%n], m, n, proof, root) {
+				t.Errorf("Expected proof of leaf %d in tree of %d to fail for another leaf", m, n)
+			}
+		}
+	}
+}
+
+//TestConsistencyProof tests every tree of up to 20 leaves is proved to extend
+//each smaller one, and not one with a leaf changed
+func TestConsistencyProof(t *testing.T) {
+	for n := 1; n <= 20; n++ {
+		leaves := testLeaves(n)
+		root := merkleRoot(leaves)
+		for m := 1; m <= n; m++ {
+			proof := consistencyProof(m, leaves)
+			if !checkConsistency(m, n, merkleRoot(leaves[:m]), root, proof) {
+				t.Errorf("Expected tree of %d to be consistent with tree of %d", m, n)
+			}
+			altered := testLeaves(m)
+			altered[0] = leaves[n-1]
+			if n > 1 && checkConsistency(m, n, merkleRoot(altered), root, proof) {
+				t.Errorf("Expected altered tree of %d to be inconsistent with tree of %d", m, n)
+			}
+		}
+	}
+}
+
+//TestMerkleRoot tests the root of a small tree is built as RFC 6962 describes
+func TestMerkleRoot(t *testing.T) {
+	l := testLeaves(3)
+	if root := merkleRoot(l); !bytes.Equal(root, nodeHash(nodeHash(l[0], l[1]), l[2])) {
+		t.Errorf("Expected root of 3 leaves to pair the first two. Got %x", root)
+	}
+}
@@ -0,0 +1,98 @@
+package certificates
+
+import (
+	"context"
+	"log"
+	"net/http"
+)
+
+//authLevel is what a route asks of the caller before its handler runs
+type authLevel int
+
+const (
+	//public routes run for anyone; credentials sent are not checked
+	public authLevel = iota
+	//authenticated routes need basic auth or a bearer token of some user
+	authenticated
+)
+
+//contextKey keys the values the middleware adds to a request's context
+type contextKey int
+
+const (
+	userKey contextKey = iota
+	sessionKey
+)
+
+//requireAuth wraps a handler so it only runs for an authenticated caller
+//holding perm, who is put into the request context for the handler to find
+//with currentUser. Anyone else gets a 401, or a 403 when authenticated but
+//missing the permission, or a 429 while locked out after failed passwords,
+//and the handler never runs
+func (a *api) requireAuth(perm permission, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, sess, err := a.authRequest(r)
+		if locked, ok := err.(lockedError); ok {
+			tooManyAttempts(w, locked)
+			return
+		}
+		if err != nil {
+			log.Println("Unauthorized")
+			w.Header().Set("WWW-Authenticate", `Basic realm="certificates", Bearer`)
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("401: Incorrect user credentials"))
+			return
+		}
+		if perm != noPermission && !u.can(perm) {
+			forbid(w, missingPermission(u, perm))
+			return
+		}
+		ctx := context.WithValue(r.Context(), userKey, u)
+		if sess.ID != "" {
+			ctx = context.WithValue(ctx, sessionKey, sess)
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+//requireOTP wraps the handler of an authenticated route so users with
+//two-factor authentication enabled must also send a one-time code, or a
+//recovery code, in the X-OTP header. Without a valid one they get a 403
+func (a *api) requireOTP(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u := currentUser(r)
+		if tf, found := a.store.GetTwoFactor(u.ID); !found || !tf.enabled() {
+			next(w, r)
+			return
+		}
+		code := r.Header.Get(otpHeader)
+		if code == "" {
+			forbid(w, "A one-time code is needed in the "+otpHeader+" header")
+			return
+		}
+		err := a.checkOneTimeCode(r, u.ID, code)
+		if locked, ok := err.(lockedError); ok {
+			tooManyAttempts(w, locked)
+			return
+		}
+		if err != nil {
+			forbid(w, "The one-time code is wrong or already used")
+			return
+		}
+		next(w, r)
+	}
+}
+
+//currentUser returns the user the middleware authenticated. It is only
+//meaningful in handlers of authenticated routes
+func currentUser(r *http.Request) user {
+	u, _ := r.Context().Value(userKey).(user)
+	return u
+}
+
+//currentSession returns the session of the bearer token a request was
+//authenticated with; requests using basic auth have none
+func currentSession(r *http.Request) (session, bool) {
+	sess, found := r.Context().Value(sessionKey).(session)
+	return sess, found
+}
@@ -1,17 +1,212 @@
 package certificates
 
-import "time"
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
 
+//transfer statuses, set by the server
+const (
+	transferPending   = "pending"
+	transferAccepted  = "accepted"  //recipient took ownership
+	transferRejected  = "rejected"  //recipient turned it down
+	transferCancelled = "cancelled" //sender withdrew it
+	transferExpired   = "expired"   //nobody acted on it in time
+)
+
+//transferTransitions lists the statuses a transfer may move to from each
+//status. Only pending transfers can change; every other status is final
+var transferTransitions = map[string][]string{
+	transferPending: {transferAccepted, transferRejected, transferCancelled, transferExpired},
+}
+
+//knownTransferStatus reports whether a transfer can ever have status
+func knownTransferStatus(status string) bool {
+	return status == transferPending || canTransition(transferPending, status)
+}
+
+//canTransition reports whether a transfer may move from one status to another
+func canTransition(from string, to string) bool {
+	for _, next := range transferTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+//transfer is a request to hand a certificate over to another user. It is
+//stored on its own, referring to its certificate by ID
 type transfer struct {
-	To     string // user email
-	Status string
+	ID        string
+	CertID    string
+	From      string // user ID of the owner handing the certificate over
+	To        string // user email
+	Status    string
+	CreatedAt time.Time
+	UpdatedAt time.Time //time of the last status change
+	ExpiresAt time.Time //zero if the transfer never expires
+}
+
+//overdue reports whether a transfer has passed its expiry time at the time given
+func (t transfer) overdue(at time.Time) bool {
+	return !t.ExpiresAt.IsZero() && !at.Before(t.ExpiresAt)
+}
+
+//ownershipChange is one link in a certificate's provenance chain
+type ownershipChange struct {
+	CertID     string
+	From       string // previous owner's user ID, empty when the certificate was issued
+	To         string // new owner's user ID
+	At         time.Time
+	TransferID string // transfer that moved the certificate, empty when it was issued
+}
+
+//kinds of ledger event
+const (
+	eventCreated     = "created"
+	eventUpdated     = "updated"
+	eventDeleted     = "deleted"
+	eventTransferred = "transferred" //a transfer was accepted
+	eventRevoked     = "revoked"
+)
+
+//ledgerEvent is one change to a certificate, chained to the event before it
+//in the ledger and to the certificate's own event before it by their hashes
+type ledgerEvent struct {
+	Seq          uint64 //position in the ledger, from 1
+	Kind         string
+	CertID       string
+	Cert         *certificate `json:",omitempty"` //the certificate after the change, unsigned; nil when deleted
+	TransferID   string       `json:",omitempty"`
+	At           time.Time
+	PrevHash     string //hash of the event before, empty for the first
+	PrevCertHash string //hash of the certificate's event before, empty for its first
+	Hash         string //hex SHA-256 of the event's JSON with Hash left empty
+}
+
+//checkpoint is a signed summary of the first TreeSize events of the ledger,
+//see merkle.go
+type checkpoint struct {
+	TreeSize  uint64
+	RootHash  string //hex Merkle tree hash of the events
+	At        time.Time
+	KeyID     string
+	Signature string
+}
+
+//session is a login, kept alive by refreshing it. Access tokens name the
+//session they were issued for so logging out revokes them along with it
+type session struct {
+	ID          string
+	UserID      string
+	RefreshHash string //hash of the secret in the current refresh token
+	CreatedAt   time.Time
+	ExpiresAt   time.Time //when the current refresh token runs out
+	RevokedAt   time.Time //zero while the session is live
+}
+
+//active reports whether a session can still be used at the time given
+func (s session) active(at time.Time) bool {
+	return s.RevokedAt.IsZero() && at.Before(s.ExpiresAt)
+}
+
+//passwordReset lets the holder of a token mailed to a user set a new
+//password once, before it expires
+type passwordReset struct {
+	ID        string
+	UserID    string
+	Hash      string //hash of the secret in the token
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    time.Time //zero until the token is used
+}
+
+//usable reports whether a reset token can still be used at the time given
+func (p passwordReset) usable(at time.Time) bool {
+	return p.UsedAt.IsZero() && at.Before(p.ExpiresAt)
+}
+
+//verification lets the holder of a token mailed to a user prove they
+//receive mail at Email. It is void once the user's email changes
+type verification struct {
+	ID        string
+	UserID    string
+	Email     string
+	Hash      string //hash of the secret in the token
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    time.Time //zero until the token is used
+}
+
+//usable reports whether a verification token can still be used at the time given
+func (v verification) usable(at time.Time) bool {
+	return v.UsedAt.IsZero() && at.Before(v.ExpiresAt)
+}
+
+//twoFactor is the TOTP authenticator of a user, see totp.go. The secret has
+//to be kept as is to compute codes from, unlike passwords and tokens
+type twoFactor struct {
+	UserID    string
+	Secret    string   //base32 encoded
+	Recovery  []string //hashes of the recovery codes not used yet
+	LastStep  uint64   //time step of the last code used; it and earlier ones are refused
+	CreatedAt time.Time
+	EnabledAt time.Time //zero until a first code confirms the enrolment
+}
+
+//enabled reports whether codes are asked for
+func (tf twoFactor) enabled() bool {
+	return !tf.EnabledAt.IsZero()
+}
+
+//apiKey lets a machine client act as the user who made it, limited to the
+//permissions named in its scopes
+type apiKey struct {
+	ID         string
+	UserID     string
+	Name       string
+	Scopes     []string
+	CreatedAt  time.Time
+	ExpiresAt  time.Time //zero if the key never expires
+	LastUsedAt time.Time //zero until first used
+	RevokedAt  time.Time //zero while the key is live
+	hash       string    //hash of the key's secret, kept out of responses
+}
+
+//active reports whether a key can still be used at the time given
+func (k apiKey) active(at time.Time) bool {
+	return k.RevokedAt.IsZero() && (k.ExpiresAt.IsZero() || at.Before(k.ExpiresAt))
 }
 
 type user struct {
-	ID       string
-	Email    string
-	Name     string
+	ID            string
+	Email         string //unique among users, deactivated ones included
+	Name          string
+	Roles         []string  //see authz.go
+	CreatedAt     time.Time //zero for the static users
+	DeactivatedAt time.Time //zero while the account is active
+	//when the user proved they receive mail at Email; zero until then
+	EmailVerifiedAt time.Time
+	//salted hash of the password, see passwords.go. The static data holds
+	//plaintext, which is hashed the first time each user logs in
 	password string
+	//set only on the copy the middleware puts into the context of a request
+	//authenticated with an API key, limiting it to the key's scopes
+	apiKeyID string
+	scopes   []permission
+}
+
+//active reports whether a user can still authenticate and receive transfers
+func (u user) active() bool {
+	return u.DeactivatedAt.IsZero()
+}
+
+//emailVerified reports whether the user has proved they own their email, as
+//they must before acting on transfers addressed to it
+func (u user) emailVerified() bool {
+	return !u.EmailVerifiedAt.IsZero()
 }
 
 type certificate struct {
@@ -21,7 +216,19 @@ type certificate struct {
 	OwnerID   string
 	Year      int
 	Note      string
-	Transfer  transfer //representing current state of transfer
+	//set by the server, over all of the above; see signing.go
+	KeyID     string `json:",omitempty"`
+	Signature string `json:",omitempty"`
+	//set by the server once the certificate is revoked; see revocation.go
+	Revoked *revocation `json:",omitempty"`
+}
+
+//revocation marks a certificate as not to be trusted. A revoked certificate
+//stays readable but can no longer change, be transferred or be deleted
+type revocation struct {
+	Reason    string //one of the revocation reasons
+	RevokedAt time.Time
+	RevokedBy string //user ID of who revoked it
 }
 type exception struct {
 	Message string
@@ -29,47 +236,57 @@ type exception struct {
 
 type certCollection []certificate
 type userCollection []user
+type transferCollection []transfer
+
+//newID returns a random identifier starting with prefix
+func newID(prefix string) string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return prefix + hex.EncodeToString(b)
+}
 
 /* static data for use in this project as opposed to db.
-Package scoped variables are bad practice but for the purposes of
-this task they allow for more convenient separation of duties */
-var certs = certCollection{
-	{
-		ID:        "c001",
-		Title:     "The Starry Night",
-		CreatedAt: time.Date(2009, 11, 17, 20, 34, 58, 651387237, time.UTC),
-		OwnerID:   "rr01",
-		Year:      1889,
-		Note:      "",
-		Transfer:  transfer{To: "", Status: ""},
-	},
-	{
-		ID:        "c002",
-		Title:     "Café Terrace at Night",
-		CreatedAt: time.Date(2009, 11, 17, 20, 34, 58, 651387237, time.UTC),
-		OwnerID:   "vvg01",
-		Year:      1888,
-		Note:      "",
-		Transfer:  transfer{To: "", Status: ""},
-	},
-}
-
-var users = userCollection{
-	{
-		ID:       "rr01",
-		Email:    "reshawnramjattan@gmail.com",
-		Name:     "Reshawn",
-		password: "rrejh3294",
-	},
-	{
-		ID:       "vvg01",
-		Email:    "vvg@gmail.com",
-		Name:     "Vincent Van Golang",
-		password: "vwh39043f",
-	},
-}
-
-//An array of pointers to certificate objects stored in certs that acts as
-//a subset of certificates containing transfers that have not yet been handled
-//This makes it easier to search for certificates when processing transfers
-var unacceptedTransfers = []*certificate{}
+Each call returns a fresh copy so every store starts from the same state
+without sharing the underlying slices */
+func seedCerts() certCollection {
+	return certCollection{
+		{
+			ID:        "c001",
+			Title:     "The Starry Night",
+			CreatedAt: time.Date(2009, 11, 17, 20, 34, 58, 651387237, time.UTC),
+			OwnerID:   "rr01",
+			Year:      1889,
+			Note:      "",
+		},
+		{
+			ID:        "c002",
+			Title:     "Café Terrace at Night",
+			CreatedAt: time.Date(2009, 11, 17, 20, 34, 58, 651387237, time.UTC),
+			OwnerID:   "vvg01",
+			Year:      1888,
+			Note:      "",
+		},
+	}
+}
+
+//the static users' emails are taken as verified
+func seedUsers() userCollection {
+	return userCollection{
+		{
+			ID:              "rr01",
+			Email:           "reshawnramjattan@gmail.com",
+			Name:            "Reshawn",
+			Roles:           []string{roleArtist},
+			EmailVerifiedAt: time.Date(2009, 11, 17, 20, 34, 58, 651387237, time.UTC),
+			password:        "rrejh3294",
+		},
+		{
+			ID:              "vvg01",
+			Email:           "vvg@gmail.com",
+			Name:            "Vincent Van Golang",
+			Roles:           []string{roleArtist},
+			EmailVerifiedAt: time.Date(2009, 11, 17, 20, 34, 58, 651387237, time.UTC),
+			password:        "vwh39043f",
+		},
+	}
+}
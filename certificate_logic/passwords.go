@@ -0,0 +1,99 @@
+package certificates
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+//Passwords are stored as PBKDF2-HMAC-SHA256 hashes encoded as
+//  pbkdf2-sha256$<iterations>$<salt>$<hash>
+//with the salt and hash in unpadded base64. A stored password without the
+//prefix is a plaintext one left from before hashing and is replaced with a
+//hash the next time its owner logs in
+const passwordScheme = "pbkdf2-sha256"
+
+//passwordIterations is the work factor for new hashes; hashes keep the count
+//they were made with so it can be raised without breaking old ones
+var passwordIterations = 100000
+
+const (
+	passwordSaltSize = 16
+	passwordKeySize  = 32
+	//shortest password accepted when one is set
+	minPasswordLength = 8
+)
+
+//dummyPasswordHash is checked against when a login names an unknown user so
+//the response takes as long as it does for a wrong password
+var dummyPasswordHash = hashPassword("not a real password")
+
+//hashPassword returns the encoded, salted hash of a password
+func hashPassword(pass string) string {
+	salt := make([]byte, passwordSaltSize)
+	rand.Read(salt)
+	key := pbkdf2SHA256([]byte(pass), salt, passwordIterations, passwordKeySize)
+	return fmt.Sprintf("%s$%d$%s$%s", passwordScheme, passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+//checkPassword reports whether pass matches the stored password, and whether
+//the stored one is legacy plaintext that should be replaced with a hash.
+//Comparisons take the same time however much of the password matches
+func checkPassword(stored string, pass string) (ok bool, legacy bool) {
+	if !strings.HasPrefix(stored, passwordScheme+"$") {
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(pass)) == 1, true
+	}
+	parts := strings.Split(stored, "$")
+	if len(parts) != 4 {
+		return false, false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false, false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false, false
+	}
+	//a key of any other length, or none, is not a hash this server made
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(want) != passwordKeySize {
+		return false, false
+	}
+	got := pbkdf2SHA256([]byte(pass), salt, iterations, len(want))
+	return subtle.ConstantTimeCompare(got, want) == 1, false
+}
+
+//pbkdf2SHA256 derives a key of keyLen bytes as described in RFC 8018 section 5.2
+func pbkdf2SHA256(pass []byte, salt []byte, iterations int, keyLen int) []byte {
+	prf := hmac.New(sha256.New, pass)
+	blocks := (keyLen + prf.Size() - 1) / prf.Size()
+	key := make([]byte, 0, blocks*prf.Size())
+	counter := make([]byte, 4)
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(counter, uint32(block))
+		prf.Write(counter)
+		u := prf.Sum(nil)
+		t := make([]byte, len(u))
+		copy(t, u)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
@@ -0,0 +1,47 @@
+package certificates
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+//TestPBKDF2SHA256 tests keys against known PBKDF2-HMAC-SHA256 vectors, the
+//last of them from RFC 7914 section 11 and longer than one block
+func TestPBKDF2SHA256(t *testing.T) {
+	vectors := []struct {
+		pass       string
+		salt       string
+		iterations int
+		key        string
+	}{
+		{"password", "salt", 1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{"password", "salt", 2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{"password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+	}
+	for _, v := range vectors {
+		key := pbkdf2SHA256([]byte(v.pass), []byte(v.salt), v.iterations, len(v.key)/2)
+		if got := hex.EncodeToString(key); got != v.key {
+			t.Errorf("Expected %s for %s/%s, c=%d. Got %s", v.key, v.pass, v.salt, v.iterations, got)
+		}
+	}
+}
+
+//TestCheckPasswordBadHash tests a stored hash whose key is missing or of the
+//wrong length matches no password
+func TestCheckPasswordBadHash(t *testing.T) {
+	hash := hashPassword("sunflowers1888")
+	if ok, legacy := checkPassword(hash, "sunflowers1888"); !ok || legacy {
+		t.Errorf("Expected the password to match its hash")
+	}
+	parts := strings.Split(hash, "$")
+	for _, key := range []string{"", parts[3][:10]} {
+		stored := strings.Join([]string{parts[0], parts[1], parts[2], key}, "$")
+		for _, pass := range []string{"", "sunflowers1888", "guess"} {
+			if ok, _ := checkPassword(stored, pass); ok {
+				t.Errorf("Expected a hash with key '%s' to match nothing. Matched '%s'", key, pass)
+			}
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package certificates
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//how long a mailed password reset token can be used for
+const resetTokenTTL = time.Hour
+
+//resetRequest is the body of a request for a password reset token
+type resetRequest struct {
+	Email string
+}
+
+//resetConfirmation is the body of a request setting a new password with a
+//reset token
+type resetConfirmation struct {
+	Token       string
+	NewPassword string
+}
+
+//resetMail is the mail carrying a password reset token
+const resetMail = `Hello %s,
+
+Someone asked to reset the password of your account %s. To choose a new
+password, send this token along with it to /auth/password-reset/confirm:
+
+%s
+
+The token works once and expires in %v. If you did not ask for a reset
+you can ignore this mail; your password has not changed.
+`
+
+//resetGuardKey is what reset requests for an email are counted against in
+//the login guard, apart from the failures of any user ID
+func resetGuardKey(email string) string {
+	return "reset:" + strings.ToLower(email)
+}
+
+//sendResetToken stores a new reset token for a user and mails it to them.
+//Failures are only logged, so the response cannot tell whether the email
+//belongs to anyone
+func (a *api) sendResetToken(u user) {
+	now := a.now().UTC()
+	p := passwordReset{ID: newID("r"), UserID: u.ID, CreatedAt: now, ExpiresAt: now.Add(resetTokenTTL)}
+	token, hash := newOpaqueToken(p.ID)
+	p.Hash = hash
+	if err := a.store.CreateReset(p); err != nil {
+		log.Println("Error creating reset token", err)
+		return
+	}
+	err := a.mailer.Send(Message{
+		To:      u.Email,
+		Subject: "Reset your password",
+		Body:    fmt.Sprintf(resetMail, u.Name, u.ID, token, resetTokenTTL),
+	})
+	if err != nil {
+		log.Println("Error mailing reset token", err)
+	}
+}
+
+//Handler functions
+// ~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+
+//mail a password reset token to the user with the email given, if any. The
+//response is the same either way, and the token is stored and mailed in the
+//background so neither is the time taken; it cannot be used to find accounts.
+//Requests count against the email and the client as failed logins do, so
+//nobody can flood an inbox or probe many emails
+func (a *api) requestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var req resetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Println("Bad request", err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400: Invalid request body"))
+		return
+	}
+	email := strings.TrimSpace(req.Email)
+	log.Println("Password reset requested for", email)
+
+	ip, key := clientIP(r), resetGuardKey(email)
+	if wait := a.guard.lockedFor(key, ip, a.now()); wait > 0 {
+		tooManyAttempts(w, lockedError{wait})
+		return
+	}
+	a.guard.fail(key, ip, a.now())
+
+	if u, found := a.store.GetUserByEmail(email); found && u.active() {
+		go a.sendResetToken(u)
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("If the email belongs to an account, a reset token has been sent to it"))
+	return
+}
+
+//set a new password with a reset token, logging the user out everywhere
+func (a *api) resetPassword(w http.ResponseWriter, r *http.Request) {
+	var req resetConfirmation
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Println("Bad request", err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400: Invalid request body"))
+		return
+	}
+	if len(req.NewPassword) < minPasswordLength {
+		log.Println("Password too short")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("400: Password must be at least %d characters", minPasswordLength)))
+		return
+	}
+
+	id, hash, ok := splitOpaqueToken(req.Token)
+	p, found := a.store.GetReset(id)
+	if !ok || !found {
+		log.Println("Unknown reset token")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400: Invalid or expired reset token"))
+		return
+	}
+	log.Println("Reset password of user", p.UserID)
+
+	switch err := a.store.ResetPassword(id, hash, hashPassword(req.NewPassword), a.now().UTC()); err {
+	case nil:
+	case errResetInvalid, errUserNotFound, errUserDeactivated:
+		log.Println("Reset refused", err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400: Invalid or expired reset token"))
+		return
+	default:
+		log.Println("Error resetting password", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Error resetting password"))
+		return
+	}
+	//the new password works at once, even if guessing had locked the account
+	a.guard.unlock(p.UserID)
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Password Reset"))
+	return
+}
@@ -0,0 +1,125 @@
+package certificates
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+)
+
+//router, executeRequest and checkResponseCode are defined in certControllers_test.go
+//this file of unit tests can be considered an extension of that and is separated solely
+//for the purposes of separating duties and logic
+
+//mailedToken matches the reset token in a reset mail
+var mailedToken = regexp.MustCompile(`(?m)^(r[0-9a-f]{16}\.\S+)$`)
+
+//requestReset asks for a reset token for an email and returns the token
+//mailed, if any
+func requestReset(t *testing.T, r http.Handler, outbox *Outbox, email string) string {
+	sent := len(outbox.Messages())
+	body, _ := json.Marshal(resetRequest{Email: email})
+	req, _ := http.NewRequest("POST", "/auth/password-reset", bytes.NewBuffer(body))
+	checkResponseCode(t, http.StatusAccepted, executeOn(r, req).Code)
+
+	//the mail is sent in the background
+	deadline := time.Now().Add(time.Second)
+	for len(outbox.Messages()) == sent && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	messages := outbox.Messages()
+	if len(messages) == sent {
+		return ""
+	}
+	m := messages[len(messages)-1]
+	if m.To != email {
+		t.Errorf("Expected mail to %s. Got %s", email, m.To)
+	}
+	match := mailedToken.FindStringSubmatch(m.Body)
+	if match == nil {
+		t.Fatalf("Expected a token in the mail. Got '%s'", m.Body)
+	}
+	return match[1]
+}
+
+//confirmReset sets a new password with a reset token
+func confirmReset(r http.Handler, token string, pass string) int {
+	body, _ := json.Marshal(resetConfirmation{Token: token, NewPassword: pass})
+	req, _ := http.NewRequest("POST", "/auth/password-reset/confirm", bytes.NewBuffer(body))
+	return executeOn(r, req).Code
+}
+
+//TestPasswordReset test a mailed token sets a new password once and logs the
+//user out of their sessions
+func TestPasswordReset(t *testing.T) {
+	outbox, _ := NewOutbox("")
+	r := NewRouter(NewMemoryStore(), WithMailer(outbox))
+	tokens := login(t, r, "vvg01", "vwh39043f")
+
+	token := requestReset(t, r, outbox, "vvg@gmail.com")
+	checkResponseCode(t, http.StatusBadRequest, confirmReset(r, token, "short"))
+	checkResponseCode(t, http.StatusOK, confirmReset(r, token, "sunflowers1888"))
+	checkResponseCode(t, http.StatusBadRequest, confirmReset(r, token, "irises1889"))
+
+	checkResponseCode(t, http.StatusUnauthorized, loginCode(r, "vvg01", "vwh39043f"))
+	login(t, r, "vvg01", "sunflowers1888")
+	checkResponseCode(t, http.StatusUnauthorized, withBearer(r, tokens.AccessToken))
+}
+
+//TestPasswordResetUnknownEmail test a request for an email without an
+//account is answered the same but sends nothing
+func TestPasswordResetUnknownEmail(t *testing.T) {
+	outbox, _ := NewOutbox("")
+	r := NewRouter(NewMemoryStore(), WithMailer(outbox))
+	if token := requestReset(t, r, outbox, "kh@gmail.com"); token != "" {
+		t.Errorf("Expected no mail to be sent")
+	}
+}
+
+//TestPasswordResetBadToken test expired, altered and unknown tokens are refused
+func TestPasswordResetBadToken(t *testing.T) {
+	clock := newTestClock()
+	outbox, _ := NewOutbox("")
+	r := NewRouter(NewMemoryStore(), WithClock(clock.Now), WithMailer(outbox))
+
+	token := requestReset(t, r, outbox, "vvg@gmail.com")
+	checkResponseCode(t, http.StatusBadRequest, confirmReset(r, token+"x", "sunflowers1888"))
+	checkResponseCode(t, http.StatusBadRequest, confirmReset(r, "r0000000000000000.secret", "sunflowers1888"))
+	checkResponseCode(t, http.StatusBadRequest, confirmReset(r, "", "sunflowers1888"))
+
+	clock.Advance(resetTokenTTL)
+	checkResponseCode(t, http.StatusBadRequest, confirmReset(r, token, "sunflowers1888"))
+	login(t, r, "vvg01", "vwh39043f")
+}
+
+//TestPasswordResetUnlocks test a reset lifts a lockout of the user
+func TestPasswordResetUnlocks(t *testing.T) {
+	outbox, _ := NewOutbox("")
+	r := NewRouter(NewMemoryStore(), WithMailer(outbox), WithLockout(lockoutPolicy))
+	for i := 0; i < lockoutPolicy.UserThreshold; i++ {
+		loginCode(r, "vvg01", "guess")
+	}
+	checkResponseCode(t, http.StatusTooManyRequests, loginCode(r, "vvg01", "vwh39043f"))
+
+	checkResponseCode(t, http.StatusOK, confirmReset(r, requestReset(t, r, outbox, "vvg@gmail.com"), "sunflowers1888"))
+	checkResponseCode(t, http.StatusOK, loginCode(r, "vvg01", "sunflowers1888"))
+}
+
+//TestPasswordResetThrottled test repeated requests for one email are locked
+//out as repeated failed logins are
+func TestPasswordResetThrottled(t *testing.T) {
+	outbox, _ := NewOutbox("")
+	r := NewRouter(NewMemoryStore(), WithMailer(outbox), WithLockout(lockoutPolicy))
+	body, _ := json.Marshal(resetRequest{Email: "kh@gmail.com"})
+	for i := 0; i < lockoutPolicy.UserThreshold; i++ {
+		req, _ := http.NewRequest("POST", "/auth/password-reset", bytes.NewBuffer(body))
+		checkResponseCode(t, http.StatusAccepted, executeOn(r, req).Code)
+	}
+	req, _ := http.NewRequest("POST", "/auth/password-reset", bytes.NewBuffer(body))
+	checkResponseCode(t, http.StatusTooManyRequests, executeOn(r, req).Code)
+
+	//other emails are still answered
+	requestReset(t, r, outbox, "vvg@gmail.com")
+}
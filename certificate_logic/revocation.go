@@ -0,0 +1,78 @@
+package certificates
+
+import "time"
+
+//reasons a certificate is revoked for, as sent when revoking it
+const (
+	revokeFraudulent    = "fraudulent"      //the certificate or the work it describes is not genuine
+	revokeIssuedInError = "issued_in_error" //the details were wrong when it was issued
+	revokeSuperseded    = "superseded"      //another certificate replaces it
+	revokeUnspecified   = "unspecified"
+)
+
+//knownRevocationReason reports whether a certificate can be revoked for reason
+func knownRevocationReason(reason string) bool {
+	switch reason {
+	case revokeFraudulent, revokeIssuedInError, revokeSuperseded, revokeUnspecified:
+		return true
+	}
+	return false
+}
+
+//sameRevocation reports whether two certificates are revoked alike, or both not at all
+func sameRevocation(a *revocation, b *revocation) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Reason == b.Reason && a.RevokedAt.Equal(b.RevokedAt) && a.RevokedBy == b.RevokedBy
+}
+
+//Default and largest number of entries on a page of the revocation list
+const (
+	defaultRevocationPage = 100
+	maxRevocationPage     = 1000
+)
+
+//revokedCert is an entry of the revocation list
+type revokedCert struct {
+	CertID    string
+	Reason    string
+	RevokedAt time.Time
+	Seq       uint64 //ledger event of the revocation
+}
+
+//revocationList is a signed page of every revocation, oldest first. Entries
+//only ever get added at the end, so a page once full never changes
+type revocationList struct {
+	Page      int //from 1
+	PerPage   int
+	Total     int //revocations on every page
+	Entries   []revokedCert
+	At        time.Time //when the page was made
+	KeyID     string
+	Signature string
+}
+
+//revocationPage makes the page of the revocation list holding the revocation
+//events given, unsigned. A page past the end has no entries
+func revocationPage(events []ledgerEvent, page int, perPage int, at time.Time) revocationList {
+	list := revocationList{Page: page, PerPage: perPage, Total: len(events), Entries: []revokedCert{}, At: at.UTC()}
+	//checked before multiplying, which overflows for a page far past the end
+	pages := (len(events) + perPage - 1) / perPage
+	if page-1 >= pages {
+		return list
+	}
+	start := (page - 1) * perPage
+	end := len(events)
+	if end-start > perPage {
+		end = start + perPage
+	}
+	for _, ev := range events[start:end] {
+		entry := revokedCert{CertID: ev.CertID, RevokedAt: ev.At, Seq: ev.Seq}
+		if ev.Cert != nil && ev.Cert.Revoked != nil {
+			entry.Reason = ev.Cert.Revoked.Reason
+		}
+		list.Entries = append(list.Entries, entry)
+	}
+	return list
+}
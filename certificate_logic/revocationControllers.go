@@ -0,0 +1,123 @@
+package certificates
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+//revokeRequest is the body of a request to revoke a certificate
+type revokeRequest struct {
+	Reason string //one of the revocation reasons, unspecified if empty
+}
+
+//Data altering functions
+// ~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+
+//pageParam reads a positive page number or size from the query, fallback if absent
+func pageParam(value string, fallback int) (int, bool) {
+	if value == "" {
+		return fallback, true
+	}
+	n, err := strconv.Atoi(value)
+	return n, err == nil && n > 0
+}
+
+//Handler functions
+// ~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+
+//revoke a certificate for a reason. It stays readable, flagged as revoked,
+//but can no longer change hands, be edited or be deleted
+func (a *api) revokeCert(w http.ResponseWriter, r *http.Request) {
+	var req revokeRequest
+	vars := mux.Vars(r)
+	id := vars["id"] // id of certificate to be revoked
+	log.Println("Attempt to revoke cert", id)
+
+	body, err := ioutil.ReadAll(r.Body)
+
+	if err != nil {
+		log.Println("Error revoking certificate", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Error revoking certificate"))
+		return
+	}
+
+	//an empty body revokes for no reason in particular
+	if len(body) > 0 && json.Unmarshal(body, &req) != nil {
+		log.Println("Error revoking certificate, bad JSON data")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Error revoking certificate, bad JSON data"))
+		return
+	}
+	if req.Reason == "" {
+		req.Reason = revokeUnspecified
+	}
+	if !knownRevocationReason(req.Reason) {
+		log.Println("Unknown revocation reason", req.Reason)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Error revoking certificate, Reason must be fraudulent, issued_in_error, superseded or unspecified"))
+		return
+	}
+
+	rev := revocation{Reason: req.Reason, RevokedAt: a.now().UTC(), RevokedBy: currentUser(r).ID}
+	switch err := a.store.RevokeCert(id, rev); err {
+	case nil:
+	case errCertNotFound:
+		log.Println("Certificate not found")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404: Certificate not found"))
+		return
+	case errCertRevoked:
+		log.Println("Certificate already revoked")
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("409: Certificate already revoked"))
+		return
+	default:
+		log.Println("Error revoking certificate", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Error revoking certificate"))
+		return
+	}
+	log.Println("Certificate", id, "revoked as", rev.Reason)
+
+	//respond with the certificate as stored, flagged as revoked
+	cert, _ := a.lookupCert(id)
+	data, _ := json.Marshal(cert)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+	return
+}
+
+//get a signed page of the list of revoked certificates, oldest first, so
+//verifiers can keep a copy and check certificates without asking each time
+func (a *api) getRevocationList(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	log.Println("Get revocation list page", query.Get("page"))
+
+	page, okPage := pageParam(query.Get("page"), 1)
+	perPage, okSize := pageParam(query.Get("per_page"), defaultRevocationPage)
+	if !okPage || !okSize || perPage > maxRevocationPage {
+		log.Println("Bad page of revocation list")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Error listing revocations, page and per_page must be positive and per_page at most " +
+			strconv.Itoa(maxRevocationPage)))
+		return
+	}
+
+	list := revocationPage(a.store.ListRevocations(), page, perPage, a.now())
+	data, _ := json.Marshal(a.keys.signRevocations(list))
+
+	//create and write http response
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+	return
+}
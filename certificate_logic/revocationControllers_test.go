@@ -0,0 +1,109 @@
+package certificates
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+//TestRevokeCert tests a revoked certificate stays readable, flagged, and
+//can no longer be edited, deleted or transferred
+func TestRevokeCert(t *testing.T) {
+	store := newTestStore()
+	r := NewRouter(store)
+	doc := certRequest(r, "GET", "/certificates/c002", "", "", "").Body.Bytes()
+
+	checkResponseCode(t, http.StatusForbidden, certRequest(r, "POST", "/certificates/c002/revoke", `{"Reason": "fraudulent"}`, "vvg01", "vwh39043f").Code)
+	response := certRequest(r, "POST", "/certificates/c002/revoke", `{"Reason": "fraudulent"}`, "rr01", "rrejh3294")
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var revoked certificate
+	json.Unmarshal(response.Body.Bytes(), &revoked)
+	if revoked.Revoked == nil || revoked.Revoked.Reason != revokeFraudulent || revoked.Revoked.RevokedBy != "rr01" {
+		t.Fatalf("Expected certificate revoked as fraudulent by rr01. Got %+v", revoked)
+	}
+
+	var c certificate
+	json.Unmarshal(certRequest(r, "GET", "/certificates/c002", "", "", "").Body.Bytes(), &c)
+	if c.Revoked == nil {
+		t.Errorf("Expected revoked certificate to be flagged. Got %+v", c)
+	}
+	var all []certificate
+	json.Unmarshal(certRequest(r, "GET", "/certificates", "", "", "").Body.Bytes(), &all)
+	if len(all) != 2 || all[0].Revoked != nil || all[1].Revoked == nil {
+		t.Errorf("Expected only c002 flagged in the list. Got %+v", all)
+	}
+	if check := verifyDoc(t, r, doc); !check.Valid || check.Revoked == nil {
+		t.Errorf("Expected signature to verify with the revocation reported. Got %+v", check)
+	}
+
+	for _, tc := range []struct {
+		method, url, body, user, pass string
+		code                          int
+	}{
+		{"POST", "/certificates/c002/revoke", "", "rr01", "rrejh3294", http.StatusConflict},
+		{"POST", "/certificates/c001/revoke", `{"Reason": "stolen"}`, "rr01", "rrejh3294", http.StatusBadRequest},
+		{"POST", "/certificates/c404/revoke", "", "rr01", "rrejh3294", http.StatusNotFound},
+		{"PUT", "/certificates/update", `{"ID": "c002", "Note": "genuine"}`, "vvg01", "vwh39043f", http.StatusConflict},
+		{"DELETE", "/certificates/c002/delete", "", "rr01", "rrejh3294", http.StatusConflict},
+		{"POST", "/certificates/c002/transfers/create", `{"To": "reshawnramjattan@gmail.com"}`, "vvg01", "vwh39043f", http.StatusConflict},
+	} {
+		if got := certRequest(r, tc.method, tc.url, tc.body, tc.user, tc.pass).Code; got != tc.code {
+			t.Errorf("Expected %d for %s %s. Got %d", tc.code, tc.method, tc.url, got)
+		}
+	}
+	if check := checkLedger(store.GetLedger()); !check.Valid || check.Events != 3 {
+		t.Errorf("Expected revocation in a valid ledger. Got %+v", check)
+	}
+}
+
+//TestRevokeBlocksAccept tests a transfer made before the certificate was
+//revoked cannot be accepted after
+func TestRevokeBlocksAccept(t *testing.T) {
+	r := NewRouter(newTestStore())
+	checkResponseCode(t, http.StatusCreated, certRequest(r, "POST", "/certificates/c001/transfers/create", `{"To": "vvg@gmail.com"}`, "rr01", "rrejh3294").Code)
+	checkResponseCode(t, http.StatusOK, certRequest(r, "POST", "/certificates/c001/revoke", "", "rr01", "rrejh3294").Code)
+
+	checkResponseCode(t, http.StatusConflict, certRequest(r, "PUT", "/certificates/c001/transfers/accept", "", "vvg01", "vwh39043f").Code)
+	checkResponseCode(t, http.StatusOK, certRequest(r, "PUT", "/certificates/c001/transfers/reject", "", "vvg01", "vwh39043f").Code)
+}
+
+//TestRevocationList tests the revocation list is paged, oldest first, and
+//each page is signed
+func TestRevocationList(t *testing.T) {
+	keys := newKeyManager()
+	r := NewRouter(newTestStore(), WithKeyManager(keys))
+	certRequest(r, "POST", "/certificates/create", `{"ID": "c040"}`, "rr01", "rrejh3294")
+	for _, id := range []string{"c001", "c002", "c040"} {
+		certRequest(r, "POST", "/certificates/"+id+"/revoke", `{"Reason": "superseded"}`, "rr01", "rrejh3294")
+	}
+
+	var first, second revocationList
+	ledgerRequest(t, r, "/revocations?per_page=2", &first)
+	ledgerRequest(t, r, "/revocations?page=2&per_page=2", &second)
+	if first.Total != 3 || len(first.Entries) != 2 || first.Entries[0].CertID != "c001" || first.Entries[1].Reason != revokeSuperseded {
+		t.Errorf("Expected first 2 of 3 revocations. Got %+v", first)
+	}
+	if len(second.Entries) != 1 || second.Entries[0].CertID != "c040" || second.Entries[0].Seq != 6 {
+		t.Errorf("Expected last revocation on page 2. Got %+v", second)
+	}
+	sig, _ := base64.StdEncoding.DecodeString(second.Signature)
+	if err := keys.verify(second.KeyID, canonicalRevocations(second), sig); err != nil {
+		t.Errorf("Expected page signature to verify. Got %v", err)
+	}
+	second.Entries[0].Reason = revokeUnspecified
+	if keys.verify(second.KeyID, canonicalRevocations(second), sig) == nil {
+		t.Errorf("Expected altered page to fail")
+	}
+
+	var past revocationList
+	ledgerRequest(t, r, "/revocations?page=4611686018427387904&per_page=4", &past)
+	if past.Total != 3 || len(past.Entries) != 0 {
+		t.Errorf("Expected no entries on a page far past the end. Got %+v", past)
+	}
+
+	for _, url := range []string{"/revocations?page=0", "/revocations?per_page=x", "/revocations?per_page=1001"} {
+		req, _ := http.NewRequest("GET", url, nil)
+		checkResponseCode(t, http.StatusBadRequest, executeOn(r, req).Code)
+	}
+}
@@ -3,6 +3,7 @@ package certificates
 import (
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -12,75 +13,508 @@ type Route struct {
 	Name        string
 	Method      string
 	Pattern     string
+	Auth        authLevel  //credentials the caller must present
+	Permission  permission //what an authenticated caller must be allowed to do
 	HandlerFunc http.HandlerFunc
 }
 
-var routes = []Route{
-	// list all certificates
-	Route{
-		"all_certificates",
-		"GET",
-		"/certificates",
-		getAllCerts,
-	},
-	// create new certificate (with ownerd in header)
-	Route{
-		"create_certificate",
-		"POST",
-		"/certificates/create",
-		createCert,
-	},
-	//Get certificate by id
-	Route{
-		"get_certificate",
-		"GET",
-		"/certificates/{id}",
-		getCert,
-	},
-	//update existing certificate
-	Route{
-		"update_certificate",
-		"PUT",
-		"/certificates/update",
-		updateCert,
-	},
-	//Delete product by id
-	Route{
-		"delete_certificate",
-		"DELETE",
-		"/certificates/{id}/delete",
-		deleteCert,
-	},
-	//View certificates belonging to a user
-	Route{
-		"user_certificates",
-		"GET",
-		"/users/{userID}/certificates",
-		userCerts,
-	},
-	//Create certificate transfer
-	Route{
-		"create_transfer",
-		"POST",
-		"/certificates/{id}/transfers/create",
-		createTransfer,
-	},
-	//Accept certificate transfer
-	Route{
-		"accept_transfer",
-		"PUT",
-		"/certificates/{id}/transfers/accept",
-		acceptTransfer,
-	},
+//api holds the dependencies shared by every handler
+type api struct {
+	store CertificateStore
+	//now tells the time; tests swap it for a clock they control
+	now func() time.Time
+	//how long a transfer stays open when the client does not say; zero for no limit
+	transferTTL time.Duration
+	//how long tokens last
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+	//failed password attempts, see lockout.go
+	guard *loginGuard
+	//sends the mail written to users, such as password reset tokens
+	mailer Mailer
+	//keys certificates, checkpoints and access tokens are signed with, see keys.go
+	keys *KeyManager
 }
 
-//NewRouter Configures a new router to the API based on all above routes
-func NewRouter() *mux.Router {
+//DefaultTransferTTL is how long a transfer stays open unless configured otherwise
+const DefaultTransferTTL = 7 * 24 * time.Hour
+
+//Default lifetimes of the tokens handed out at login. A refresh token is
+//replaced each time it is used, which pushes the end of the session back
+const (
+	DefaultAccessTokenTTL  = 15 * time.Minute
+	DefaultRefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+//Option changes a setting of the API built by NewRouter
+type Option func(*api)
+
+//WithClock makes the API tell the time with now instead of the system clock
+func WithClock(now func() time.Time) Option {
+	return func(a *api) { a.now = now }
+}
+
+//WithTransferTTL sets how long new transfers stay open when the client gives
+//no expiry; zero leaves them open until handled
+func WithTransferTTL(ttl time.Duration) Option {
+	return func(a *api) { a.transferTTL = ttl }
+}
+
+//WithTokenTTL sets how long access tokens and refresh tokens last
+func WithTokenTTL(access time.Duration, refresh time.Duration) Option {
+	return func(a *api) {
+		a.accessTTL = access
+		a.refreshTTL = refresh
+	}
+}
+
+//WithLockout sets how failed password attempts lock out users and clients
+func WithLockout(policy LockoutPolicy) Option {
+	return func(a *api) { a.guard = newLoginGuard(policy) }
+}
+
+//WithMailer sets how mail to users is sent
+func WithMailer(m Mailer) Option {
+	return func(a *api) { a.mailer = m }
+}
+
+//WithKeyManager sets the keys certificates, checkpoints and access tokens
+//are signed with. Without it a random key is kept in memory, so signatures
+//stop verifying and access tokens stop working when the process restarts;
+//instances sharing a store share a key manager
+func WithKeyManager(keys *KeyManager) Option {
+	return func(a *api) { a.keys = keys }
+}
+
+//routes lists every endpoint along with the handler bound to this api instance
+func (a *api) routes() []Route {
+	return []Route{
+		// list all certificates
+		Route{
+			"all_certificates",
+			"GET",
+			"/certificates",
+			public,
+			noPermission,
+			a.getAllCerts,
+		},
+		// create new certificate owned by the authed user
+		Route{
+			"create_certificate",
+			"POST",
+			"/certificates/create",
+			authenticated,
+			permIssueCerts,
+			a.createCert,
+		},
+		//Check the signature of a certificate document
+		Route{
+			"verify_certificate",
+			"POST",
+			"/certificates/verify",
+			public,
+			noPermission,
+			a.verifyCert,
+		},
+		//Get certificate by id
+		Route{
+			"get_certificate",
+			"GET",
+			"/certificates/{id}",
+			public,
+			noPermission,
+			a.getCert,
+		},
+		//Get the chain of owners of a certificate
+		Route{
+			"certificate_provenance",
+			"GET",
+			"/certificates/{id}/provenance",
+			public,
+			noPermission,
+			a.getProvenance,
+		},
+		//Get the ledger events of a certificate, each chained to the one before
+		Route{
+			"certificate_events",
+			"GET",
+			"/certificates/{id}/events",
+			public,
+			noPermission,
+			a.getCertEvents,
+		},
+		//Check no event in the ledger has been altered
+		Route{
+			"verify_ledger",
+			"GET",
+			"/ledger/verify",
+			public,
+			noPermission,
+			a.verifyLedger,
+		},
+		//List the signed checkpoints of the ledger
+		Route{
+			"ledger_checkpoints",
+			"GET",
+			"/ledger/checkpoints",
+			public,
+			noPermission,
+			a.listCheckpoints,
+		},
+		//Prove an event is included in a checkpoint
+		Route{
+			"inclusion_proof",
+			"GET",
+			"/ledger/proofs/inclusion",
+			public,
+			noPermission,
+			a.getInclusionProof,
+		},
+		//Prove a checkpoint is consistent with a later one
+		Route{
+			"consistency_proof",
+			"GET",
+			"/ledger/proofs/consistency",
+			public,
+			noPermission,
+			a.getConsistencyProof,
+		},
+		//update existing certificate
+		Route{
+			"update_certificate",
+			"PUT",
+			"/certificates/update",
+			authenticated,
+			permEditCerts,
+			a.updateCert,
+		},
+		//Delete product by id; irreversible, so a one-time code is asked of users with 2FA
+		Route{
+			"delete_certificate",
+			"DELETE",
+			"/certificates/{id}/delete",
+			authenticated,
+			permDeleteCerts,
+			a.requireOTP(a.deleteCert),
+		},
+		//Revoke a certificate for a reason, keeping it as evidence; irreversible, so a one-time code is asked of users with 2FA
+		Route{
+			"revoke_certificate",
+			"POST",
+			"/certificates/{id}/revoke",
+			authenticated,
+			permRevokeCerts,
+			a.requireOTP(a.revokeCert),
+		},
+		//Download a signed page of the list of revoked certificates
+		Route{
+			"revocation_list",
+			"GET",
+			"/revocations",
+			public,
+			noPermission,
+			a.getRevocationList,
+		},
+		//View certificates belonging to a user
+		Route{
+			"user_certificates",
+			"GET",
+			"/users/{userID}/certificates",
+			public,
+			noPermission,
+			a.userCerts,
+		},
+		//View transfers sent to a user
+		Route{
+			"incoming_transfers",
+			"GET",
+			"/users/{userID}/transfers/incoming",
+			authenticated,
+			permReadTransfer,
+			a.incomingTransfers,
+		},
+		//View transfers sent by a user
+		Route{
+			"outgoing_transfers",
+			"GET",
+			"/users/{userID}/transfers/outgoing",
+			authenticated,
+			permReadTransfer,
+			a.outgoingTransfers,
+		},
+		//Exchange user credentials for an access and a refresh token
+		Route{
+			"login",
+			"POST",
+			"/auth/login",
+			public,
+			noPermission,
+			a.login,
+		},
+		//Exchange a refresh token for new tokens
+		Route{
+			"refresh_token",
+			"POST",
+			"/auth/refresh",
+			public,
+			noPermission,
+			a.refresh,
+		},
+		//Revoke the session of an access token
+		Route{
+			"logout",
+			"POST",
+			"/auth/logout",
+			authenticated,
+			noPermission,
+			a.logout,
+		},
+		//Register a new user
+		Route{
+			"register_user",
+			"POST",
+			"/users/register",
+			public,
+			noPermission,
+			a.registerUser,
+		},
+		//View a user's profile
+		Route{
+			"user",
+			"GET",
+			"/users/{userID}",
+			authenticated,
+			noPermission,
+			a.getUser,
+		},
+		//Change a user's email and name
+		Route{
+			"update_user",
+			"PUT",
+			"/users/{userID}",
+			authenticated,
+			noPermission,
+			a.updateProfile,
+		},
+		//Deactivate a user's account
+		Route{
+			"deactivate_user",
+			"DELETE",
+			"/users/{userID}",
+			authenticated,
+			noPermission,
+			a.deactivateUser,
+		},
+		//Mail a password reset token to the owner of an email
+		Route{
+			"request_password_reset",
+			"POST",
+			"/auth/password-reset",
+			public,
+			noPermission,
+			a.requestPasswordReset,
+		},
+		//Set a new password with a reset token
+		Route{
+			"reset_password",
+			"POST",
+			"/auth/password-reset/confirm",
+			public,
+			noPermission,
+			a.resetPassword,
+		},
+		//Mail a token verifying the email of a user
+		Route{
+			"request_email_verification",
+			"POST",
+			"/users/{userID}/email/verify",
+			authenticated,
+			noPermission,
+			a.requestVerification,
+		},
+		//Verify an email with a mailed token
+		Route{
+			"verify_email",
+			"POST",
+			"/auth/verify-email",
+			public,
+			noPermission,
+			a.verifyEmail,
+		},
+		//Start enrolling an authenticator app for two-factor authentication
+		Route{
+			"enrol_2fa",
+			"POST",
+			"/users/{userID}/2fa",
+			authenticated,
+			noPermission,
+			a.enrolTwoFactor,
+		},
+		//Enable two-factor authentication with a first code from the authenticator
+		Route{
+			"confirm_2fa",
+			"POST",
+			"/users/{userID}/2fa/confirm",
+			authenticated,
+			noPermission,
+			a.confirmTwoFactor,
+		},
+		//Disable two-factor authentication
+		Route{
+			"disable_2fa",
+			"DELETE",
+			"/users/{userID}/2fa",
+			authenticated,
+			noPermission,
+			a.disableTwoFactor,
+		},
+		//Public keys signatures are checked with, as a JSON Web Key Set
+		Route{
+			"jwks",
+			"GET",
+			"/.well-known/jwks.json",
+			public,
+			noPermission,
+			a.getJWKS,
+		},
+		//Add a signing key taking over from the current one
+		Route{
+			"rotate_signing_key",
+			"POST",
+			"/signing-keys/rotate",
+			authenticated,
+			permManageKeys,
+			a.rotateSigningKey,
+		},
+		//Revoke a compromised signing key
+		Route{
+			"revoke_signing_key",
+			"DELETE",
+			"/signing-keys/{keyID}",
+			authenticated,
+			permManageKeys,
+			a.revokeSigningKey,
+		},
+		//Set the roles of a user
+		Route{
+			"set_roles",
+			"PUT",
+			"/users/{userID}/roles",
+			authenticated,
+			permManageUsers,
+			a.setRoles,
+		},
+		//Create an API key for a machine client acting as the user
+		Route{
+			"create_api_key",
+			"POST",
+			"/users/{userID}/keys",
+			authenticated,
+			noPermission,
+			a.createAPIKey,
+		},
+		//List the API keys of a user
+		Route{
+			"api_keys",
+			"GET",
+			"/users/{userID}/keys",
+			authenticated,
+			noPermission,
+			a.listAPIKeys,
+		},
+		//Revoke an API key
+		Route{
+			"revoke_api_key",
+			"DELETE",
+			"/users/{userID}/keys/{keyID}",
+			authenticated,
+			noPermission,
+			a.revokeAPIKey,
+		},
+		//Lift the lockout of a user after failed password attempts
+		Route{
+			"unlock_user",
+			"DELETE",
+			"/users/{userID}/lockout",
+			authenticated,
+			permManageUsers,
+			a.unlockUser,
+		},
+		//Change a user's password; the old password in the body is the credential
+		Route{
+			"change_password",
+			"PUT",
+			"/users/{userID}/password",
+			public,
+			noPermission,
+			a.changePassword,
+		},
+		//Create certificate transfer; a one-time code is asked of users with 2FA
+		Route{
+			"create_transfer",
+			"POST",
+			"/certificates/{id}/transfers/create",
+			authenticated,
+			permWriteTransfer,
+			a.requireOTP(a.createTransfer),
+		},
+		//Accept certificate transfer; a one-time code is asked of users with 2FA
+		Route{
+			"accept_transfer",
+			"PUT",
+			"/certificates/{id}/transfers/accept",
+			authenticated,
+			permWriteTransfer,
+			a.requireOTP(a.acceptTransfer),
+		},
+		//Reject certificate transfer
+		Route{
+			"reject_transfer",
+			"PUT",
+			"/certificates/{id}/transfers/reject",
+			authenticated,
+			permWriteTransfer,
+			a.rejectTransfer,
+		},
+		//Cancel certificate transfer
+		Route{
+			"cancel_transfer",
+			"PUT",
+			"/certificates/{id}/transfers/cancel",
+			authenticated,
+			permWriteTransfer,
+			a.cancelTransfer,
+		},
+	}
+}
+
+//NewRouter Configures a new router to the API based on all above routes,
+//with every handler reading and writing through the store passed in
+func NewRouter(store CertificateStore, opts ...Option) *mux.Router {
+	a := &api{
+		store:       store,
+		now:         time.Now,
+		transferTTL: DefaultTransferTTL,
+		keys:        newKeyManager(),
+		accessTTL:   DefaultAccessTokenTTL,
+		refreshTTL:  DefaultRefreshTokenTTL,
+		guard:       newLoginGuard(DefaultLockoutPolicy),
+	}
+	a.mailer, _ = NewOutbox("")
+	for _, opt := range opts {
+		opt(a)
+	}
+	if err := store.SetSigner(a.keys.signCert); err != nil {
+		log.Println("Error signing certificates", err)
+	}
 	router := mux.NewRouter().StrictSlash(true)
-	for _, route := range routes {
+	for _, route := range a.routes() {
 		var handler http.Handler
 		log.Println("Route: ", route.Name)
 		handler = route.HandlerFunc
+		if route.Auth == authenticated {
+			handler = a.requireAuth(route.Permission, handler)
+		}
 
 		router.
 			Methods(route.Method).
@@ -0,0 +1,141 @@
+package certificates
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+//errors returned when checking a signature
+var (
+	errUnsigned     = errors.New("certificate is not signed")
+	errUnknownKey   = errors.New("signed with an unknown key")
+	errBadSignature = errors.New("signature does not match what was signed")
+)
+
+//certDomain is prepended to every signed certificate, so a signature over a
+//certificate can never pass for one over anything else the server signs
+const certDomain = "certificates-rest-api/certificate/v1\n"
+
+//checkpointDomain is prepended to every signed checkpoint
+const checkpointDomain = "certificates-rest-api/checkpoint/v1\n"
+
+//revocationsDomain is prepended to every signed page of the revocation list
+const revocationsDomain = "certificates-rest-api/revocations/v1\n"
+
+//signedCert is what is signed of a certificate: every field but the
+//signature itself, in this order
+type signedCert struct {
+	ID        string
+	Title     string
+	CreatedAt time.Time
+	OwnerID   string
+	Year      int
+	Note      string
+}
+
+//canonicalCert is the canonical serialization of a certificate: certDomain
+//followed by signedCert as compact JSON, with CreatedAt in UTC. The same
+//certificate always gives the same bytes however it was sent
+func canonicalCert(c certificate) []byte {
+	data, _ := json.Marshal(signedCert{
+		ID:        c.ID,
+		Title:     c.Title,
+		CreatedAt: c.CreatedAt.UTC(),
+		OwnerID:   c.OwnerID,
+		Year:      c.Year,
+		Note:      c.Note,
+	})
+	return append([]byte(certDomain), data...)
+}
+
+//canonicalCheckpoint is what is signed of a checkpoint: checkpointDomain
+//followed by its tree size, root hash and time in RFC 3339 UTC, a line each
+func canonicalCheckpoint(cp checkpoint) []byte {
+	return []byte(fmt.Sprintf("%s%d\n%s\n%s\n", checkpointDomain, cp.TreeSize, cp.RootHash, cp.At.UTC().Format(time.RFC3339Nano)))
+}
+
+//signedRevocations is what is signed of a page of the revocation list
+type signedRevocations struct {
+	Page    int
+	PerPage int
+	Total   int
+	Entries []revokedCert
+	At      time.Time
+}
+
+//canonicalRevocations is revocationsDomain followed by signedRevocations as
+//compact JSON, with every time in UTC
+func canonicalRevocations(l revocationList) []byte {
+	entries := make([]revokedCert, len(l.Entries))
+	for i, entry := range l.Entries {
+		entry.RevokedAt = entry.RevokedAt.UTC()
+		entries[i] = entry
+	}
+	data, _ := json.Marshal(signedRevocations{
+		Page:    l.Page,
+		PerPage: l.PerPage,
+		Total:   l.Total,
+		Entries: entries,
+		At:      l.At.UTC(),
+	})
+	return append([]byte(revocationsDomain), data...)
+}
+
+//signCert returns c signed with the current key, replacing any signature it had
+func (m *KeyManager) signCert(c certificate) certificate {
+	keyID, sig := m.sign(canonicalCert(c))
+	c.KeyID = keyID
+	c.Signature = base64.StdEncoding.EncodeToString(sig)
+	return c
+}
+
+//signCheckpoint returns cp signed with the current key
+func (m *KeyManager) signCheckpoint(cp checkpoint) checkpoint {
+	keyID, sig := m.sign(canonicalCheckpoint(cp))
+	cp.KeyID = keyID
+	cp.Signature = base64.StdEncoding.EncodeToString(sig)
+	return cp
+}
+
+//signRevocations returns a page of the revocation list signed with the current key
+func (m *KeyManager) signRevocations(l revocationList) revocationList {
+	keyID, sig := m.sign(canonicalRevocations(l))
+	l.KeyID = keyID
+	l.Signature = base64.StdEncoding.EncodeToString(sig)
+	return l
+}
+
+//verifyCert checks c was signed by this server, as it is, with a key that
+//has not been revoked
+func (m *KeyManager) verifyCert(c certificate) error {
+	if c.Signature == "" {
+		return errUnsigned
+	}
+	sig, err := base64.StdEncoding.DecodeString(c.Signature)
+	if err != nil {
+		return errBadSignature
+	}
+	return m.verify(c.KeyID, canonicalCert(c), sig)
+}
+
+//keyIDOf names a public key by the start of its SHA-256 hash
+func keyIDOf(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+//newSigningKey generates a random Ed25519 key
+func newSigningKey() ed25519.PrivateKey {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
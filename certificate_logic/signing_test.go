@@ -0,0 +1,43 @@
+package certificates
+
+import (
+	"testing"
+	"time"
+)
+
+//TestCanonicalCert tests the signed form leaves out the signature and the
+//time zone CreatedAt was sent in
+func TestCanonicalCert(t *testing.T) {
+	c := certificate{ID: "c001", Title: "Starry Night", OwnerID: "rr01", Year: 1889,
+		CreatedAt: time.Date(2009, 11, 17, 21, 34, 58, 0, time.FixedZone("CET", 3600))}
+	want := certDomain + `{"ID":"c001","Title":"Starry Night","CreatedAt":"2009-11-17T20:34:58Z","OwnerID":"rr01","Year":1889,"Note":""}`
+	if got := string(canonicalCert(c)); got != want {
+		t.Errorf("Expected canonical form %s. Got %s", want, got)
+	}
+	c.KeyID, c.Signature = "k", "sig"
+	if got := string(canonicalCert(c)); got != want {
+		t.Errorf("Expected signature left out of canonical form. Got %s", got)
+	}
+}
+
+//TestSignedCertVerify tests a signed certificate verifies until any field changes
+func TestSignedCertVerify(t *testing.T) {
+	keys := newKeyManager()
+	c := keys.signCert(certificate{ID: "c001", Title: "Starry Night", OwnerID: "rr01", Year: 1889})
+	if err := keys.verifyCert(c); err != nil {
+		t.Errorf("Expected signed certificate to verify. Got %v", err)
+	}
+
+	altered := c
+	altered.OwnerID = "vvg01"
+	if err := keys.verifyCert(altered); err != errBadSignature {
+		t.Errorf("Expected altered certificate to fail. Got %v", err)
+	}
+	if err := newKeyManager().verifyCert(c); err != errUnknownKey {
+		t.Errorf("Expected certificate signed with another key to fail. Got %v", err)
+	}
+	c.Signature = ""
+	if err := keys.verifyCert(c); err != errUnsigned {
+		t.Errorf("Expected unsigned certificate to fail. Got %v", err)
+	}
+}
@@ -0,0 +1,189 @@
+package certificates
+
+import (
+	"errors"
+	"time"
+)
+
+//errors returned by CertificateStore implementations
+var (
+	errCertNotFound     = errors.New("certificate not found")
+	errCertExists       = errors.New("certificate already exists")
+	errOwnerChange      = errors.New("owner change attempted; must be done by transfer")
+	errNotOwner         = errors.New("user does not own certificate")
+	errTransferNotFound = errors.New("transfer not found")
+	errTransferPending  = errors.New("certificate already has a pending transfer")
+	errTransferClosed   = errors.New("transfer status cannot change")
+	errTransferExpired  = errors.New("transfer has expired")
+	errNotRecipient     = errors.New("transfer not intended for this user")
+	errUserNotFound     = errors.New("user not found")
+	errUserExists       = errors.New("user already exists")
+	errEmailTaken       = errors.New("email already in use")
+	errUserDeactivated  = errors.New("user has been deactivated")
+	errPasswordChanged  = errors.New("password changed in the meantime")
+	errSessionNotFound  = errors.New("session not found")
+	errSessionRevoked   = errors.New("session has been revoked")
+	errRefreshReused    = errors.New("refresh token already used")
+	errKeyNotFound      = errors.New("API key not found")
+	errKeyRevoked       = errors.New("API key has been revoked")
+	errResetInvalid     = errors.New("reset token is unknown, used or expired")
+	errVerifyInvalid    = errors.New("verification token is unknown, used or expired")
+	errEmailVerified    = errors.New("email already verified")
+	errTwoFactorOff     = errors.New("two-factor authentication not enabled")
+	errCodeUsed         = errors.New("one-time code already used")
+	errCheckpointStale  = errors.New("checkpoint does not cover more of the ledger than the last")
+	errCertRevoked      = errors.New("certificate has been revoked")
+)
+
+//CertificateStore is the storage the handlers work against. Swapping the
+//implementation passed to NewRouter changes where certificates, users and
+//pending transfers are kept without touching any of the handlers.
+//Implementations must be safe for concurrent use, and each change checks its
+//preconditions atomically with applying it so two requests racing on the
+//same certificate cannot both succeed
+type CertificateStore interface {
+	//certificates
+	GetCert(id string) (certificate, bool)
+	ListCerts() certCollection
+	ListCertsByOwner(ownerID string) certCollection
+	//CreateCert stores a new certificate and starts its provenance with the
+	//issue to c.OwnerID at c.CreatedAt
+	CreateCert(c certificate) error
+	//UpdateCert replaces a stored certificate, failing with errOwnerChange if
+	//c has a different OwnerID than the stored one or errCertRevoked if the
+	//stored one is revoked
+	UpdateCert(c certificate) error
+	//DeleteCert removes a certificate along with its provenance, provided it
+	//is owned by ownerID; otherwise it fails with errNotOwner. An empty
+	//ownerID deletes whoever the owner is. Revoked certificates are kept,
+	//failing with errCertRevoked
+	DeleteCert(id string, ownerID string) error
+	//RevokeCert marks a certificate revoked for good, failing with
+	//errCertRevoked if it already is
+	RevokeCert(id string, r revocation) error
+	//GetProvenance returns every change of a certificate's owner, oldest first
+	GetProvenance(certID string) ([]ownershipChange, bool)
+	//SetSigner has every certificate signed with sign whenever it is
+	//created or changes, including by a transfer, and signs any stored
+	//without a signature. The signature is stored with the certificate
+	SetSigner(sign func(c certificate) certificate) error
+	//ResignCerts signs every certificate signed with the key keyID again,
+	//or every unsigned one if keyID is empty
+	ResignCerts(keyID string) error
+
+	//ledger
+	//GetLedger returns every event of the ledger, oldest first, along with
+	//the certificates as the last of them left them
+	GetLedger() ([]ledgerEvent, certCollection)
+	//GetEvents returns every event of the ledger, oldest first, without
+	//holding up changes to the certificates
+	GetEvents() []ledgerEvent
+	//GetCertEvents returns the ledger events of a certificate, oldest first
+	GetCertEvents(certID string) []ledgerEvent
+	//AddCheckpoint stores a checkpoint of the ledger, which must cover more
+	//events than the last one and no more than there are; otherwise it
+	//fails with errCheckpointStale
+	AddCheckpoint(cp checkpoint) error
+	//ListCheckpoints returns every checkpoint, oldest first
+	ListCheckpoints() []checkpoint
+	//ListRevocations returns the revocation events of the ledger, oldest first
+	ListRevocations() []ledgerEvent
+
+	//users
+	GetUser(id string) (user, bool)
+	GetUserByEmail(email string) (user, bool)
+	ListUsers() userCollection
+	//CreateUser stores a new user, failing with errUserExists if the ID is
+	//taken or errEmailTaken if another user has the email
+	CreateUser(u user) error
+	//UpdateProfile sets the email and name of an active user. The email must
+	//not belong to another user; otherwise it fails with errEmailTaken. A
+	//new email is unverified
+	UpdateProfile(id string, email string, name string) error
+	//DeactivateUser closes an account for good. The user stays stored and
+	//keeps the email so nobody else can take it over
+	DeactivateUser(id string, at time.Time) error
+	//SetPassword replaces a user's stored password with hash, provided the
+	//stored one is still current; otherwise it fails with errPasswordChanged
+	SetPassword(id string, current string, hash string) error
+	SetRoles(id string, roles []string) error
+
+	//password resets
+	CreateReset(p passwordReset) error
+	GetReset(id string) (passwordReset, bool)
+	//ResetPassword uses up a reset token, provided hash is the hash of its
+	//secret and it is unused at the time given, failing with errResetInvalid
+	//otherwise. The user's password is replaced with password and every
+	//session of theirs is revoked
+	ResetPassword(id string, hash string, password string, at time.Time) error
+
+	//email verification
+	CreateVerification(v verification) error
+	GetVerification(id string) (verification, bool)
+	//VerifyEmail uses up a verification token, provided hash is the hash of
+	//its secret, it is unused at the time given and its email is still the
+	//user's, failing with errVerifyInvalid otherwise. The user's email is
+	//marked verified, or errEmailVerified is returned if it already was
+	VerifyEmail(id string, hash string, at time.Time) error
+
+	//two-factor authentication
+	GetTwoFactor(userID string) (twoFactor, bool)
+	//SetTwoFactor stores a user's authenticator, replacing any they had
+	SetTwoFactor(tf twoFactor) error
+	RemoveTwoFactor(userID string) error
+	//UseTwoFactor records a code was used so it cannot be used again: the
+	//TOTP code of a time step after LastStep, or if recoveryHash is set the
+	//recovery code with that hash. Anything else fails with errCodeUsed
+	UseTwoFactor(userID string, step uint64, recoveryHash string) error
+
+	//sessions
+	CreateSession(s session) error
+	GetSession(id string) (session, bool)
+	//RefreshSession swaps the refresh token hash of a live session, provided
+	//current is still its hash; a stale one fails with errRefreshReused
+	RefreshSession(id string, current string, hash string, expiresAt time.Time) error
+	//RevokeSession ends a session for good
+	RevokeSession(id string, at time.Time) error
+
+	//API keys
+	CreateAPIKey(k apiKey) error
+	GetAPIKey(id string) (apiKey, bool)
+	//ListAPIKeys returns the keys made by a user, oldest first
+	ListAPIKeys(userID string) []apiKey
+	RevokeAPIKey(id string, at time.Time) error
+	//TouchAPIKey records a key was used at the time given
+	TouchAPIKey(id string, at time.Time) error
+
+	//transfers
+	//CreateTransfer stores a new pending transfer of t.CertID, provided the
+	//certificate is owned by t.From, is not revoked and has no other transfer
+	//pending. A pending transfer overdue by t.CreatedAt is expired to make
+	//way for it
+	CreateTransfer(t transfer) error
+	GetTransfer(id string) (transfer, bool)
+	//ListTransfers returns the transfers matching f, oldest first
+	ListTransfers(f transferFilter) transferCollection
+	//GetCurrentTransfer returns the most recent transfer of a certificate, whatever its status
+	GetCurrentTransfer(certID string) (transfer, bool)
+	//AcceptTransfer moves a transfer addressed to email to accepted and hands
+	//its certificate over to newOwnerID, adding to its provenance. A transfer
+	//overdue at the time given fails with errTransferExpired, and one of a
+	//certificate revoked since it was made with errCertRevoked
+	AcceptTransfer(id string, email string, newOwnerID string, at time.Time) error
+	//CloseTransfer moves a transfer to a final status other than accepted.
+	//Illegal transitions fail with errTransferClosed
+	CloseTransfer(id string, status string, at time.Time) error
+}
+
+//transferFilter selects transfers by their fields; empty fields match anything
+type transferFilter struct {
+	Status string
+	From   string //sender user ID
+	To     string //recipient email
+}
+
+func (f transferFilter) matches(t transfer) bool {
+	return (f.Status == "" || f.Status == t.Status) &&
+		(f.From == "" || f.From == t.From) &&
+		(f.To == "" || f.To == t.To)
+}
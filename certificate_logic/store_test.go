@@ -0,0 +1,263 @@
+package certificates
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//newTransfer builds a pending transfer record as createTransfer would
+func newTransfer(certID string, from string, to string) transfer {
+	now := time.Now().UTC()
+	return transfer{
+		ID:        newID("t"),
+		CertID:    certID,
+		From:      from,
+		To:        to,
+		Status:    transferPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+}
+
+//stressStore hammers a store with creates, updates and transfers from many
+//goroutines at once. Run with -race to check the store's locking
+func stressStore(t *testing.T, store CertificateStore) {
+	const workers = 16
+	const certsPerWorker = 25
+
+	var wg sync.WaitGroup
+	var accepted int64
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < certsPerWorker; i++ {
+				id := fmt.Sprintf("s-%d-%d", w, i)
+				c := certificate{ID: id, Title: "Sunflowers", OwnerID: "rr01"}
+				if err := store.CreateCert(c); err != nil {
+					t.Errorf("Create %s: %v", id, err)
+					continue
+				}
+				c.Note = "updated"
+				if err := store.UpdateCert(c); err != nil {
+					t.Errorf("Update %s: %v", id, err)
+				}
+				tr := newTransfer(id, "rr01", "vvg@gmail.com")
+				if err := store.CreateTransfer(tr); err != nil {
+					t.Errorf("Transfer %s: %v", id, err)
+				}
+
+				//two recipients racing to accept the same transfer; exactly one wins
+				var race sync.WaitGroup
+				for r := 0; r < 2; r++ {
+					race.Add(1)
+					go func() {
+						defer race.Done()
+						if store.AcceptTransfer(tr.ID, "vvg@gmail.com", "vvg01", time.Now()) == nil {
+							atomic.AddInt64(&accepted, 1)
+						}
+					}()
+				}
+				race.Wait()
+
+				//the old owner updating after the transfer must not take the cert back
+				if err := store.UpdateCert(c); err != errOwnerChange {
+					t.Errorf("Expected owner change error updating %s. Got %v", id, err)
+				}
+			}
+		}(w)
+	}
+
+	//readers running alongside the writers
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				store.ListCerts()
+				store.ListCertsByOwner("vvg01")
+				store.GetCert("c001")
+			}
+		}()
+	}
+
+	//owners racing over the shared seeded certificate
+	for r := 0; r < workers; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tr := newTransfer("c002", "vvg01", "reshawnramjattan@gmail.com")
+			store.CreateTransfer(tr)
+			if pending, found := store.GetCurrentTransfer("c002"); found {
+				store.AcceptTransfer(pending.ID, "reshawnramjattan@gmail.com", "rr01", time.Now())
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	if accepted != workers*certsPerWorker {
+		t.Errorf("Expected %d accepted transfers. Got %d", workers*certsPerWorker, accepted)
+	}
+	if n := len(store.ListCertsByOwner("vvg01")); n != workers*certsPerWorker {
+		t.Errorf("Expected vvg01 to own %d certificates. Got %d", workers*certsPerWorker, n)
+	}
+	if c, _ := store.GetCert("c002"); c.OwnerID != "rr01" {
+		t.Errorf("Expected c002 to end with rr01. Got %s", c.OwnerID)
+	}
+}
+
+//TestMemoryStoreConcurrent stresses the in-memory store
+func TestMemoryStoreConcurrent(t *testing.T) {
+	stressStore(t, NewMemoryStore())
+}
+
+//TestFileStoreConcurrent stresses the file store, compacting along the way,
+//and checks the log replays to the same state
+func TestFileStoreConcurrent(t *testing.T) {
+	dir := tempDataDir(t)
+	defer os.RemoveAll(dir)
+
+	store, err := openFileStore(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stressStore(t, store)
+
+	reopened, err := openFileStore(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, after := store.ListCerts(), reopened.ListCerts()
+	if len(before) != len(after) {
+		t.Fatalf("Expected %d certificates after reload. Got %d", len(before), len(after))
+	}
+	for i := range before {
+		if before[i] != after[i] {
+			t.Errorf("Expected %+v after reload. Got %+v", before[i], after[i])
+		}
+	}
+}
+
+//TestGetEventsDuringChange checks reading the events does not wait on a
+//change to the certificates going through
+func TestGetEventsDuringChange(t *testing.T) {
+	store := NewMemoryStore().(*memoryStore)
+	store.commitMu.Lock()
+	defer store.commitMu.Unlock()
+
+	done := make(chan []ledgerEvent)
+	go func() { done <- store.GetEvents() }()
+	select {
+	case events := <-done:
+		if len(events) != 2 {
+			t.Errorf("Expected 2 events. Got %d", len(events))
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected the events while a change holds the store")
+	}
+}
+
+//benchmark stores are built once per size as filling one takes a while
+var benchStores = map[int]*memoryStore{}
+
+//benchStore returns a memory store holding n certificates spread over n/10
+//owners and n/10 users
+func benchStore(n int) *memoryStore {
+	if s, found := benchStores[n]; found {
+		return s
+	}
+	certs := make(certCollection, n)
+	for i := range certs {
+		certs[i] = certificate{ID: fmt.Sprintf("b%d", i), OwnerID: fmt.Sprintf("u%d", i%(n/10))}
+	}
+	users := make(userCollection, n/10)
+	for i := range users {
+		users[i] = user{ID: fmt.Sprintf("u%d", i), Email: fmt.Sprintf("u%d@example.com", i)}
+	}
+	s := newMemoryStore(certs, users)
+	benchStores[n] = s
+	return s
+}
+
+//benchSizes compares a small store against one with a million certificates;
+//the lookups below should take about the same time at either size
+var benchSizes = []int{1000, 1000000}
+
+func BenchmarkGetCert(b *testing.B) {
+	for _, n := range benchSizes {
+		s := benchStore(n)
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				s.GetCert(fmt.Sprintf("b%d", i%n))
+			}
+		})
+	}
+}
+
+func BenchmarkListCertsByOwner(b *testing.B) {
+	for _, n := range benchSizes {
+		s := benchStore(n)
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				s.ListCertsByOwner(fmt.Sprintf("u%d", i%(n/10)))
+			}
+		})
+	}
+}
+
+func BenchmarkGetUserByEmail(b *testing.B) {
+	for _, n := range benchSizes {
+		s := benchStore(n)
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				s.GetUserByEmail(fmt.Sprintf("u%d@example.com", i%(n/10)))
+			}
+		})
+	}
+}
+
+//BenchmarkCreateDeleteCert measures a create followed by a delete, which
+//used to splice the whole certificate slice
+func BenchmarkCreateDeleteCert(b *testing.B) {
+	for _, n := range benchSizes {
+		s := benchStore(n)
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				s.CreateCert(certificate{ID: "bench", OwnerID: "u0"})
+				s.DeleteCert("bench", "u0")
+			}
+		})
+	}
+}
+
+//BenchmarkAcceptTransfer measures moving a certificate between owners,
+//which keeps the owner index up to date
+func BenchmarkAcceptTransfer(b *testing.B) {
+	for _, n := range benchSizes {
+		s := benchStore(n)
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			owners := []string{"u0", "u1"}
+			for i := 0; i < b.N; i++ {
+				//b0 starts out with u0 and is passed back and forth
+				from, to := owners[i%2], owners[(i+1)%2]
+				tr := transfer{ID: fmt.Sprint(i), CertID: "b0", From: from, To: to + "@example.com", Status: transferPending}
+				s.CreateTransfer(tr)
+				s.AcceptTransfer(tr.ID, tr.To, to, tr.CreatedAt)
+			}
+		})
+	}
+}
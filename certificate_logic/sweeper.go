@@ -0,0 +1,44 @@
+package certificates
+
+import (
+	"log"
+	"time"
+)
+
+//expireTransfers marks every pending transfer that is past its expiry time
+//as expired and returns how many it changed
+func expireTransfers(store CertificateStore, now time.Time) int {
+	expired := 0
+	for _, t := range store.ListTransfers(transferFilter{Status: transferPending}) {
+		if !t.overdue(now) {
+			continue
+		}
+		//a transfer handled since it was listed is left as it is
+		if err := store.CloseTransfer(t.ID, transferExpired, now); err == nil {
+			expired++
+		}
+	}
+	return expired
+}
+
+//StartTransferSweeper expires overdue transfers in the background, checking
+//every interval with the time told by now. Call the function it returns to
+//stop it
+func StartTransferSweeper(store CertificateStore, interval time.Duration, now func() time.Time) func() {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if n := expireTransfers(store, now().UTC()); n > 0 {
+					log.Println("Expired transfers:", n)
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
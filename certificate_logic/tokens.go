@@ -0,0 +1,106 @@
+package certificates
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+//errors from reading a bearer or refresh token
+var (
+	errTokenInvalid = errors.New("token is malformed or its signature does not match")
+	errTokenExpired = errors.New("token has expired")
+)
+
+//Access tokens are JWTs signed with Ed25519 (EdDSA) by the key manager,
+//their header naming the key. They carry the user and the session they were
+//issued for, and are good until exp unless the session is revoked first
+type accessClaims struct {
+	Subject   string `json:"sub"` //user ID
+	SessionID string `json:"sid"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+//tokenHeader is the JOSE header of an access token
+type tokenHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+//signToken encodes claims as a JWT signed with the current key
+func signToken(keys *KeyManager, c accessClaims) string {
+	k := keys.current()
+	header, _ := json.Marshal(tokenHeader{"EdDSA", "JWT", k.ID})
+	payload, _ := json.Marshal(c)
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(k.Private, []byte(unsigned)))
+}
+
+//parseToken checks a JWT was signed with a key of the manager that is not
+//revoked and has not expired at the time given, returning its claims
+func parseToken(keys *KeyManager, token string, at time.Time) (accessClaims, error) {
+	var c accessClaims
+	var h tokenHeader
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return c, errTokenInvalid
+	}
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(header, &h) != nil || h.Algorithm != "EdDSA" || h.Type != "JWT" {
+		return c, errTokenInvalid
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || keys.verify(h.KeyID, []byte(parts[0]+"."+parts[1]), sig) != nil {
+		return c, errTokenInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(payload, &c) != nil {
+		return c, errTokenInvalid
+	}
+	if at.Unix() >= c.ExpiresAt {
+		return c, errTokenExpired
+	}
+	return c, nil
+}
+
+//Refresh tokens and API keys are opaque: the ID of the session or key and a
+//random secret, joined by a dot. Only a hash of the secret is stored, so a
+//copy of the store cannot be used to log in
+
+//newOpaqueToken returns a fresh token for the session or key id along with
+//the hash to store for it
+func newOpaqueToken(id string) (token string, hash string) {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	encoded := base64.RawURLEncoding.EncodeToString(secret)
+	return id + "." + encoded, secretHash(encoded)
+}
+
+//splitOpaqueToken returns the session or key a token belongs to and the
+//hash of its secret
+func splitOpaqueToken(token string) (id string, hash string, ok bool) {
+	i := strings.LastIndex(token, ".")
+	if i <= 0 || i == len(token)-1 {
+		return "", "", false
+	}
+	return token[:i], secretHash(token[i+1:]), true
+}
+
+func secretHash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+//sameHash compares two secret hashes in constant time
+func sameHash(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
@@ -0,0 +1,120 @@
+package certificates
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//One-time codes follow RFC 6238 (TOTP) with the parameters every common
+//authenticator app uses: HMAC-SHA1, 30 second steps and 6 digits
+const (
+	totpStep   = 30 * time.Second
+	totpDigits = 6
+	//steps either side of the current one that are accepted, for clocks
+	//that have drifted and codes typed in as they change
+	totpSkew = 1
+	//issuer shown next to the account in authenticator apps
+	totpIssuer = "Certificates"
+)
+
+//secrets are shown base32 encoded without padding, as authenticator apps expect
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+//newTOTPSecret returns a random 160 bit secret, base32 encoded
+func newTOTPSecret() string {
+	secret := make([]byte, 20)
+	rand.Read(secret)
+	return totpEncoding.EncodeToString(secret)
+}
+
+//totpCode returns the code for a time step, computed as in RFC 4226 (HOTP)
+func totpCode(secret []byte, step uint64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, step)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	//dynamic truncation picks 31 bits at an offset given by the last nibble
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+//totpStepAt returns the time step a moment falls in
+func totpStepAt(at time.Time) uint64 {
+	return uint64(at.Unix() / int64(totpStep/time.Second))
+}
+
+//checkTOTP reports whether code is valid for a base32 secret at the time
+//given, returning the time step it belongs to
+func checkTOTP(secret string, code string, at time.Time) (uint64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	now := totpStepAt(at)
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+//totpURI returns the otpauth URI authenticator apps read, usually from a QR code
+func totpURI(account string, secret string) string {
+	u := url.URL{
+		Scheme: "otpauth",
+		Host:   "totp",
+		Path:   "/" + totpIssuer + ":" + account,
+	}
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", totpIssuer)
+	q.Set("digits", fmt.Sprint(totpDigits))
+	q.Set("period", fmt.Sprint(int(totpStep/time.Second)))
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+//number of recovery codes handed out when two-factor authentication is enabled
+const recoveryCodeCount = 10
+
+//recovery codes are 10 lowercase base32 characters, written in two groups
+var recoveryEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+//newRecoveryCodes returns fresh recovery codes along with the hashes to store
+func newRecoveryCodes() (codes []string, hashes []string) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 6)
+		rand.Read(b)
+		code := recoveryEncoding.EncodeToString(b)
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, secretHash(code))
+	}
+	return codes, hashes
+}
+
+//recoveryCodeHash returns the hash of a recovery code as typed, ignoring case,
+//spaces and dashes, or false if it cannot be one
+func recoveryCodeHash(code string) (string, bool) {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	if len(code) != 10 {
+		return "", false
+	}
+	if _, err := recoveryEncoding.DecodeString(code); err != nil {
+		return "", false
+	}
+	return secretHash(code), true
+}
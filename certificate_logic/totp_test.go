@@ -0,0 +1,66 @@
+package certificates
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+//TestTOTPCode tests codes against the SHA1 test vectors of RFC 6238,
+//truncated to 6 digits
+func TestTOTPCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	vectors := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+	for unix, want := range vectors {
+		if code := totpCode(secret, totpStepAt(time.Unix(unix, 0))); code != want {
+			t.Errorf("Expected code %s at %d. Got %s", want, unix, code)
+		}
+	}
+}
+
+//TestCheckTOTP tests codes are accepted one step either side of now and no further
+func TestCheckTOTP(t *testing.T) {
+	secret := newTOTPSecret()
+	key, _ := totpEncoding.DecodeString(secret)
+	now := time.Unix(1111111109, 0)
+	step := totpStepAt(now)
+
+	for _, s := range []uint64{step - 1, step, step + 1} {
+		if got, ok := checkTOTP(secret, totpCode(key, s), now); !ok || got != s {
+			t.Errorf("Expected code of step %d to be accepted. Got %d, %v", s, got, ok)
+		}
+	}
+	for _, s := range []uint64{step - 2, step + 2} {
+		if _, ok := checkTOTP(secret, totpCode(key, s), now); ok {
+			t.Errorf("Expected code of step %d to be refused", s)
+		}
+	}
+	if _, ok := checkTOTP(secret, "12345", now); ok {
+		t.Errorf("Expected a short code to be refused")
+	}
+}
+
+//TestRecoveryCodes tests recovery codes hash to what is stored however they are typed
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes := newRecoveryCodes()
+	if len(codes) != recoveryCodeCount || len(hashes) != recoveryCodeCount {
+		t.Fatalf("Expected %d codes. Got %d", recoveryCodeCount, len(codes))
+	}
+	for i, code := range codes {
+		for _, typed := range []string{code, strings.ToUpper(code), strings.Replace(code, "-", " ", 1)} {
+			if hash, ok := recoveryCodeHash(typed); !ok || hash != hashes[i] {
+				t.Errorf("Expected '%s' to match recovery code %s", typed, code)
+			}
+		}
+	}
+	if _, ok := recoveryCodeHash("123456"); ok {
+		t.Errorf("Expected a TOTP code not to pass as a recovery code")
+	}
+}
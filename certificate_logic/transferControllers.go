@@ -2,6 +2,7 @@ package certificates
 
 import (
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -9,35 +10,82 @@ import (
 	"github.com/gorilla/mux"
 )
 
+//body of a successful response to each transfer action
+var transferResponses = map[string]string{
+	transferAccepted:  "Transfer Accepted",
+	transferRejected:  "Transfer Rejected",
+	transferCancelled: "Transfer Cancelled",
+}
+
+//returned when someone other than the sender tries to cancel a transfer
+var errNotSender = errors.New("transfer not created by this user")
+
 //Data altering functions
 // ~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
 
-//find certificate to be transferred
-//check if authed user is the owner of the certificate
-// returns a status code where 1: success, 2: user != owner, 3: cert not found
-func addTransferToCert(id string, newTrans transfer, user user) int {
-	for i, element := range certs {
-		if element.ID == id {
-			if element.OwnerID == user.ID { //this user owns the cert
-				certs[i].Transfer = newTrans //element != pointer to object in certs
-				unacceptedTransfers = append(unacceptedTransfers, &certs[i])
-				return 1
-			}
-			return 2
-
-		}
+//record a new pending transfer of certificate id from the authed user
+//to the email in newTrans; the store checks the user owns the certificate.
+//The transfer expires at newTrans.ExpiresAt, or after the default time to live
+// returns the stored transfer and a status code where 1: success,
+// 2: user != owner, 3: cert not found, 4: a transfer is already pending,
+// 5: expiry not in the future, 6: recipient account is deactivated,
+// 7: cert is revoked
+func (a *api) addTransferToCert(id string, newTrans transfer, user user) (transfer, int) {
+	now := a.now().UTC()
+	t := transfer{
+		ID:        newID("t"),
+		CertID:    id,
+		From:      user.ID,
+		To:        newTrans.To,
+		Status:    transferPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+		ExpiresAt: newTrans.ExpiresAt.UTC(),
+	}
+	if newTrans.ExpiresAt.IsZero() && a.transferTTL > 0 {
+		t.ExpiresAt = now.Add(a.transferTTL)
+	}
+	if t.overdue(now) {
+		return t, 5
 	}
-	return 3
+	//an email with no account yet can still receive, a closed account cannot
+	if recipient, found := a.store.GetUserByEmail(t.To); found && !recipient.active() {
+		return t, 6
+	}
+	switch a.store.CreateTransfer(t) {
+	case nil:
+		return t, 1
+	case errNotOwner: //this user does not own the cert
+		return t, 2
+	case errTransferPending:
+		return t, 4
+	case errCertRevoked:
+		return t, 7
+	}
+	return t, 3
 }
 
 //check password of user passed, return user object along with auth status
-func authenticate(id string, pass string) (user, bool) {
-	for _, u := range users {
-		if id == u.ID && pass == u.password {
-			return u, true
+//a plaintext password left from before hashing is replaced with its hash.
+//Deactivated users never authenticate
+func (a *api) authenticate(id string, pass string) (user, bool) {
+	u, found := a.store.GetUser(id)
+	if !found {
+		//take as long as a wrong password would
+		checkPassword(dummyPasswordHash, pass)
+		return user{}, false
+	}
+	ok, legacy := checkPassword(u.password, pass)
+	if !ok || !u.active() {
+		return user{}, false
+	}
+	if legacy {
+		//losing to a concurrent password change is fine, it hashes the new one
+		if err := a.store.SetPassword(u.ID, u.password, hashPassword(pass)); err != nil && err != errPasswordChanged {
+			log.Println("Error hashing legacy password", err)
 		}
 	}
-	return user{}, false
+	return u, true
 
 }
 
@@ -45,7 +93,7 @@ func authenticate(id string, pass string) (user, bool) {
 // ~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
 
 //create transfer from data sent in request
-func createTransfer(w http.ResponseWriter, r *http.Request) {
+func (a *api) createTransfer(w http.ResponseWriter, r *http.Request) {
 	var newTrans transfer
 
 	vars := mux.Vars(r)
@@ -75,23 +123,14 @@ func createTransfer(w http.ResponseWriter, r *http.Request) {
 
 	log.Println("New transfer:", newTrans)
 
-	//auth user
-	ownerID, pass, _ := r.BasicAuth()
-	user, valid := authenticate(ownerID, pass)
-	if !valid {
-		log.Println("Unauthorized")
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("401: Incorrect user credentials"))
-		return
-	}
+	//user authed by the middleware
+	user := currentUser(r)
 
 	//execute transfer
-	createTransferStatus := addTransferToCert(id, newTrans, user)
+	createdTrans, createTransferStatus := a.addTransferToCert(id, newTrans, user)
 	//if user does not own cert
 	if createTransferStatus == 2 {
-		log.Println("Unauthorized")
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("401: Unauthorized to create transfer, user does not own certificate"))
+		forbid(w, "Certificate belongs to another user")
 		return
 	}
 	//if cert not found
@@ -101,55 +140,144 @@ func createTransfer(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("404: Certificate not found"))
 		return
 	}
+	//if an earlier transfer has not been handled yet
+	if createTransferStatus == 4 {
+		log.Println("Transfer already pending")
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("409: Certificate already has a pending transfer"))
+		return
+	}
+	//if the requested expiry has already passed
+	if createTransferStatus == 5 {
+		log.Println("Transfer expiry in the past")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Error creating transfer, ExpiresAt must be in the future"))
+		return
+	}
+	//if the recipient has closed their account
+	if createTransferStatus == 6 {
+		log.Println("Transfer recipient deactivated")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Error creating transfer, recipient account is deactivated"))
+		return
+	}
+	//if the cert has been revoked
+	if createTransferStatus == 7 {
+		log.Println("Certificate is revoked")
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("409: Certificate has been revoked"))
+		return
+	}
 
 	//create and write http response
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusCreated)
-	createdData, _ := json.Marshal(newTrans)
+	createdData, _ := json.Marshal(createdTrans)
 	w.Write(createdData)
 	return
 
 }
 
-func acceptTransfer(w http.ResponseWriter, r *http.Request) {
+//accept the transfer of a certificate; only the recipient may
+func (a *api) acceptTransfer(w http.ResponseWriter, r *http.Request) {
+	a.respondToTransfer(w, r, transferAccepted)
+}
+
+//reject the transfer of a certificate; only the recipient may
+func (a *api) rejectTransfer(w http.ResponseWriter, r *http.Request) {
+	a.respondToTransfer(w, r, transferRejected)
+}
+
+//cancel the transfer of a certificate; only the sender may
+func (a *api) cancelTransfer(w http.ResponseWriter, r *http.Request) {
+	a.respondToTransfer(w, r, transferCancelled)
+}
+
+//respondToTransfer moves the current transfer of the certificate in the
+//request to status on behalf of the authed user
+func (a *api) respondToTransfer(w http.ResponseWriter, r *http.Request, status string) {
 	vars := mux.Vars(r)
 	//log.Println(vars)
 	id := vars["id"] // id of certificate to be transferred
-	log.Println("Attempt to accept Transfer for cert ", id)
-
-	ownerID, pass, _ := r.BasicAuth()
-	user, valid := authenticate(ownerID, pass)
-	if !valid {
-		log.Println("Unauthorized")
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("401: Incorrect user credentials"))
-		return
-	}
-
-	//find transfer, ensure receiving user is this user, update status
-	for index, element := range unacceptedTransfers {
-		if element.ID == id {
-			if element.Transfer.To == user.Email {
-				unacceptedTransfers[index].Transfer.Status = "Accepted"
-				unacceptedTransfers[index].OwnerID = user.ID
-				unacceptedTransfers = append(unacceptedTransfers[:index], unacceptedTransfers[index+1:]...)
-
-				//create and write http response
-				w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-				w.Header().Set("Access-Control-Allow-Origin", "*")
-				w.WriteHeader(http.StatusOK)
-				w.Write([]byte("Transfer Accepted"))
-				return
-			}
-			log.Println("Unauthorized")
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte("401: Transfer not intended for this user"))
-			return
-		}
+	log.Println("Attempt to move Transfer for cert ", id, "to", status)
+
+	user := currentUser(r)
+	//the recipient is whoever holds the email, which they must have proved
+	if status != transferCancelled && !user.emailVerified() {
+		forbid(w, "Verify the email of the account before accepting or rejecting transfers")
+		return
+	}
+
+	//find transfer, ensure this user is allowed to act on it, update status
+	current, found := a.store.GetCurrentTransfer(id)
+	if !found {
+		log.Println("Transfer not found")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404: Transfer not found"))
+		return
+	}
+
+	var err error
+	now := a.now().UTC()
+	switch {
+	case status == transferAccepted:
+		err = a.store.AcceptTransfer(current.ID, user.Email, user.ID, now)
+	case status == transferRejected && current.To != user.Email:
+		err = errNotRecipient
+	case status == transferCancelled && current.From != user.ID:
+		err = errNotSender
+	default:
+		err = a.store.CloseTransfer(current.ID, status, now)
 	}
 
-	log.Println("Transfer not found")
-	w.WriteHeader(http.StatusNotFound)
-	w.Write([]byte("404: Transfer not found"))
+	switch err {
+	case nil:
+	case errNotRecipient:
+		forbid(w, "Transfer not intended for this user")
+		return
+	case errNotSender:
+		forbid(w, "Transfer not created by this user")
+		return
+	case errTransferExpired:
+		//the sweeper has not got to it yet
+		a.store.CloseTransfer(current.ID, transferExpired, now)
+		log.Println("Transfer has expired")
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("409: Transfer is already expired"))
+		return
+	case errTransferClosed:
+		//report the status that got in the way
+		current, _ = a.store.GetTransfer(current.ID)
+		log.Println("Transfer is already", current.Status)
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("409: Transfer is already " + current.Status))
+		return
+	case errCertRevoked:
+		log.Println("Certificate is revoked")
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("409: Certificate has been revoked"))
+		return
+	case errTransferNotFound:
+		log.Println("Transfer not found")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404: Transfer not found"))
+		return
+	case errCertNotFound:
+		log.Println("Certificate not found")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404: Certificate not found"))
+		return
+	default:
+		log.Println("Error updating transfer", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Error updating transfer"))
+		return
+	}
+
+	//create and write http response
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(transferResponses[status]))
 	return
 }
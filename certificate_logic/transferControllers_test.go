@@ -2,8 +2,13 @@ package certificates
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 )
 
 //router, executeRequest and checkResponseCode are defined in certControllers_test.go
@@ -20,8 +25,9 @@ func TestCreateTransfer(t *testing.T) {
 
 	checkResponseCode(t, http.StatusCreated, response.Code)
 
-	if certs[0].Transfer.Status != "pending" {
-		t.Errorf("Expected certificate transfer to be pending. Got '%v'", certs[0].Transfer.Status)
+	pending, found := testStore.GetCurrentTransfer("c001")
+	if !found || pending.Status != "pending" {
+		t.Errorf("Expected certificate transfer to be pending. Got '%v'", pending.Status)
 	}
 
 }
@@ -58,7 +64,7 @@ func TestCreateTransferNotMine(t *testing.T) {
 	req.SetBasicAuth("vvg01", "vwh39043f")
 	response := executeRequest(req)
 
-	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+	checkResponseCode(t, http.StatusForbidden, response.Code)
 
 }
 
@@ -76,8 +82,8 @@ func TestAcceptTransfer(t *testing.T) {
 
 	checkResponseCode(t, http.StatusOK, response.Code)
 
-	if certs[0].OwnerID != "vvg01" {
-		t.Errorf("Expected certificate owner to be changed. Got '%v'", certs[0].OwnerID)
+	if owner := storedCert(t, "c001").OwnerID; owner != "vvg01" {
+		t.Errorf("Expected certificate owner to be changed. Got '%v'", owner)
 	}
 
 }
@@ -108,6 +114,21 @@ func TestAcceptTransferNonExist(t *testing.T) {
 
 }
 
+//TestAcceptTransferStoreFailure test a transfer the store fails to log is
+//reported as a server error, not as a missing transfer
+func TestAcceptTransferStoreFailure(t *testing.T) {
+	store := newSeededStore()
+	r := NewRouter(store)
+	checkResponseCode(t, http.StatusCreated, transferAction(r, "create", "rr01", "rrejh3294").Code)
+	store.journal = func(e logEntry) error { return errors.New("disk full") }
+
+	checkResponseCode(t, http.StatusInternalServerError, transferAction(r, "accept", "vvg01", "vwh39043f").Code)
+	checkResponseCode(t, http.StatusInternalServerError, transferAction(r, "reject", "vvg01", "vwh39043f").Code)
+	if owner := store.certs["c001"].cert.OwnerID; owner != "rr01" {
+		t.Errorf("Expected certificate owner to be unchanged. Got '%v'", owner)
+	}
+}
+
 //TestAcceptTransferNotYours test attempting to accept transfer not intended for auth user
 func TestAcceptTransferNotYours(t *testing.T) {
 	testtrans := []byte(`{"To": "vvg@gmail.com","Status": "pending"}`)
@@ -120,10 +141,268 @@ func TestAcceptTransferNotYours(t *testing.T) {
 	req.SetBasicAuth("rr01", "rrejh3294")
 	response = executeRequest(req)
 
-	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+	checkResponseCode(t, http.StatusForbidden, response.Code)
 
-	if body := response.Body.String(); body != "401: Transfer not intended for this user" {
+	if body := response.Body.String(); body != "403: Transfer not intended for this user" {
 		t.Errorf("Expected transfer not for this user error. Got %s", body)
 	}
 
 }
+
+//TestAcceptTransferAfterReshuffle test accepting a transfer after other certificates were
+//created and deleted still hands over the certificate it was made for
+func TestAcceptTransferAfterReshuffle(t *testing.T) {
+	store := NewMemoryStore()
+	r := NewRouter(store)
+	send := func(req *http.Request) *httptest.ResponseRecorder { return executeOn(r, req) }
+
+	req, _ := http.NewRequest("POST", "/certificates/c001/transfers/create", bytes.NewBufferString(`{"To": "vvg@gmail.com"}`))
+	req.SetBasicAuth("rr01", "rrejh3294")
+	response := send(req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var created transfer
+	json.Unmarshal(response.Body.Bytes(), &created)
+	if created.ID == "" || created.CertID != "c001" || created.From != "rr01" || created.Status != "pending" {
+		t.Errorf("Expected a pending transfer record for c001. Got %+v", created)
+	}
+
+	for _, id := range []string{"c003", "c004", "c005"} {
+		req, _ = http.NewRequest("POST", "/certificates/create", bytes.NewBufferString(`{"ID": "`+id+`"}`))
+		req.SetBasicAuth("rr01", "rrejh3294")
+		send(req)
+	}
+	req, _ = http.NewRequest("DELETE", "/certificates/c002/delete", nil)
+	req.SetBasicAuth("rr01", "rrejh3294")
+	send(req)
+
+	req, _ = http.NewRequest("PUT", "/certificates/c001/transfers/accept", nil)
+	req.SetBasicAuth("vvg01", "vwh39043f")
+	response = send(req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	if c, _ := store.GetCert("c001"); c.OwnerID != "vvg01" {
+		t.Errorf("Expected c001 to be handed over. Got owner '%v'", c.OwnerID)
+	}
+	for _, id := range []string{"c003", "c004", "c005"} {
+		if c, _ := store.GetCert(id); c.OwnerID != "rr01" {
+			t.Errorf("Expected %s to stay with rr01. Got '%v'", id, c.OwnerID)
+		}
+	}
+	if accepted, _ := store.GetTransfer(created.ID); accepted.Status != "accepted" {
+		t.Errorf("Expected transfer record to be accepted. Got '%v'", accepted.Status)
+	}
+}
+
+//TestCreateTransferAlreadyPending test a second transfer cannot be opened while one is pending
+func TestCreateTransferAlreadyPending(t *testing.T) {
+	r := NewRouter(NewMemoryStore())
+	for _, expected := range []int{http.StatusCreated, http.StatusConflict} {
+		req, _ := http.NewRequest("POST", "/certificates/c001/transfers/create", bytes.NewBufferString(`{"To": "vvg@gmail.com"}`))
+		req.SetBasicAuth("rr01", "rrejh3294")
+		checkResponseCode(t, expected, executeOn(r, req).Code)
+	}
+}
+
+//transferAction sends a transfer request for c001 on its own router as the given user
+func transferAction(r http.Handler, action string, userID string, pass string) *httptest.ResponseRecorder {
+	method, body := "PUT", ""
+	if action == "create" {
+		method, body = "POST", `{"To": "vvg@gmail.com", "Status": "accepted"}`
+	}
+	req, _ := http.NewRequest(method, "/certificates/c001/transfers/"+action, bytes.NewBufferString(body))
+	req.SetBasicAuth(userID, pass)
+	return executeOn(r, req)
+}
+
+//TestTransferStatusServerControlled test a status sent by the client is ignored
+func TestTransferStatusServerControlled(t *testing.T) {
+	store := NewMemoryStore()
+	response := transferAction(NewRouter(store), "create", "rr01", "rrejh3294")
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	if current, _ := store.GetCurrentTransfer("c001"); current.Status != "pending" {
+		t.Errorf("Expected new transfer to be pending. Got '%v'", current.Status)
+	}
+	if c, _ := store.GetCert("c001"); c.OwnerID != "rr01" {
+		t.Errorf("Expected owner to be unchanged. Got '%v'", c.OwnerID)
+	}
+}
+
+//TestRejectTransfer test the recipient rejecting a transfer
+func TestRejectTransfer(t *testing.T) {
+	store := NewMemoryStore()
+	r := NewRouter(store)
+	transferAction(r, "create", "rr01", "rrejh3294")
+
+	//only the recipient may reject
+	checkResponseCode(t, http.StatusForbidden, transferAction(r, "reject", "rr01", "rrejh3294").Code)
+	checkResponseCode(t, http.StatusOK, transferAction(r, "reject", "vvg01", "vwh39043f").Code)
+
+	if current, _ := store.GetCurrentTransfer("c001"); current.Status != "rejected" {
+		t.Errorf("Expected transfer to be rejected. Got '%v'", current.Status)
+	}
+	if c, _ := store.GetCert("c001"); c.OwnerID != "rr01" {
+		t.Errorf("Expected owner to be unchanged. Got '%v'", c.OwnerID)
+	}
+
+	//the owner can start over once the transfer is rejected
+	checkResponseCode(t, http.StatusCreated, transferAction(r, "create", "rr01", "rrejh3294").Code)
+}
+
+//TestCancelTransfer test the sender cancelling a transfer
+func TestCancelTransfer(t *testing.T) {
+	store := NewMemoryStore()
+	r := NewRouter(store)
+	transferAction(r, "create", "rr01", "rrejh3294")
+
+	//only the sender may cancel
+	checkResponseCode(t, http.StatusForbidden, transferAction(r, "cancel", "vvg01", "vwh39043f").Code)
+	checkResponseCode(t, http.StatusOK, transferAction(r, "cancel", "rr01", "rrejh3294").Code)
+
+	if current, _ := store.GetCurrentTransfer("c001"); current.Status != "cancelled" {
+		t.Errorf("Expected transfer to be cancelled. Got '%v'", current.Status)
+	}
+}
+
+//TestIllegalTransferTransitions test acting on a transfer that is no longer pending
+func TestIllegalTransferTransitions(t *testing.T) {
+	r := NewRouter(NewMemoryStore())
+	transferAction(r, "create", "rr01", "rrejh3294")
+	transferAction(r, "cancel", "rr01", "rrejh3294")
+
+	response := transferAction(r, "accept", "vvg01", "vwh39043f")
+	checkResponseCode(t, http.StatusConflict, response.Code)
+	if body := response.Body.String(); body != "409: Transfer is already cancelled" {
+		t.Errorf("Expected transfer already cancelled error. Got %s", body)
+	}
+	checkResponseCode(t, http.StatusConflict, transferAction(r, "reject", "vvg01", "vwh39043f").Code)
+	checkResponseCode(t, http.StatusConflict, transferAction(r, "cancel", "rr01", "rrejh3294").Code)
+
+	//an accepted transfer is final too
+	transferAction(r, "create", "rr01", "rrejh3294")
+	checkResponseCode(t, http.StatusOK, transferAction(r, "accept", "vvg01", "vwh39043f").Code)
+	checkResponseCode(t, http.StatusConflict, transferAction(r, "accept", "vvg01", "vwh39043f").Code)
+	checkResponseCode(t, http.StatusConflict, transferAction(r, "cancel", "rr01", "rrejh3294").Code)
+}
+
+//testClock is a clock the tests move forward by hand
+type testClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func newTestClock() *testClock {
+	return &testClock{t: time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.t = c.t.Add(d)
+	c.mu.Unlock()
+}
+
+//TestTransferDefaultExpiry test a transfer without an expiry gets the server default
+//and cannot be accepted once it has passed
+func TestTransferDefaultExpiry(t *testing.T) {
+	clock := newTestClock()
+	store := NewMemoryStore()
+	r := NewRouter(store, WithClock(clock.Now), WithTransferTTL(time.Hour))
+	transferAction(r, "create", "rr01", "rrejh3294")
+
+	current, _ := store.GetCurrentTransfer("c001")
+	if !current.ExpiresAt.Equal(clock.Now().Add(time.Hour)) {
+		t.Errorf("Expected transfer to expire in an hour. Got %v", current.ExpiresAt)
+	}
+
+	clock.Advance(time.Hour)
+	response := transferAction(r, "accept", "vvg01", "vwh39043f")
+	checkResponseCode(t, http.StatusConflict, response.Code)
+	if body := response.Body.String(); body != "409: Transfer is already expired" {
+		t.Errorf("Expected transfer expired error. Got %s", body)
+	}
+	if current, _ = store.GetCurrentTransfer("c001"); current.Status != "expired" {
+		t.Errorf("Expected transfer to be marked expired. Got '%v'", current.Status)
+	}
+	if c, _ := store.GetCert("c001"); c.OwnerID != "rr01" {
+		t.Errorf("Expected owner to be unchanged. Got '%v'", c.OwnerID)
+	}
+}
+
+//TestTransferRequestedExpiry test a client chosen expiry, which must be in the future
+func TestTransferRequestedExpiry(t *testing.T) {
+	clock := newTestClock()
+	store := NewMemoryStore()
+	r := NewRouter(store, WithClock(clock.Now))
+
+	for expiry, expected := range map[string]int{
+		"2018-06-01T11:00:00Z": http.StatusBadRequest,
+		"2018-06-03T12:00:00Z": http.StatusCreated,
+	} {
+		req, _ := http.NewRequest("POST", "/certificates/c001/transfers/create", bytes.NewBufferString(`{"To": "vvg@gmail.com", "ExpiresAt": "`+expiry+`"}`))
+		req.SetBasicAuth("rr01", "rrejh3294")
+		checkResponseCode(t, expected, executeOn(r, req).Code)
+	}
+
+	//an overdue transfer no longer blocks a new one
+	clock.Advance(72 * time.Hour)
+	checkResponseCode(t, http.StatusCreated, transferAction(r, "create", "rr01", "rrejh3294").Code)
+	if n := len(store.ListTransfers(transferFilter{Status: transferExpired})); n != 1 {
+		t.Errorf("Expected the overdue transfer to be expired. Got %d expired", n)
+	}
+}
+
+//TestTransferSweeper test the background sweeper expires overdue transfers
+func TestTransferSweeper(t *testing.T) {
+	clock := newTestClock()
+	store := NewMemoryStore()
+	r := NewRouter(store, WithClock(clock.Now), WithTransferTTL(time.Hour))
+	transferAction(r, "create", "rr01", "rrejh3294")
+
+	if n := expireTransfers(store, clock.Now()); n != 0 {
+		t.Errorf("Expected nothing to expire yet. Got %d", n)
+	}
+
+	clock.Advance(2 * time.Hour)
+	stop := StartTransferSweeper(store, time.Millisecond, clock.Now)
+	defer stop()
+	for i := 0; i < 1000; i++ {
+		if current, _ := store.GetCurrentTransfer("c001"); current.Status == "expired" {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Errorf("Expected sweeper to expire the transfer")
+}
+
+//TestLegacyPasswordUpgrade test a plaintext password is hashed on first login
+func TestLegacyPasswordUpgrade(t *testing.T) {
+	store := NewMemoryStore()
+	a := &api{store: store}
+
+	if _, ok := a.authenticate("rr01", "wrong"); ok {
+		t.Errorf("Expected wrong password to be refused")
+	}
+	if u, _ := store.GetUser("rr01"); u.password != "rrejh3294" {
+		t.Errorf("Expected failed login to leave the password alone")
+	}
+	if _, ok := a.authenticate("rr01", "rrejh3294"); !ok {
+		t.Fatalf("Expected plaintext password to be accepted")
+	}
+	u, _ := store.GetUser("rr01")
+	if ok, legacy := checkPassword(u.password, "rrejh3294"); !ok || legacy {
+		t.Errorf("Expected password to be hashed after login. Got '%s'", u.password)
+	}
+	if _, ok := a.authenticate("rr01", "rrejh3294"); !ok {
+		t.Errorf("Expected hashed password to be accepted")
+	}
+	if _, ok := a.authenticate("nobody", "rrejh3294"); ok {
+		t.Errorf("Expected unknown user to be refused")
+	}
+}
@@ -0,0 +1,212 @@
+package certificates
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+)
+
+//otpHeader carries a one-time code, or a recovery code, on requests that
+//need one from users with two-factor authentication
+const otpHeader = "X-OTP"
+
+//errCodeInvalid is returned for a one-time code that is wrong or already used
+var errCodeInvalid = errors.New("one-time code is wrong or already used")
+
+//enrolment is returned when a user starts enrolling an authenticator
+type enrolment struct {
+	Secret string
+	URI    string //otpauth URI, for a QR code
+}
+
+//codeRequest is the body of a request confirming an enrolment
+type codeRequest struct {
+	Code string
+}
+
+//recoveryCodes are returned once, when two-factor authentication is enabled
+type recoveryCodes struct {
+	RecoveryCodes []string
+}
+
+//codeGuardKey is what wrong one-time codes of a user are counted under. It
+//is kept apart from the user ID since the password that comes with each
+//code would otherwise clear the count
+func codeGuardKey(userID string) string {
+	return "2fa:" + userID
+}
+
+//checkOneTimeCode checks a TOTP code or recovery code of a user and uses it
+//up. Wrong codes lock the user out as wrong passwords do, and count towards
+//the lockout of the client. While either is locked out it fails with a
+//lockedError without looking at the code
+func (a *api) checkOneTimeCode(r *http.Request, userID string, code string) error {
+	ip := clientIP(r)
+	key := codeGuardKey(userID)
+	if wait := a.guard.lockedFor(key, ip, a.now()); wait > 0 {
+		return lockedError{wait}
+	}
+	tf, _ := a.store.GetTwoFactor(userID)
+	err := errCodeInvalid
+	if step, ok := checkTOTP(tf.Secret, code, a.now()); ok {
+		err = a.store.UseTwoFactor(userID, step, "")
+	} else if hash, ok := recoveryCodeHash(code); ok {
+		err = a.store.UseTwoFactor(userID, 0, hash)
+		if err == nil {
+			log.Println("Recovery code used by user", userID)
+		}
+	}
+	if err != nil {
+		a.guard.fail(key, ip, a.now())
+		return errCodeInvalid
+	}
+	a.guard.succeed(key)
+	return nil
+}
+
+//twoFactorSelf checks the authed user is the user in the URL and not using
+//an API key, refusing the request if not
+func twoFactorSelf(w http.ResponseWriter, r *http.Request) (string, bool) {
+	id, ok := accountOwner(w, r, false)
+	if ok && currentUser(r).ID != id {
+		forbid(w, "Only the user can enrol an authenticator")
+		return "", false
+	}
+	return id, ok
+}
+
+//Handler functions
+// ~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+
+//start enrolling an authenticator for the authed user. Codes are not asked
+//for until the enrolment is confirmed with a first one
+func (a *api) enrolTwoFactor(w http.ResponseWriter, r *http.Request) {
+	id, ok := twoFactorSelf(w, r)
+	if !ok {
+		return
+	}
+	log.Println("Enrol authenticator of user", id)
+
+	if tf, found := a.store.GetTwoFactor(id); found && tf.enabled() {
+		log.Println("Two-factor authentication already enabled")
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("409: Two-factor authentication is already enabled"))
+		return
+	}
+	tf := twoFactor{UserID: id, Secret: newTOTPSecret(), CreatedAt: a.now().UTC()}
+	if err := a.store.SetTwoFactor(tf); err != nil {
+		log.Println("Error enrolling authenticator", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Error enrolling authenticator"))
+		return
+	}
+
+	data, _ := json.Marshal(enrolment{tf.Secret, totpURI(id, tf.Secret)})
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(data)
+	return
+}
+
+//confirm an enrolment with a code from the authenticator, enabling
+//two-factor authentication and handing out recovery codes
+func (a *api) confirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	id, ok := twoFactorSelf(w, r)
+	if !ok {
+		return
+	}
+	log.Println("Confirm authenticator of user", id)
+
+	var req codeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Println("Bad request", err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400: Invalid request body"))
+		return
+	}
+	tf, found := a.store.GetTwoFactor(id)
+	if !found {
+		log.Println("No authenticator enrolled")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404: No authenticator is being enrolled"))
+		return
+	}
+	if tf.enabled() {
+		log.Println("Two-factor authentication already enabled")
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("409: Two-factor authentication is already enabled"))
+		return
+	}
+	step, valid := checkTOTP(tf.Secret, req.Code, a.now())
+	if !valid {
+		log.Println("Wrong code")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400: Code does not match the authenticator"))
+		return
+	}
+
+	codes, hashes := newRecoveryCodes()
+	tf.Recovery = hashes
+	tf.LastStep = step
+	tf.EnabledAt = a.now().UTC()
+	if err := a.store.SetTwoFactor(tf); err != nil {
+		log.Println("Error enabling two-factor authentication", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Error enabling two-factor authentication"))
+		return
+	}
+
+	log.Println("Two-factor authentication enabled for user", id)
+	data, _ := json.Marshal(recoveryCodes{codes})
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+	return
+}
+
+//turn two-factor authentication off. Users must send a code to turn off
+//their own; admins can turn off that of another user who lost theirs
+func (a *api) disableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	id, ok := accountOwner(w, r, false)
+	if !ok {
+		return
+	}
+	log.Println("Disable two-factor authentication of user", id)
+
+	tf, found := a.store.GetTwoFactor(id)
+	if !found {
+		log.Println("Two-factor authentication not enabled")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404: Two-factor authentication is not enabled"))
+		return
+	}
+	if currentUser(r).ID == id && tf.enabled() {
+		err := a.checkOneTimeCode(r, id, r.Header.Get(otpHeader))
+		if locked, ok := err.(lockedError); ok {
+			tooManyAttempts(w, locked)
+			return
+		}
+		if err != nil {
+			forbid(w, "A valid one-time code is needed in the "+otpHeader+" header")
+			return
+		}
+	}
+	switch err := a.store.RemoveTwoFactor(id); err {
+	case nil, errTwoFactorOff:
+	default:
+		log.Println("Error disabling two-factor authentication", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Error disabling two-factor authentication"))
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Two-Factor Authentication Disabled"))
+	return
+}
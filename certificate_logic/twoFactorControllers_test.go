@@ -0,0 +1,154 @@
+package certificates
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+//router, executeRequest and checkResponseCode are defined in certControllers_test.go
+//this file of unit tests can be considered an extension of that and is separated solely
+//for the purposes of separating duties and logic
+
+//authenticator computes codes like an app enrolled with a secret would
+type authenticator struct {
+	key   []byte
+	clock *testClock
+}
+
+func (a authenticator) code() string {
+	return totpCode(a.key, totpStepAt(a.clock.Now()))
+}
+
+//enableTwoFactor enrols and confirms an authenticator for rr01, returning
+//it and the recovery codes
+func enableTwoFactor(t *testing.T, r http.Handler, clock *testClock) (authenticator, []string) {
+	req, _ := http.NewRequest("POST", "/users/rr01/2fa", nil)
+	req.SetBasicAuth("rr01", "rrejh3294")
+	response := executeOn(r, req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	var e enrolment
+	json.Unmarshal(response.Body.Bytes(), &e)
+	key, _ := totpEncoding.DecodeString(e.Secret)
+	app := authenticator{key, clock}
+
+	body, _ := json.Marshal(codeRequest{Code: app.code()})
+	req, _ = http.NewRequest("POST", "/users/rr01/2fa/confirm", bytes.NewBuffer(body))
+	req.SetBasicAuth("rr01", "rrejh3294")
+	response = executeOn(r, req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var codes recoveryCodes
+	json.Unmarshal(response.Body.Bytes(), &codes)
+	//the code confirming the enrolment is used up
+	clock.Advance(totpStep)
+	return app, codes.RecoveryCodes
+}
+
+//withOTP sends a certificate request as rr01 with a one-time code, if any
+func withOTP(r http.Handler, method string, url string, body string, code string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+	req.SetBasicAuth("rr01", "rrejh3294")
+	if code != "" {
+		req.Header.Set(otpHeader, code)
+	}
+	return executeOn(r, req)
+}
+
+//TestTwoFactorEnrol test enrolment gives an otpauth URI and only counts once
+//confirmed with a code
+func TestTwoFactorEnrol(t *testing.T) {
+	clock := newTestClock()
+	r := NewRouter(newTestStore(), WithClock(clock.Now))
+
+	req, _ := http.NewRequest("POST", "/users/rr01/2fa", nil)
+	req.SetBasicAuth("rr01", "rrejh3294")
+	response := executeOn(r, req)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	var e enrolment
+	json.Unmarshal(response.Body.Bytes(), &e)
+	if e.URI != totpURI("rr01", e.Secret) {
+		t.Errorf("Expected otpauth URI. Got '%s'", e.URI)
+	}
+
+	//not enabled until confirmed
+	checkResponseCode(t, http.StatusCreated, transferAction(r, "create", "rr01", "rrejh3294").Code)
+
+	body, _ := json.Marshal(codeRequest{Code: "000000"})
+	req, _ = http.NewRequest("POST", "/users/rr01/2fa/confirm", bytes.NewBuffer(body))
+	req.SetBasicAuth("rr01", "rrejh3294")
+	checkResponseCode(t, http.StatusBadRequest, executeOn(r, req).Code)
+
+	//others cannot enrol for a user, admins included
+	req, _ = http.NewRequest("POST", "/users/vvg01/2fa", nil)
+	req.SetBasicAuth("rr01", "rrejh3294")
+	checkResponseCode(t, http.StatusForbidden, executeOn(r, req).Code)
+}
+
+//TestTwoFactorRequired test creating and accepting transfers and deleting
+//certificates need a code once enabled, and each code works once
+func TestTwoFactorRequired(t *testing.T) {
+	clock := newTestClock()
+	r := NewRouter(newTestStore(), WithClock(clock.Now))
+	app, _ := enableTwoFactor(t, r, clock)
+
+	transfer := `{"To": "vvg@gmail.com"}`
+	checkResponseCode(t, http.StatusForbidden, withOTP(r, "POST", "/certificates/c001/transfers/create", transfer, "").Code)
+	checkResponseCode(t, http.StatusForbidden, withOTP(r, "POST", "/certificates/c001/transfers/create", transfer, "000000").Code)
+	code := app.code()
+	checkResponseCode(t, http.StatusCreated, withOTP(r, "POST", "/certificates/c001/transfers/create", transfer, code).Code)
+	checkResponseCode(t, http.StatusForbidden, withOTP(r, "DELETE", "/certificates/c002/delete", "", code).Code)
+
+	clock.Advance(totpStep)
+	checkResponseCode(t, http.StatusOK, withOTP(r, "DELETE", "/certificates/c002/delete", "", app.code()).Code)
+
+	//users without 2FA are not asked for codes
+	checkResponseCode(t, http.StatusOK, transferAction(r, "accept", "vvg01", "vwh39043f").Code)
+}
+
+//TestTwoFactorRecoveryCode test a recovery code stands in for a code once
+func TestTwoFactorRecoveryCode(t *testing.T) {
+	clock := newTestClock()
+	r := NewRouter(newTestStore(), WithClock(clock.Now))
+	_, recovery := enableTwoFactor(t, r, clock)
+	if len(recovery) != recoveryCodeCount {
+		t.Fatalf("Expected %d recovery codes. Got %v", recoveryCodeCount, recovery)
+	}
+
+	checkResponseCode(t, http.StatusOK, withOTP(r, "DELETE", "/certificates/c002/delete", "", recovery[0]).Code)
+	checkResponseCode(t, http.StatusForbidden, withOTP(r, "DELETE", "/certificates/c001/delete", "", recovery[0]).Code)
+	checkResponseCode(t, http.StatusOK, withOTP(r, "DELETE", "/certificates/c001/delete", "", recovery[1]).Code)
+}
+
+//TestTwoFactorLockout test guessing codes locks the user out
+func TestTwoFactorLockout(t *testing.T) {
+	clock := newTestClock()
+	r := NewRouter(newTestStore(), WithClock(clock.Now), WithLockout(lockoutPolicy))
+	app, _ := enableTwoFactor(t, r, clock)
+
+	for i := 0; i < lockoutPolicy.UserThreshold; i++ {
+		withOTP(r, "DELETE", "/certificates/c002/delete", "", "000000")
+	}
+	checkResponseCode(t, http.StatusTooManyRequests, withOTP(r, "DELETE", "/certificates/c002/delete", "", app.code()).Code)
+}
+
+//TestTwoFactorDisable test users need a code to turn 2FA off and admins can
+//turn it off for a user who lost theirs
+func TestTwoFactorDisable(t *testing.T) {
+	clock := newTestClock()
+	store := newTestStore()
+	r := NewRouter(store, WithClock(clock.Now))
+	app, _ := enableTwoFactor(t, r, clock)
+
+	checkResponseCode(t, http.StatusForbidden, withOTP(r, "DELETE", "/users/rr01/2fa", "", "").Code)
+	checkResponseCode(t, http.StatusOK, withOTP(r, "DELETE", "/users/rr01/2fa", "", app.code()).Code)
+	checkResponseCode(t, http.StatusNotFound, withOTP(r, "DELETE", "/users/rr01/2fa", "", "").Code)
+	checkResponseCode(t, http.StatusOK, withOTP(r, "DELETE", "/certificates/c002/delete", "", "").Code)
+
+	store.SetTwoFactor(twoFactor{UserID: "vvg01", Secret: newTOTPSecret(), EnabledAt: clock.Now()})
+	req, _ := http.NewRequest("DELETE", "/users/vvg01/2fa", nil)
+	req.SetBasicAuth("vvg01", "vwh39043f")
+	checkResponseCode(t, http.StatusForbidden, executeOn(r, req).Code)
+	checkResponseCode(t, http.StatusOK, withOTP(r, "DELETE", "/users/vvg01/2fa", "", "").Code)
+}
@@ -2,32 +2,28 @@ package certificates
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"net/mail"
+	"strings"
 
 	"github.com/gorilla/mux"
 )
 
-func getUserCerts(id string) (certCollection, bool) {
-	userCerts := certCollection{}
-	found := false
-	for _, element := range certs {
-		if element.OwnerID == id {
-			userCerts = append(userCerts, element)
-			found = true
-		}
-	}
-	return userCerts, found
+func (a *api) getUserCerts(id string) (certCollection, bool) {
+	userCerts := a.store.ListCertsByOwner(id)
+	return userCerts, len(userCerts) > 0
 }
 
 //return all certificates by the specified user
-func userCerts(w http.ResponseWriter, r *http.Request) {
+func (a *api) userCerts(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	//log.Println(vars)
 	id := vars["userID"] // id of user
 	log.Println("Get certs of user", id)
 
-	userCerts, found := getUserCerts(id)
+	userCerts, found := a.getUserCerts(id)
 
 	//if user not found
 	if !found {
@@ -47,3 +43,418 @@ func userCerts(w http.ResponseWriter, r *http.Request) {
 	return
 
 }
+
+//list transfers of certificates sent to the specified user
+func (a *api) incomingTransfers(w http.ResponseWriter, r *http.Request) {
+	a.userTransfers(w, r, "incoming")
+}
+
+//list transfers of certificates sent by the specified user
+func (a *api) outgoingTransfers(w http.ResponseWriter, r *http.Request) {
+	a.userTransfers(w, r, "outgoing")
+}
+
+//userTransfers lists the transfers of the user in the URL, who must be the
+//authed user, going in the direction given. An optional ?status= narrows
+//the list down to transfers with that status
+func (a *api) userTransfers(w http.ResponseWriter, r *http.Request, direction string) {
+	vars := mux.Vars(r)
+	id := vars["userID"] // id of user
+	log.Println("Get", direction, "transfers of user", id)
+
+	//user authed by the middleware
+	user := currentUser(r)
+	if user.ID != id {
+		forbid(w, "Cannot view the transfers of another user")
+		return
+	}
+
+	filter := transferFilter{Status: r.URL.Query().Get("status")}
+	if filter.Status != "" && !knownTransferStatus(filter.Status) {
+		log.Println("Unknown transfer status", filter.Status)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Unknown transfer status " + filter.Status))
+		return
+	}
+	if direction == "incoming" {
+		//transfers to an email are only shown to whoever has proved they hold it
+		if !user.emailVerified() {
+			forbid(w, "Verify the email of the account before viewing incoming transfers")
+			return
+		}
+		filter.To = user.Email
+	} else {
+		filter.From = user.ID
+	}
+
+	data, _ := json.Marshal(a.store.ListTransfers(filter)) //convert data returned to json
+
+	//create and write http response
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+	return
+}
+
+//passwordChange is the body of a change password request
+type passwordChange struct {
+	OldPassword string
+	NewPassword string
+}
+
+//change the password of the specified user, who must give the current one
+func (a *api) changePassword(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["userID"] // id of user
+	log.Println("Change password of user", id)
+
+	var change passwordChange
+	if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+		log.Println("Bad request", err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400: Invalid request body"))
+		return
+	}
+
+	//auth user with the old password
+	u, err := a.checkPasswordFrom(r, id, change.OldPassword)
+	if locked, ok := err.(lockedError); ok {
+		tooManyAttempts(w, locked)
+		return
+	}
+	if err != nil {
+		log.Println("Unauthorized")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("401: Incorrect user credentials"))
+		return
+	}
+	if len(change.NewPassword) < minPasswordLength {
+		log.Println("New password too short")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("400: Password must be at least %d characters", minPasswordLength)))
+		return
+	}
+
+	//authenticate may have just hashed a plaintext password, so compare
+	//against what is stored now rather than what it returned
+	u, _ = a.store.GetUser(u.ID)
+	if ok, _ := checkPassword(u.password, change.OldPassword); !ok {
+		log.Println("Password changed concurrently")
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("409: Password was changed by another request"))
+		return
+	}
+	switch err := a.store.SetPassword(u.ID, u.password, hashPassword(change.NewPassword)); err {
+	case nil:
+	case errPasswordChanged:
+		log.Println("Password changed concurrently")
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("409: Password was changed by another request"))
+		return
+	default:
+		log.Println("Error changing password", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Error changing password"))
+		return
+	}
+
+	log.Println("Password changed")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Password Changed"))
+	return
+}
+
+//set the roles of the specified user, replacing those held
+func (a *api) setRoles(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["userID"] // id of user
+	log.Println("Set roles of user", id)
+
+	var roles []string
+	if err := json.NewDecoder(r.Body).Decode(&roles); err != nil {
+		log.Println("Bad request", err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400: Expected a JSON list of roles"))
+		return
+	}
+	if len(roles) == 0 {
+		log.Println("No roles given")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400: A user needs at least one role"))
+		return
+	}
+	for _, role := range roles {
+		if !knownRole(role) {
+			log.Println("Unknown role", role)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400: Unknown role " + role))
+			return
+		}
+	}
+	//an admin taking their own admin role away could leave nobody to give it back
+	if u := currentUser(r); u.ID == id && !(user{Roles: roles}).hasRole(roleAdmin) {
+		forbid(w, "Admins cannot remove their own admin role")
+		return
+	}
+
+	switch err := a.store.SetRoles(id, roles); err {
+	case nil:
+	case errUserNotFound:
+		log.Println("User not found")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404: User not found"))
+		return
+	default:
+		log.Println("Error setting roles", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Error setting roles"))
+		return
+	}
+
+	u, _ := a.store.GetUser(id)
+	data, _ := json.Marshal(u)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+	return
+}
+
+//lift the lockout of the specified user after failed password attempts
+func (a *api) unlockUser(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["userID"] // id of user
+	log.Println("Unlock user", id)
+
+	if _, found := a.store.GetUser(id); !found {
+		log.Println("User not found")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404: User not found"))
+		return
+	}
+	a.guard.unlock(id)
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Account Unlocked"))
+	return
+}
+
+//registration is the body of a register request
+type registration struct {
+	Email    string
+	Name     string
+	Password string
+}
+
+//profileUpdate is the body of an update profile request; fields left empty
+//keep their current value
+type profileUpdate struct {
+	Email string
+	Name  string
+}
+
+//validEmail reports whether email is a bare address such as vvg@gmail.com
+func validEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email
+}
+
+//accountOwner checks the authed user may act on the account of the user in
+//the URL, being that user or an admin, refusing the request if not. API keys
+//are refused unless allowKey, so a leaked one cannot take over an account
+func accountOwner(w http.ResponseWriter, r *http.Request, allowKey bool) (string, bool) {
+	id := mux.Vars(r)["userID"] // id of user owning the account
+	u := currentUser(r)
+	if u.apiKeyID != "" && !allowKey {
+		forbid(w, "API keys cannot be used to change accounts")
+		return "", false
+	}
+	if u.ID != id && !u.can(permManageUsers) {
+		forbid(w, "Cannot manage the account of another user")
+		return "", false
+	}
+	return id, true
+}
+
+//writeUser responds with a user as JSON
+func writeUser(w http.ResponseWriter, status int, u user) {
+	data, _ := json.Marshal(u)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+//register a new user, who is given an ID and the collector role
+func (a *api) registerUser(w http.ResponseWriter, r *http.Request) {
+	var reg registration
+	if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+		log.Println("Bad request", err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400: Invalid request body"))
+		return
+	}
+	reg.Email = strings.TrimSpace(reg.Email)
+	log.Println("Register user", reg.Email)
+
+	if !validEmail(reg.Email) {
+		log.Println("Invalid email", reg.Email)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400: A valid email address is needed"))
+		return
+	}
+	if len(reg.Password) < minPasswordLength {
+		log.Println("Password too short")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("400: Password must be at least %d characters", minPasswordLength)))
+		return
+	}
+
+	u := user{
+		ID:        newID("u"),
+		Email:     reg.Email,
+		Name:      strings.TrimSpace(reg.Name),
+		Roles:     []string{roleCollector},
+		CreatedAt: a.now().UTC(),
+		password:  hashPassword(reg.Password),
+	}
+	switch err := a.store.CreateUser(u); err {
+	case nil:
+	case errEmailTaken:
+		log.Println("Email already in use")
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("409: Email already in use"))
+		return
+	default:
+		log.Println("Error registering user", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Error registering user"))
+		return
+	}
+
+	log.Println("Registered user", u.ID)
+	a.sendVerification(u)
+	writeUser(w, http.StatusCreated, u)
+}
+
+//return the profile of the specified user
+func (a *api) getUser(w http.ResponseWriter, r *http.Request) {
+	id, ok := accountOwner(w, r, true)
+	if !ok {
+		return
+	}
+	log.Println("Get user", id)
+
+	u, found := a.store.GetUser(id)
+	if !found {
+		log.Println("User not found")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404: User not found"))
+		return
+	}
+	writeUser(w, http.StatusOK, u)
+}
+
+//change the email and name of the specified user
+func (a *api) updateProfile(w http.ResponseWriter, r *http.Request) {
+	id, ok := accountOwner(w, r, false)
+	if !ok {
+		return
+	}
+	log.Println("Update profile of user", id)
+
+	var update profileUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		log.Println("Bad request", err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400: Invalid request body"))
+		return
+	}
+	u, found := a.store.GetUser(id)
+	if !found {
+		log.Println("User not found")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404: User not found"))
+		return
+	}
+	oldEmail := u.Email
+	if email := strings.TrimSpace(update.Email); email != "" {
+		if !validEmail(email) {
+			log.Println("Invalid email", email)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("400: A valid email address is needed"))
+			return
+		}
+		u.Email = email
+	}
+	if name := strings.TrimSpace(update.Name); name != "" {
+		u.Name = name
+	}
+
+	switch err := a.store.UpdateProfile(id, u.Email, u.Name); err {
+	case nil:
+	case errUserNotFound:
+		log.Println("User not found")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404: User not found"))
+		return
+	case errEmailTaken:
+		log.Println("Email already in use")
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("409: Email already in use"))
+		return
+	case errUserDeactivated:
+		log.Println("User deactivated")
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("409: Account is deactivated"))
+		return
+	default:
+		log.Println("Error updating profile", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Error updating profile"))
+		return
+	}
+
+	u, _ = a.store.GetUser(id)
+	//a new email has to be verified before transfers to it can be accepted
+	if u.Email != oldEmail {
+		a.sendVerification(u)
+	}
+	writeUser(w, http.StatusOK, u)
+}
+
+//deactivate the specified user, who can no longer log in or receive transfers
+func (a *api) deactivateUser(w http.ResponseWriter, r *http.Request) {
+	id, ok := accountOwner(w, r, false)
+	if !ok {
+		return
+	}
+	log.Println("Deactivate user", id)
+
+	switch err := a.store.DeactivateUser(id, a.now().UTC()); err {
+	case nil:
+	case errUserNotFound:
+		log.Println("User not found")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404: User not found"))
+		return
+	case errUserDeactivated:
+		log.Println("User already deactivated")
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("409: Account is already deactivated"))
+		return
+	default:
+		log.Println("Error deactivating user", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Error deactivating user"))
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Account Deactivated"))
+	return
+}
@@ -1,7 +1,11 @@
 package certificates
 
 import (
+	"bytes"
+	"encoding/json"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -26,3 +30,211 @@ func TestUserCertsNonExistUser(t *testing.T) {
 	checkResponseCode(t, http.StatusNotFound, response.Code)
 
 }
+
+//listTransfers fetches a user's transfers from a router as that user
+func listTransfers(t *testing.T, r http.Handler, url string, userID string, pass string) transferCollection {
+	req, _ := http.NewRequest("GET", url, nil)
+	req.SetBasicAuth(userID, pass)
+	response := executeOn(r, req)
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var list transferCollection
+	json.Unmarshal(response.Body.Bytes(), &list)
+	return list
+}
+
+//TestUserTransfers test listing incoming and outgoing transfers with a status filter
+func TestUserTransfers(t *testing.T) {
+	r := NewRouter(newTestStore())
+	transferAction(r, "create", "rr01", "rrejh3294")
+	transferAction(r, "cancel", "rr01", "rrejh3294")
+	transferAction(r, "create", "rr01", "rrejh3294")
+
+	outgoing := listTransfers(t, r, "/users/rr01/transfers/outgoing", "rr01", "rrejh3294")
+	if len(outgoing) != 2 || outgoing[0].Status != "cancelled" || outgoing[1].Status != "pending" {
+		t.Errorf("Expected a cancelled then a pending outgoing transfer. Got %+v", outgoing)
+	}
+	incoming := listTransfers(t, r, "/users/vvg01/transfers/incoming?status=pending", "vvg01", "vwh39043f")
+	if len(incoming) != 1 || incoming[0].ID != outgoing[1].ID {
+		t.Errorf("Expected the pending transfer incoming. Got %+v", incoming)
+	}
+	if list := listTransfers(t, r, "/users/rr01/transfers/incoming", "rr01", "rrejh3294"); len(list) != 0 {
+		t.Errorf("Expected no incoming transfers for rr01. Got %+v", list)
+	}
+}
+
+//TestUserTransfersUnauthorized test listing transfers needs the user's own
+//credentials: bad ones are unauthorized and another user's are forbidden
+func TestUserTransfersUnauthorized(t *testing.T) {
+	for creds, code := range map[[2]string]int{{"rr01", "rr"}: http.StatusUnauthorized, {"rr01", "rrejh3294"}: http.StatusForbidden} {
+		req, _ := http.NewRequest("GET", "/users/vvg01/transfers/incoming", nil)
+		req.SetBasicAuth(creds[0], creds[1])
+		checkResponseCode(t, code, executeRequest(req).Code)
+	}
+}
+
+//TestUserTransfersBadStatus test filtering by a status transfers never have
+func TestUserTransfersBadStatus(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/users/rr01/transfers/outgoing?status=lost", nil)
+	req.SetBasicAuth("rr01", "rrejh3294")
+	checkResponseCode(t, http.StatusBadRequest, executeRequest(req).Code)
+}
+
+//changePassword sends a change password request for vvg01 to a router
+func changePassword(r http.Handler, oldPass string, newPass string) int {
+	body, _ := json.Marshal(passwordChange{OldPassword: oldPass, NewPassword: newPass})
+	req, _ := http.NewRequest("PUT", "/users/vvg01/password", bytes.NewBuffer(body))
+	return executeOn(r, req).Code
+}
+
+//TestChangePassword test a user can log in with a new password and not the old one
+func TestChangePassword(t *testing.T) {
+	store := newTestStore()
+	r := NewRouter(store)
+
+	checkResponseCode(t, http.StatusOK, changePassword(r, "vwh39043f", "sunflowers1888"))
+	if u, _ := store.GetUser("vvg01"); !strings.HasPrefix(u.password, passwordScheme+"$") {
+		t.Errorf("Expected new password to be stored hashed. Got '%s'", u.password)
+	}
+
+	checkResponseCode(t, http.StatusUnauthorized, changePassword(r, "vwh39043f", "irises1889"))
+	checkResponseCode(t, http.StatusOK, changePassword(r, "sunflowers1888", "irises1889"))
+}
+
+//TestChangePasswordTooShort test a new password must be long enough
+func TestChangePasswordTooShort(t *testing.T) {
+	r := NewRouter(newTestStore())
+	checkResponseCode(t, http.StatusBadRequest, changePassword(r, "vwh39043f", "short"))
+}
+
+//TestSetRoles test an admin changes the roles of a user and nobody else can
+func TestSetRoles(t *testing.T) {
+	store := newTestStore()
+	r := NewRouter(store)
+	setRoles := func(id string, body string, userID string, pass string) int {
+		req, _ := http.NewRequest("PUT", "/users/"+id+"/roles", bytes.NewBufferString(body))
+		req.SetBasicAuth(userID, pass)
+		return executeOn(r, req).Code
+	}
+
+	checkResponseCode(t, http.StatusForbidden, setRoles("vvg01", `["admin"]`, "vvg01", "vwh39043f"))
+	checkResponseCode(t, http.StatusBadRequest, setRoles("vvg01", `["curator"]`, "rr01", "rrejh3294"))
+	checkResponseCode(t, http.StatusBadRequest, setRoles("vvg01", `[]`, "rr01", "rrejh3294"))
+	checkResponseCode(t, http.StatusNotFound, setRoles("kh01", `["gallery"]`, "rr01", "rrejh3294"))
+	checkResponseCode(t, http.StatusForbidden, setRoles("rr01", `["artist"]`, "rr01", "rrejh3294"))
+
+	checkResponseCode(t, http.StatusOK, setRoles("vvg01", `["gallery", "collector"]`, "rr01", "rrejh3294"))
+	if u, _ := store.GetUser("vvg01"); !u.hasRole(roleGallery) || u.hasRole(roleArtist) || u.can(permEditDetails) {
+		t.Errorf("Expected vvg01 to be a gallery and collector only. Got %v", u.Roles)
+	}
+}
+
+//TestGrantAdmin test the first admin is made outside the API and keeps their roles
+func TestGrantAdmin(t *testing.T) {
+	store := NewMemoryStore()
+	if u, _ := store.GetUser("rr01"); u.hasRole(roleAdmin) {
+		t.Errorf("Expected no admin in the static data. Got %v", u.Roles)
+	}
+	if err := GrantAdmin(store, "kh01"); err != errUserNotFound {
+		t.Errorf("Expected an unknown user to fail. Got %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := GrantAdmin(store, "vvg01"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if u, _ := store.GetUser("vvg01"); len(u.Roles) != 2 || !u.hasRole(roleArtist) || !u.hasRole(roleAdmin) {
+		t.Errorf("Expected vvg01 to be an artist and admin. Got %v", u.Roles)
+	}
+}
+
+//register signs a user up on a router
+func register(r http.Handler, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", "/users/register", bytes.NewBufferString(body))
+	return executeOn(r, req)
+}
+
+//TestRegisterUser test a registered user gets an ID, can log in and holds no
+//more than the collector role
+func TestRegisterUser(t *testing.T) {
+	r := NewRouter(newTestStore())
+	response := register(r, `{"Email": "kh@gmail.com", "Name": "Katsushika Hokusai", "Password": "greatwave1831"}`)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var u user
+	json.Unmarshal(response.Body.Bytes(), &u)
+	if u.ID == "" || u.Email != "kh@gmail.com" || !u.hasRole(roleCollector) || len(u.Roles) != 1 {
+		t.Errorf("Expected a new collector with an ID. Got %+v", u)
+	}
+	if strings.Contains(response.Body.String(), "greatwave1831") {
+		t.Errorf("Expected the password to be left out of the response")
+	}
+	login(t, r, u.ID, "greatwave1831")
+}
+
+//TestRegisterUserInvalid test a registration needs a free, valid email and a
+//long enough password
+func TestRegisterUserInvalid(t *testing.T) {
+	r := NewRouter(newTestStore())
+	checkResponseCode(t, http.StatusConflict, register(r, `{"Email": "vvg@gmail.com", "Password": "greatwave1831"}`).Code)
+	checkResponseCode(t, http.StatusBadRequest, register(r, `{"Email": "Hokusai <kh@gmail.com>", "Password": "greatwave1831"}`).Code)
+	checkResponseCode(t, http.StatusBadRequest, register(r, `{"Email": "kh@gmail.com", "Password": "wave"}`).Code)
+	checkResponseCode(t, http.StatusBadRequest, register(r, `{"Email": "kh@gmail.com"`).Code)
+}
+
+//TestUserProfile test a user sees and changes their own profile, and only
+//admins those of others
+func TestUserProfile(t *testing.T) {
+	store := newTestStore()
+	r := NewRouter(store)
+	profile := func(method string, id string, body string, userID string, pass string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "/users/"+id, bytes.NewBufferString(body))
+		req.SetBasicAuth(userID, pass)
+		return executeOn(r, req)
+	}
+
+	checkResponseCode(t, http.StatusOK, profile("GET", "vvg01", "", "vvg01", "vwh39043f").Code)
+	checkResponseCode(t, http.StatusForbidden, profile("GET", "rr01", "", "vvg01", "vwh39043f").Code)
+	checkResponseCode(t, http.StatusOK, profile("GET", "vvg01", "", "rr01", "rrejh3294").Code)
+	checkResponseCode(t, http.StatusNotFound, profile("GET", "kh01", "", "rr01", "rrejh3294").Code)
+
+	//the email of another user is taken
+	checkResponseCode(t, http.StatusConflict, profile("PUT", "vvg01", `{"Email": "reshawnramjattan@gmail.com"}`, "vvg01", "vwh39043f").Code)
+	checkResponseCode(t, http.StatusBadRequest, profile("PUT", "vvg01", `{"Email": "not an email"}`, "vvg01", "vwh39043f").Code)
+	response := profile("PUT", "vvg01", `{"Email": "vincent@gmail.com"}`, "vvg01", "vwh39043f")
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if u, _ := store.GetUserByEmail("vincent@gmail.com"); u.ID != "vvg01" || u.Name != "Vincent Van Golang" {
+		t.Errorf("Expected new email with name kept. Got %+v", u)
+	}
+	if _, found := store.GetUserByEmail("vvg@gmail.com"); found {
+		t.Errorf("Expected old email to be freed")
+	}
+}
+
+//TestDeactivateUser test a deactivated user can no longer authenticate in any
+//way or receive transfers, and keeps their email
+func TestDeactivateUser(t *testing.T) {
+	store := newTestStore()
+	r := NewRouter(store)
+	tokens := login(t, r, "vvg01", "vwh39043f")
+	deactivate := func(id string, userID string, pass string) int {
+		req, _ := http.NewRequest("DELETE", "/users/"+id, nil)
+		req.SetBasicAuth(userID, pass)
+		return executeOn(r, req).Code
+	}
+
+	checkResponseCode(t, http.StatusForbidden, deactivate("rr01", "vvg01", "vwh39043f"))
+	checkResponseCode(t, http.StatusOK, deactivate("vvg01", "vvg01", "vwh39043f"))
+	checkResponseCode(t, http.StatusUnauthorized, deactivate("vvg01", "vvg01", "vwh39043f"))
+	checkResponseCode(t, http.StatusConflict, deactivate("vvg01", "rr01", "rrejh3294"))
+
+	checkResponseCode(t, http.StatusUnauthorized, loginCode(r, "vvg01", "vwh39043f"))
+	req, _ := http.NewRequest("GET", "/users/vvg01/transfers/incoming", nil)
+	req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	checkResponseCode(t, http.StatusUnauthorized, executeOn(r, req).Code)
+	_, code := refreshTokens(r, tokens.RefreshToken)
+	checkResponseCode(t, http.StatusUnauthorized, code)
+
+	checkResponseCode(t, http.StatusBadRequest, transferAction(r, "create", "rr01", "rrejh3294").Code)
+	checkResponseCode(t, http.StatusConflict, register(r, `{"Email": "vvg@gmail.com", "Password": "greatwave1831"}`).Code)
+}
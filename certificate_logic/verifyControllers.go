@@ -0,0 +1,128 @@
+package certificates
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+//how long a mailed email verification token can be used for
+const verifyTokenTTL = 48 * time.Hour
+
+//verifyRequest is the body of a request verifying an email with a token
+type verifyRequest struct {
+	Token string
+}
+
+//verifyMail is the mail carrying an email verification token
+const verifyMail = `Hello %s,
+
+Please confirm %s is the email of your account %s. Certificates transferred
+to this address can only be accepted once it is confirmed. Send this token
+to /auth/verify-email to confirm it:
+
+%s
+
+The token works once and expires in %v. If you did not make an account you
+can ignore this mail.
+`
+
+//sendVerification stores a new verification token for a user's current
+//email and mails it there. Failures are only logged; the user can ask again
+func (a *api) sendVerification(u user) {
+	now := a.now().UTC()
+	v := verification{ID: newID("v"), UserID: u.ID, Email: u.Email, CreatedAt: now, ExpiresAt: now.Add(verifyTokenTTL)}
+	token, hash := newOpaqueToken(v.ID)
+	v.Hash = hash
+	if err := a.store.CreateVerification(v); err != nil {
+		log.Println("Error creating verification token", err)
+		return
+	}
+	err := a.mailer.Send(Message{
+		To:      u.Email,
+		Subject: "Confirm your email",
+		Body:    fmt.Sprintf(verifyMail, u.Name, u.Email, u.ID, token, verifyTokenTTL),
+	})
+	if err != nil {
+		log.Println("Error mailing verification token", err)
+	}
+}
+
+//Handler functions
+// ~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+
+//mail a new verification token to the email of the specified user
+func (a *api) requestVerification(w http.ResponseWriter, r *http.Request) {
+	id, ok := accountOwner(w, r, false)
+	if !ok {
+		return
+	}
+	log.Println("Verification requested for user", id)
+
+	u, found := a.store.GetUser(id)
+	if !found {
+		log.Println("User not found")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("404: User not found"))
+		return
+	}
+	if u.emailVerified() {
+		log.Println("Email already verified")
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("409: Email is already verified"))
+		return
+	}
+	a.sendVerification(u)
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("A verification token has been sent to " + u.Email))
+	return
+}
+
+//verify the email of a user with a mailed token
+func (a *api) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req verifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Println("Bad request", err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400: Invalid request body"))
+		return
+	}
+
+	id, hash, ok := splitOpaqueToken(req.Token)
+	v, found := a.store.GetVerification(id)
+	if !ok || !found {
+		log.Println("Unknown verification token")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400: Invalid or expired verification token"))
+		return
+	}
+	log.Println("Verify email of user", v.UserID)
+
+	switch err := a.store.VerifyEmail(id, hash, a.now().UTC()); err {
+	case nil:
+	case errVerifyInvalid:
+		log.Println("Verification refused")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("400: Invalid or expired verification token"))
+		return
+	case errEmailVerified:
+		log.Println("Email already verified")
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("409: Email is already verified"))
+		return
+	default:
+		log.Println("Error verifying email", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Error verifying email"))
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Email Verified"))
+	return
+}
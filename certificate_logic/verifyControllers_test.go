@@ -0,0 +1,145 @@
+package certificates
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+//router, executeRequest and checkResponseCode are defined in certControllers_test.go
+//this file of unit tests can be considered an extension of that and is separated solely
+//for the purposes of separating duties and logic
+
+//mailedVerifyToken matches the token in a verification mail
+var mailedVerifyToken = regexp.MustCompile(`(?m)^(v[0-9a-f]{16}\.\S+)$`)
+
+//lastVerifyToken returns the token of the latest mail in an outbox, which
+//must be a verification mail to email
+func lastVerifyToken(t *testing.T, outbox *Outbox, email string) string {
+	messages := outbox.Messages()
+	if len(messages) == 0 {
+		t.Fatalf("Expected a verification mail")
+	}
+	m := messages[len(messages)-1]
+	match := mailedVerifyToken.FindStringSubmatch(m.Body)
+	if m.To != email || match == nil {
+		t.Fatalf("Expected a verification mail to %s. Got %+v", email, m)
+	}
+	return match[1]
+}
+
+//confirmEmail verifies an email with a token
+func confirmEmail(r http.Handler, token string) int {
+	body, _ := json.Marshal(verifyRequest{Token: token})
+	req, _ := http.NewRequest("POST", "/auth/verify-email", bytes.NewBuffer(body))
+	return executeOn(r, req).Code
+}
+
+//registerCollector registers kh@gmail.com and returns the new user's ID
+func registerCollector(t *testing.T, r http.Handler) string {
+	response := register(r, `{"Email": "kh@gmail.com", "Name": "Hokusai", "Password": "greatwave1831"}`)
+	checkResponseCode(t, http.StatusCreated, response.Code)
+	var u user
+	json.Unmarshal(response.Body.Bytes(), &u)
+	return u.ID
+}
+
+//TestVerifyEmailGatesAccept test a transfer cannot be accepted or rejected
+//until the recipient has verified their email
+func TestVerifyEmailGatesAccept(t *testing.T) {
+	outbox, _ := NewOutbox("")
+	r := NewRouter(NewMemoryStore(), WithMailer(outbox))
+	id := registerCollector(t, r)
+	token := lastVerifyToken(t, outbox, "kh@gmail.com")
+
+	req, _ := http.NewRequest("POST", "/certificates/c001/transfers/create", bytes.NewBufferString(`{"To": "kh@gmail.com"}`))
+	req.SetBasicAuth("rr01", "rrejh3294")
+	checkResponseCode(t, http.StatusCreated, executeOn(r, req).Code)
+
+	for _, action := range []string{"accept", "reject"} {
+		response := transferAction(r, action, id, "greatwave1831")
+		checkResponseCode(t, http.StatusForbidden, response.Code)
+	}
+
+	checkResponseCode(t, http.StatusOK, confirmEmail(r, token))
+	checkResponseCode(t, http.StatusBadRequest, confirmEmail(r, token))
+	checkResponseCode(t, http.StatusOK, transferAction(r, "accept", id, "greatwave1831").Code)
+}
+
+//TestVerifyEmailGatesIncoming test transfers sent to an email are not listed
+//for an account until it has verified the email
+func TestVerifyEmailGatesIncoming(t *testing.T) {
+	outbox, _ := NewOutbox("")
+	r := NewRouter(NewMemoryStore(), WithMailer(outbox))
+	id := registerCollector(t, r)
+
+	req, _ := http.NewRequest("POST", "/certificates/c001/transfers/create", bytes.NewBufferString(`{"To": "kh@gmail.com"}`))
+	req.SetBasicAuth("rr01", "rrejh3294")
+	checkResponseCode(t, http.StatusCreated, executeOn(r, req).Code)
+
+	incoming := func() *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/users/"+id+"/transfers/incoming", nil)
+		req.SetBasicAuth(id, "greatwave1831")
+		return executeOn(r, req)
+	}
+	checkResponseCode(t, http.StatusForbidden, incoming().Code)
+
+	checkResponseCode(t, http.StatusOK, confirmEmail(r, lastVerifyToken(t, outbox, "kh@gmail.com")))
+	response := incoming()
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var transfers []transfer
+	json.Unmarshal(response.Body.Bytes(), &transfers)
+	if len(transfers) != 1 || transfers[0].CertID != "c001" {
+		t.Errorf("Expected the transfer of c001 once verified. Got %+v", transfers)
+	}
+}
+
+//TestVerifyEmailChanged test a new email must be verified again, and a token
+//for the old one no longer works
+func TestVerifyEmailChanged(t *testing.T) {
+	outbox, _ := NewOutbox("")
+	store := NewMemoryStore()
+	r := NewRouter(store, WithMailer(outbox))
+	id := registerCollector(t, r)
+	oldToken := lastVerifyToken(t, outbox, "kh@gmail.com")
+
+	req, _ := http.NewRequest("PUT", "/users/"+id, bytes.NewBufferString(`{"Email": "hokusai@gmail.com"}`))
+	req.SetBasicAuth(id, "greatwave1831")
+	checkResponseCode(t, http.StatusOK, executeOn(r, req).Code)
+	newToken := lastVerifyToken(t, outbox, "hokusai@gmail.com")
+
+	checkResponseCode(t, http.StatusBadRequest, confirmEmail(r, oldToken))
+	checkResponseCode(t, http.StatusOK, confirmEmail(r, newToken))
+	if u, _ := store.GetUser(id); !u.emailVerified() {
+		t.Errorf("Expected new email to be verified")
+	}
+
+	//a verified user changing their email loses the verification
+	req, _ = http.NewRequest("PUT", "/users/vvg01", bytes.NewBufferString(`{"Email": "vincent@gmail.com"}`))
+	req.SetBasicAuth("vvg01", "vwh39043f")
+	checkResponseCode(t, http.StatusOK, executeOn(r, req).Code)
+	if u, _ := store.GetUser("vvg01"); u.emailVerified() {
+		t.Errorf("Expected changed email to be unverified")
+	}
+}
+
+//TestRequestVerification test a user can have a new token mailed, and only
+//while unverified
+func TestRequestVerification(t *testing.T) {
+	outbox, _ := NewOutbox("")
+	r := NewRouter(NewMemoryStore(), WithMailer(outbox))
+	id := registerCollector(t, r)
+	request := func(userID string, pass string) int {
+		req, _ := http.NewRequest("POST", "/users/"+userID+"/email/verify", nil)
+		req.SetBasicAuth(userID, pass)
+		return executeOn(r, req).Code
+	}
+
+	checkResponseCode(t, http.StatusAccepted, request(id, "greatwave1831"))
+	checkResponseCode(t, http.StatusOK, confirmEmail(r, lastVerifyToken(t, outbox, "kh@gmail.com")))
+	checkResponseCode(t, http.StatusConflict, request(id, "greatwave1831"))
+	checkResponseCode(t, http.StatusConflict, request("vvg01", "vwh39043f"))
+}
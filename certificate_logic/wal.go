@@ -0,0 +1,233 @@
+package certificates
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+)
+
+//operations recorded in the write-ahead log, named after the routes performing them
+const (
+	opCreateCert     = "create_certificate"
+	opUpdateCert     = "update_certificate"
+	opDeleteCert     = "delete_certificate"
+	opCreateTransfer = "create_transfer"
+	opAcceptTransfer = "accept_transfer"
+	opCloseTransfer  = "close_transfer"
+	opSetPassword    = "set_password"
+	opSetRoles       = "set_roles"
+	opCreateSession  = "login"
+	opRefreshSession = "refresh"
+	opRevokeSession  = "logout"
+	opCreateAPIKey   = "create_api_key"
+	opRevokeAPIKey   = "revoke_api_key"
+	opTouchAPIKey    = "use_api_key"
+	opRegisterUser   = "register_user"
+	opUpdateProfile  = "update_profile"
+	opDeactivateUser = "deactivate_user"
+	opCreateReset    = "request_password_reset"
+	opResetPassword  = "reset_password"
+	opVerifyRequest  = "request_email_verification"
+	opVerifyEmail    = "verify_email"
+	opEnable2FA      = "enable_2fa"
+	opDisable2FA     = "disable_2fa"
+	opUse2FA         = "use_2fa"
+	opCheckpoint     = "checkpoint"
+	opRevokeCert     = "revoke_certificate"
+)
+
+//every record is framed by its payload length and a CRC-32C checksum
+const walHeaderSize = 8
+
+//a length above this can only come from a corrupt header
+const walMaxRecordSize = 1 << 24
+
+var walTable = crc32.MakeTable(crc32.Castagnoli)
+
+//logEntry is a single mutation as written to the log
+type logEntry struct {
+	Seq        uint64
+	Time       time.Time
+	Op         string
+	Cert       *certificate   `json:",omitempty"`
+	Event      *ledgerEvent   `json:",omitempty"` //ledger event of a change to a certificate
+	Checkpoint *checkpoint    `json:",omitempty"`
+	Revocation *revocation    `json:",omitempty"`
+	CertID     string         `json:",omitempty"`
+	Transfer   *transfer      `json:",omitempty"`
+	TransferID string         `json:",omitempty"`
+	OwnerID    string         `json:",omitempty"`
+	Email      string         `json:",omitempty"`
+	Status     string         `json:",omitempty"`
+	UserID     string         `json:",omitempty"`
+	User       *userRecord    `json:",omitempty"`
+	Name       string         `json:",omitempty"`
+	Roles      []string       `json:",omitempty"`
+	Password   string         `json:",omitempty"` //always a hash, never plaintext
+	Reset      *passwordReset `json:",omitempty"`
+	ResetID    string         `json:",omitempty"`
+	Verify     *verification  `json:",omitempty"`
+	VerifyID   string         `json:",omitempty"`
+	TwoFactor  *twoFactor     `json:",omitempty"`
+	Step       uint64         `json:",omitempty"`
+	Recovery   string         `json:",omitempty"` //hash of a recovery code
+	Session    *session       `json:",omitempty"`
+	SessionID  string         `json:",omitempty"`
+	APIKey     *apiKeyRecord  `json:",omitempty"`
+	KeyID      string         `json:",omitempty"`
+	//when the change took effect, for changes timed by the caller
+	At time.Time
+}
+
+//apply performs the mutation described by a log entry
+func (s *memoryStore) apply(e logEntry) error {
+	switch e.Op {
+	case opCreateCert:
+		return s.createCert(*e.Cert, &e)
+	case opUpdateCert:
+		return s.updateCert(*e.Cert, &e)
+	case opDeleteCert:
+		return s.deleteCert(e.CertID, e.OwnerID, &e)
+	case opRevokeCert:
+		return s.revokeCert(e.CertID, *e.Revocation, &e)
+	case opCreateTransfer:
+		return s.CreateTransfer(*e.Transfer)
+	case opAcceptTransfer:
+		return s.acceptTransfer(e.TransferID, e.Email, e.OwnerID, e.At, &e)
+	case opCloseTransfer:
+		return s.CloseTransfer(e.TransferID, e.Status, e.At)
+	case opSetPassword:
+		//the change was checked against the password current at the time
+		s.mu.RLock()
+		current := s.users[e.UserID].password
+		s.mu.RUnlock()
+		return s.SetPassword(e.UserID, current, e.Password)
+	case opSetRoles:
+		return s.SetRoles(e.UserID, e.Roles)
+	case opRegisterUser:
+		return s.CreateUser(e.User.account())
+	case opUpdateProfile:
+		return s.UpdateProfile(e.UserID, e.Email, e.Name)
+	case opDeactivateUser:
+		return s.DeactivateUser(e.UserID, e.At)
+	case opCreateReset:
+		return s.CreateReset(*e.Reset)
+	case opResetPassword:
+		//the token was checked when the reset was logged
+		s.resetMu.Lock()
+		hash := s.resets[e.ResetID].Hash
+		s.resetMu.Unlock()
+		return s.ResetPassword(e.ResetID, hash, e.Password, e.At)
+	case opVerifyRequest:
+		return s.CreateVerification(*e.Verify)
+	case opVerifyEmail:
+		v, _ := s.GetVerification(e.VerifyID)
+		return s.VerifyEmail(e.VerifyID, v.Hash, e.At)
+	case opEnable2FA:
+		return s.SetTwoFactor(*e.TwoFactor)
+	case opDisable2FA:
+		return s.RemoveTwoFactor(e.UserID)
+	case opUse2FA:
+		return s.UseTwoFactor(e.UserID, e.Step, e.Recovery)
+	case opCheckpoint:
+		return s.AddCheckpoint(*e.Checkpoint)
+	case opCreateSession:
+		return s.CreateSession(*e.Session)
+	case opRefreshSession:
+		current, _ := s.GetSession(e.Session.ID)
+		return s.RefreshSession(e.Session.ID, current.RefreshHash, e.Session.RefreshHash, e.Session.ExpiresAt)
+	case opRevokeSession:
+		return s.RevokeSession(e.SessionID, e.At)
+	case opCreateAPIKey:
+		return s.CreateAPIKey(e.APIKey.key())
+	case opRevokeAPIKey:
+		return s.RevokeAPIKey(e.KeyID, e.At)
+	case opTouchAPIKey:
+		return s.TouchAPIKey(e.KeyID, e.At)
+	}
+	return nil
+}
+
+//appendRecord writes one framed entry at the end of the log and syncs it
+func appendRecord(f *os.File, e logEntry) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	record := make([]byte, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, walTable))
+	copy(record[walHeaderSize:], payload)
+
+	offset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(record)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		//drop whatever part of the record made it out so the next append
+		//does not land behind a torn one, and a record the caller was told
+		//failed is not replayed after a restart
+		f.Truncate(offset)
+		f.Seek(offset, io.SeekStart)
+		return err
+	}
+	return nil
+}
+
+//readRecords reads entries from the start of the log until the end of the file.
+//It returns the valid entries and the offset just past the last of them. A bad
+//record is only taken for a torn write, and left past that offset, when it is
+//the last thing in the file; one with more of the log after it is corruption
+//of committed records and fails the read
+func readRecords(f *os.File) ([]logEntry, int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	r := bufio.NewReader(f)
+	entries := []logEntry{}
+	var offset int64
+	header := make([]byte, walHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return entries, offset, nil
+		}
+		size := binary.BigEndian.Uint32(header[0:4])
+		next := offset + walHeaderSize + int64(size)
+		if next > info.Size() {
+			return entries, offset, nil
+		}
+		if size > walMaxRecordSize {
+			return nil, 0, fmt.Errorf("write-ahead log record at offset %d is %d bytes, more than the %d allowed", offset, size, walMaxRecordSize)
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil, 0, err
+		}
+		var e logEntry
+		bad := crc32.Checksum(payload, walTable) != binary.BigEndian.Uint32(header[4:8])
+		if !bad {
+			bad = json.Unmarshal(payload, &e) != nil
+		}
+		if bad {
+			if next == info.Size() {
+				return entries, offset, nil
+			}
+			return nil, 0, fmt.Errorf("write-ahead log record at offset %d is corrupt and has more of the log after it", offset)
+		}
+		entries = append(entries, e)
+		offset = next
+	}
+}
@@ -2,21 +2,99 @@ package main
 
 import (
 	"Certificates-REST-API/certificate_logic"
+	"flag"
+	"log"
 	"net/http"
+	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/gorilla/handlers"
 )
 
 func main() {
+	//directory used for persistent storage; static in-memory data when empty
+	dataDir := flag.String("data-dir", "", "directory to persist certificates, users and transfers in")
+	//how long transfers stay open when the client gives no expiry
+	transferTTL := flag.Duration("transfer-ttl", certificates.DefaultTransferTTL, "default lifetime of a transfer, 0 for none")
+	//failed passwords before a user is locked out
+	lockoutThreshold := flag.Int("lockout-threshold", certificates.DefaultLockoutPolicy.UserThreshold, "failed logins before a user is locked out, 0 for no lockout")
+	//mail server for mail to users; without one mail is kept in an outbox directory
+	smtpAddr := flag.String("smtp-addr", "", "host:port of the SMTP server to send mail through")
+	smtpFrom := flag.String("smtp-from", "certificates@localhost", "sender address of mail to users")
+	smtpUser := flag.String("smtp-user", "", "user to log in to the SMTP server as; the password is read from $SMTP_PASSWORD")
+	outboxDir := flag.String("outbox-dir", "", "directory to keep mail in when no SMTP server is set")
+	//keys certificates and tokens are signed with; kept in the data directory unless set
+	signingKey := flag.String("signing-key", "", "file holding the Ed25519 keys certificates and tokens are signed with, created if missing")
+	//how often the ledger of certificate events is checkpointed
+	checkpointEvery := flag.Duration("checkpoint-every", time.Hour, "time between signed checkpoints of the ledger")
+	//nobody is an admin until one is made here
+	admin := flag.String("admin", "", "ID of a user to give the admin role to on start")
+	flag.Parse()
+
 	//port to be used variable
 	port := "8080"
+
+	//storage backing the API
+	store := certificates.NewMemoryStore()
+	if *dataDir != "" {
+		var err error
+		store, err = certificates.NewFileStore(*dataDir)
+		if err != nil {
+			log.Fatalln("Unable to open data directory", err)
+		}
+	}
+	if *admin != "" {
+		if err := certificates.GrantAdmin(store, *admin); err != nil {
+			log.Fatalln("Unable to make", *admin, "an admin", err)
+		}
+	}
 	//create routes, initialize endpoints
-	router := certificates.NewRouter()
+	lockout := certificates.DefaultLockoutPolicy
+	lockout.UserThreshold = *lockoutThreshold
+	var mailer certificates.Mailer
+	if *smtpAddr != "" {
+		mailer = certificates.NewSMTPMailer(*smtpAddr, *smtpFrom, *smtpUser, os.Getenv("SMTP_PASSWORD"))
+	} else {
+		//mail kept only in memory would never reach anyone
+		if *outboxDir == "" {
+			*outboxDir = "outbox"
+			log.Println("Warning: no -smtp-addr or -outbox-dir given, keeping mail to users in", *outboxDir)
+		}
+		outbox, err := certificates.NewOutbox(*outboxDir)
+		if err != nil {
+			log.Fatalln("Unable to open outbox directory", err)
+		}
+		mailer = outbox
+	}
+	opts := []certificates.Option{
+		certificates.WithTransferTTL(*transferTTL),
+		certificates.WithLockout(lockout),
+		certificates.WithMailer(mailer),
+	}
+	if *signingKey == "" && *dataDir != "" {
+		*signingKey = filepath.Join(*dataDir, "signing.key")
+	}
+	//without a key file signatures only verify until the process restarts
+	keys, err := certificates.NewKeyManager(*signingKey)
+	if err != nil {
+		log.Fatalln("Unable to load signing keys", err)
+	}
+	opts = append(opts, certificates.WithKeyManager(keys))
+	router := certificates.NewRouter(store, opts...)
+
+	//expire overdue transfers in the background
+	stopSweeper := certificates.StartTransferSweeper(store, time.Minute, time.Now)
+	defer stopSweeper()
+	//sign checkpoints of the ledger in the background
+	stopCheckpointer := certificates.StartCheckpointer(store, keys, *checkpointEvery, time.Now)
+	defer stopCheckpointer()
 
 	//CORS Settings
 	allowedOrigins := handlers.AllowedOrigins([]string{"*"})
 	allowedMethods := handlers.AllowedMethods([]string{"GET", "POST", "DELETE", "PUT"})
+	allowedHeaders := handlers.AllowedHeaders([]string{"Authorization", "Content-Type", "X-API-Key", "X-OTP"})
 
 	// Launch with CORS
-	http.ListenAndServe(":"+port, handlers.CORS(allowedOrigins, allowedMethods)(router))
+	http.ListenAndServe(":"+port, handlers.CORS(allowedOrigins, allowedMethods, allowedHeaders)(router))
 }